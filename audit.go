@@ -0,0 +1,250 @@
+package bqin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/kayac/bqin/internal/logger"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+const (
+	AuditStatusSuccess = "success"
+	AuditStatusSkipped = "skipped"
+	AuditStatusFailed  = "failed"
+)
+
+// AuditConfig is the audit sinks, one record per job is written to each sink.
+type AuditConfig struct {
+	// the table is created with AuditSchema when not exists.
+	BigQuery *LoadingDestination `yaml:"bigquery,omitempty"`
+	// records are appended as NDJSON, for development.
+	File string `yaml:"file,omitempty"`
+}
+
+func (c *AuditConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.BigQuery == nil && c.File == "" {
+		return errors.New("bigquery or file is required")
+	}
+	if d := c.BigQuery; d != nil {
+		if d.ProjectID == "" || d.Dataset == "" || d.Table == "" {
+			return errors.New("bigquery requires project_id, dataset and table")
+		}
+	}
+	return nil
+}
+
+// AuditRecord is the result of a job, which S3 object is loaded to which table and when.
+type AuditRecord struct {
+	MessageID     string    `json:"message_id" bigquery:"message_id"`
+	S3URI         string    `json:"s3_uri" bigquery:"s3_uri"`
+	ETag          string    `json:"etag" bigquery:"etag"`
+	Size          int64     `json:"size" bigquery:"size"`
+	Rule          string    `json:"rule" bigquery:"rule"`
+	Table         string    `json:"table" bigquery:"table"`
+	BigQueryJobID string    `json:"bigquery_job_id" bigquery:"bigquery_job_id"`
+	OutputRows    int64     `json:"output_rows" bigquery:"output_rows"`
+	OutputBytes   int64     `json:"output_bytes" bigquery:"output_bytes"`
+	Status        string    `json:"status" bigquery:"status"`
+	Error         string    `json:"error" bigquery:"error"`
+	StartedAt     time.Time `json:"started_at" bigquery:"started_at"`
+	FinishedAt    time.Time `json:"finished_at" bigquery:"finished_at"`
+	// seconds
+	TransportDuration float64 `json:"transport_duration" bigquery:"transport_duration"`
+	LoadDuration      float64 `json:"load_duration" bigquery:"load_duration"`
+}
+
+func newAuditRecord(receiptHandle *ReceiptHandle, job *Job) *AuditRecord {
+	return &AuditRecord{
+		MessageID: receiptHandle.MessageID(),
+		S3URI:     job.Source.String(),
+		Rule:      job.Rule,
+		Table:     job.LoadingDestination.String(),
+		StartedAt: time.Now(),
+	}
+}
+
+func (r *AuditRecord) finish(status string, err error) {
+	r.Status = status
+	if err != nil {
+		r.Error = err.Error()
+	}
+	r.FinishedAt = time.Now()
+}
+
+// AuditSchema is the fixed schema of the audit table, partitioned by started_at.
+var AuditSchema = func() bigquery.Schema {
+	schema, err := bigquery.InferSchema(AuditRecord{})
+	if err != nil {
+		panic(err)
+	}
+	for _, f := range schema {
+		f.Required = false
+	}
+	return schema
+}()
+
+type auditSink interface {
+	write(ctx context.Context, record *AuditRecord) error
+}
+
+// Auditor writes audit records to sinks. failures of sinks are only logged, the message is not failed.
+type Auditor struct {
+	sinks []auditSink
+}
+
+func NewAuditor(conf *AuditConfig, opts ...option.ClientOption) *Auditor {
+	a := &Auditor{}
+	if conf == nil {
+		return a
+	}
+	if conf.BigQuery != nil {
+		a.sinks = append(a.sinks, newAuditBigQuerySink(conf.BigQuery, opts))
+	}
+	if conf.File != "" {
+		a.sinks = append(a.sinks, &auditFileSink{path: conf.File})
+	}
+	return a
+}
+
+func (a *Auditor) Audit(ctx context.Context, record *AuditRecord) {
+	if a == nil {
+		return
+	}
+	for _, sink := range a.sinks {
+		if err := sink.write(ctx, record); err != nil {
+			logger.FromContext(ctx).Warnf("[audit] write record failed: %s", err)
+		}
+	}
+}
+
+// AuditClientRetryInterval is the interval to retry creating the BigQuery client of the audit sink after failed.
+// the interval is doubled on each failure up to AuditClientMaxRetryInterval, records are dropped until it is created.
+var (
+	AuditClientRetryInterval    = 10 * time.Second
+	AuditClientMaxRetryInterval = 5 * time.Minute
+)
+
+var newAuditBigQueryClient = newBigQueryClient
+
+type auditBigQuerySink struct {
+	dest *LoadingDestination
+	opts []option.ClientOption
+
+	mu sync.Mutex
+	// client is created at first write and shared by all records.
+	client  *bigquery.Client
+	created bool
+	// err is the last error of creating the client, retried after retryAt.
+	err      error
+	retryAt  time.Time
+	interval time.Duration
+}
+
+func newAuditBigQuerySink(dest *LoadingDestination, opts []option.ClientOption) *auditBigQuerySink {
+	return &auditBigQuerySink{
+		dest: dest,
+		opts: opts,
+	}
+}
+
+func (s *auditBigQuerySink) write(ctx context.Context, record *AuditRecord) error {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return err
+	}
+	table := client.Dataset(s.dest.Dataset).Table(s.dest.Table)
+	if err := s.createTable(ctx, table); err != nil {
+		return err
+	}
+	if err := table.Inserter().Put(ctx, record); err != nil {
+		return errors.Wrapf(err, "insert to %s failed", s.dest)
+	}
+	return nil
+}
+
+// getClient creates the client lazily, failures are retried with exponential backoff.
+func (s *auditBigQuerySink) getClient(ctx context.Context) (*bigquery.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+	now := time.Now()
+	if s.err != nil && now.Before(s.retryAt) {
+		return nil, s.err
+	}
+	client, err := newAuditBigQueryClient(context.Background(), s.dest.ProjectID, s.opts)
+	if err != nil {
+		s.interval *= 2
+		if s.interval == 0 {
+			s.interval = AuditClientRetryInterval
+		}
+		if s.interval > AuditClientMaxRetryInterval {
+			s.interval = AuditClientMaxRetryInterval
+		}
+		s.err = errors.Wrap(err, "can not get bigquery client")
+		s.retryAt = now.Add(s.interval)
+		logger.FromContext(ctx).Debugf("[audit] retry creating bigquery client after %s", s.interval)
+		return nil, s.err
+	}
+	s.client, s.err = client, nil
+	return client, nil
+}
+
+// createTable creates the audit table at first, an existing table is used as is.
+func (s *auditBigQuerySink) createTable(ctx context.Context, table *bigquery.Table) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.created {
+		return nil
+	}
+	err := table.Create(ctx, &bigquery.TableMetadata{
+		Schema: AuditSchema,
+		TimePartitioning: &bigquery.TimePartitioning{
+			Field: "started_at",
+		},
+	})
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusConflict {
+		err = nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "create table %s failed", s.dest)
+	}
+	logger.FromContext(ctx).Debugf("[audit] table %s is ready", s.dest)
+	s.created = true
+	return nil
+}
+
+type auditFileSink struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (s *auditFileSink) write(ctx context.Context, record *AuditRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "marshal record failed")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open audit file failed")
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return errors.Wrap(err, "write audit file failed")
+	}
+	return nil
+}
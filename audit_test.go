@@ -0,0 +1,164 @@
+package bqin_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/kayac/bqin"
+	"github.com/kayac/bqin/internal/logger"
+	"google.golang.org/api/option"
+)
+
+func TestAudit(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	mgr := NewStubManager("testdata/s3/")
+	defer mgr.Close()
+	if err := mgr.SQS.SendMessagesFromFile([]string{"testdata/sqs/user.json"}); err != nil {
+		t.Fatalf("Prepare failed, load message body %s:", err)
+	}
+	conf, err := bqin.LoadConfig("testdata/config/audit.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	mgr.OverwriteConfig(conf)
+	conf.Audit.File = filepath.Join(t.TempDir(), "audit.ndjson")
+
+	err = bqin.NewApp(conf).Run(context.Background(), bqin.WithExitNoMessage(true), bqin.WithExitError(true))
+	if err != nil {
+		t.Fatalf("unexpected run error: %s", err)
+	}
+
+	if _, ok := mgr.BigQuery.CreatedTables()["bqin-test-gcp.ops.load_audit"]; !ok {
+		t.Errorf("audit table is not created: %v", mgr.BigQuery.CreatedTables())
+	}
+	rows := mgr.BigQuery.InsertedRows()["bqin-test-gcp.ops.load_audit"]
+	if len(rows) != 1 {
+		t.Fatalf("unexpected inserted rows: %v", rows)
+	}
+	expected := map[string]interface{}{
+		"s3_uri": "s3://bqin.bucket.test/data/user/snapshot_at=20200210/part-0001.csv",
+		"rule":   "s3://bqin.bucket.test/data/user",
+		"table":  "bqin-test-gcp.test.user",
+		"status": bqin.AuditStatusSuccess,
+		"error":  "",
+	}
+	for k, v := range expected {
+		if rows[0][k] != v {
+			t.Errorf("inserted row %s is unexpected: %v", k, rows[0][k])
+		}
+	}
+
+	f, err := os.Open(conf.Audit.File)
+	if err != nil {
+		t.Fatalf("audit file is not written: %s", err)
+	}
+	defer f.Close()
+	var records []*bqin.AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r bqin.AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("audit file is not ndjson: %s", err)
+		}
+		records = append(records, &r)
+	}
+	if len(records) != 1 {
+		t.Fatalf("unexpected records: %d", len(records))
+	}
+	r := records[0]
+	t.Logf("%#v", r)
+	if r.MessageID == "" || r.ETag == "" || r.Size == 0 || r.BigQueryJobID == "" {
+		t.Errorf("record is not filled: %#v", r)
+	}
+	if r.OutputRows != 1 || r.OutputBytes == 0 {
+		t.Errorf("unexpected load statistics: rows=%d bytes=%d", r.OutputRows, r.OutputBytes)
+	}
+	if r.FinishedAt.Before(r.StartedAt) {
+		t.Errorf("unexpected timings: %s - %s", r.StartedAt, r.FinishedAt)
+	}
+}
+
+func TestAuditorReusesClient(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	mgr := NewStubManager("testdata/s3/")
+	defer mgr.Close()
+	conf, err := bqin.LoadConfig("testdata/config/audit.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	mgr.OverwriteConfig(conf)
+	conf.Audit.File = ""
+
+	auditor := (&bqin.Factory{Config: conf}).NewAuditor()
+	for i := 0; i < 3; i++ {
+		auditor.Audit(context.Background(), &bqin.AuditRecord{
+			S3URI:  "s3://bqin.bucket.test/data/user/part-0001.csv",
+			Status: bqin.AuditStatusSuccess,
+		})
+	}
+	if rows := mgr.BigQuery.InsertedRows()["bqin-test-gcp.ops.load_audit"]; len(rows) != 3 {
+		t.Errorf("unexpected inserted rows: %d", len(rows))
+	}
+}
+
+func TestAuditorRetriesClient(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	mgr := NewStubManager("testdata/s3/")
+	defer mgr.Close()
+	conf, err := bqin.LoadConfig("testdata/config/audit.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	mgr.OverwriteConfig(conf)
+	conf.Audit.File = ""
+
+	cases := []struct {
+		Comment  string
+		Interval time.Duration
+		Attempts int
+		Rows     int
+	}{
+		{Comment: "retried at next record", Interval: 0, Attempts: 2, Rows: 2},
+		{Comment: "not retried before the interval", Interval: time.Hour, Attempts: 1, Rows: 0},
+	}
+	for _, c := range cases {
+		t.Run(c.Comment, func(t *testing.T) {
+			defer func(interval time.Duration) {
+				bqin.AuditClientRetryInterval = interval
+			}(bqin.AuditClientRetryInterval)
+			bqin.AuditClientRetryInterval = c.Interval
+			before := len(mgr.BigQuery.InsertedRows()["bqin-test-gcp.ops.load_audit"])
+
+			var attempts int
+			restore := bqin.SetNewAuditBigQueryClient(func(ctx context.Context, projectID string, opts []option.ClientOption) (*bigquery.Client, error) {
+				attempts++
+				if attempts == 1 {
+					return nil, errors.New("temporary failure")
+				}
+				return bigquery.NewClient(ctx, projectID, opts...)
+			})
+			defer restore()
+
+			auditor := (&bqin.Factory{Config: conf}).NewAuditor()
+			for i := 0; i < 3; i++ {
+				auditor.Audit(context.Background(), &bqin.AuditRecord{
+					S3URI:  "s3://bqin.bucket.test/data/user/part-0001.csv",
+					Status: bqin.AuditStatusSuccess,
+				})
+			}
+			if attempts != c.Attempts {
+				t.Errorf("unexpected attempts of creating client: %d", attempts)
+			}
+			if rows := mgr.BigQuery.InsertedRows()["bqin-test-gcp.ops.load_audit"]; len(rows)-before != c.Rows {
+				t.Errorf("unexpected inserted rows: %d", len(rows)-before)
+			}
+		})
+	}
+}
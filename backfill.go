@@ -0,0 +1,270 @@
+package bqin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kayac/bqin/internal/logger"
+	"github.com/pkg/errors"
+)
+
+// BackfillMaxURIsPerLoad is the max number of source URIs of a load job by backfill,
+// the limit of a load job of BigQuery is 10,000.
+var BackfillMaxURIsPerLoad = 10000
+
+// BackfillOption is the options of Backfill.
+type BackfillOption struct {
+	// objects last modified in [Since, Until) are loaded. zero value means unbounded.
+	Since time.Time
+	Until time.Time
+	// only resolves jobs, objects are neither transported nor loaded.
+	DryRun bool
+	// number of objects in a micro batch (default 1). jobs to the same table in a batch are loaded by one load job.
+	BatchSize int
+	// the last key of completed batches is saved to this file, and the next backfill is resumed after the key.
+	CheckpointFile string
+}
+
+func (o *BackfillOption) inRange(t time.Time) bool {
+	if !o.Since.IsZero() && t.Before(o.Since) {
+		return false
+	}
+	if !o.Until.IsZero() && !t.Before(o.Until) {
+		return false
+	}
+	return true
+}
+
+// BackfillProgress is the counts of processed objects.
+type BackfillProgress struct {
+	Listed    int64
+	Objects   int64
+	Jobs      int64
+	Skipped   int64
+	Unmatched int64
+	Bytes     int64
+	LastKey   string
+}
+
+func (p *BackfillProgress) String() string {
+	return fmt.Sprintf("listed=%d objects=%d jobs=%d skipped=%d unmatched=%d bytes=%d last_key=%s",
+		p.Listed, p.Objects, p.Jobs, p.Skipped, p.Unmatched, p.Bytes, p.LastKey)
+}
+
+type backfillCheckpoint struct {
+	Prefix    string    `json:"prefix"`
+	LastKey   string    `json:"last_key"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func loadBackfillCheckpoint(path string, prefix *url.URL) (*backfillCheckpoint, error) {
+	cp := &backfillCheckpoint{Prefix: prefix.String()}
+	if path == "" {
+		return cp, nil
+	}
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read checkpoint failed")
+	}
+	var saved backfillCheckpoint
+	if err := json.Unmarshal(bs, &saved); err != nil {
+		return nil, errors.Wrap(err, "parse checkpoint failed")
+	}
+	if saved.Prefix != cp.Prefix {
+		return nil, errors.Errorf("checkpoint %s is for other prefix %s", path, saved.Prefix)
+	}
+	return &saved, nil
+}
+
+func (cp *backfillCheckpoint) save(path string) error {
+	if path == "" {
+		return nil
+	}
+	cp.UpdatedAt = time.Now()
+	bs, err := json.Marshal(cp)
+	if err != nil {
+		return errors.Wrap(err, "marshal checkpoint failed")
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0644); err != nil {
+		return errors.Wrap(err, "write checkpoint failed")
+	}
+	return errors.Wrap(os.Rename(tmp, path), "write checkpoint failed")
+}
+
+// Backfill lists objects under the prefix and loads them by rules without SQS messages.
+// backfill stops at the first failed batch, and can be resumed by the checkpoint file.
+func (app *App) Backfill(ctx context.Context, prefix *url.URL, opt *BackfillOption) (*BackfillProgress, error) {
+	if opt == nil {
+		opt = &BackfillOption{}
+	}
+	cp, err := loadBackfillCheckpoint(opt.CheckpointFile, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if cp.LastKey != "" {
+		logger.FromContext(ctx).Infof("[backfill] resume after %s", cp.LastKey)
+	}
+	size := opt.BatchSize
+	if size <= 0 {
+		size = 1
+	}
+	progress := &BackfillProgress{LastKey: cp.LastKey}
+	batch := make([]*S3Record, 0, size)
+	flush := func(lastKey string) error {
+		if len(batch) > 0 {
+			if err := app.backfillBatch(ctx, batch, opt, progress); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+		progress.LastKey = lastKey
+		if !opt.DryRun {
+			cp.LastKey = lastKey
+			if err := cp.save(opt.CheckpointFile); err != nil {
+				return err
+			}
+		}
+		logger.FromContext(ctx).Infof("[backfill] %s", progress)
+		return nil
+	}
+	err = app.List(ctx, prefix, cp.LastKey, func(obj *S3ListedObject) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		progress.Listed++
+		if !opt.inRange(obj.LastModified) {
+			return nil
+		}
+		progress.Objects++
+		batch = append(batch, &S3Record{
+			URL:       obj.URL,
+			EventTime: obj.LastModified,
+			Size:      obj.Size,
+		})
+		if len(batch) < size {
+			return nil
+		}
+		return flush(strings.TrimPrefix(obj.Path, "/"))
+	})
+	if err != nil {
+		return progress, err
+	}
+	if len(batch) > 0 {
+		last := batch[len(batch)-1]
+		if err := flush(strings.TrimPrefix(last.Path, "/")); err != nil {
+			return progress, err
+		}
+	}
+	return progress, nil
+}
+
+type backfillLoad struct {
+	rule    string
+	job     *LoadingJob
+	records []*AuditRecord
+}
+
+// backfillBatch transports objects of the batch, and loads them by one load job per destination and post load queries.
+func (app *App) backfillBatch(ctx context.Context, records []*S3Record, opt *BackfillOption, progress *BackfillProgress) (err error) {
+	ctx, span := startSpan(ctx, "bqin.backfill")
+	defer func() {
+		endSpan(span, err)
+	}()
+	ctx = withObjectCache(ctx)
+	jobs, unmatched, err := app.ResolveWithUnmatched(ctx, records)
+	if err != nil {
+		return newJobError("resolve", err)
+	}
+	progress.Unmatched += int64(len(unmatched))
+
+	transportHandles := make([]*TransportJobHandle, 0, len(jobs))
+	defer func() {
+		cleanupCtx, cancel := cleanupContext(ctx)
+		defer cancel()
+		for _, h := range transportHandles {
+			h.Cleanup(cleanupCtx)
+		}
+	}()
+	loads := make([]*backfillLoad, 0, len(jobs))
+	index := make(map[string]*backfillLoad, len(jobs))
+	for _, job := range jobs {
+		jobCtx := logger.WithFields(ctx,
+			logger.FieldRule, job.Rule,
+			logger.FieldS3URI, job.Source.String(),
+			logger.FieldTable, job.LoadingDestination.String(),
+		)
+		record := newAuditRecord(nil, job)
+		if err := app.Inspect(jobCtx, job); err != nil {
+			if errors.Cause(err) != ErrSkipObject {
+				err = newJobError("inspect", err)
+				record.finish(AuditStatusFailed, err)
+				app.Audit(jobCtx, record)
+				return err
+			}
+			logger.FromContext(jobCtx).Infof("[backfill] skipped: %s", err)
+			progress.Skipped++
+			record.finish(AuditStatusSkipped, err)
+			app.Audit(jobCtx, record)
+			continue
+		}
+		progress.Jobs++
+		if opt.DryRun {
+			logger.FromContext(jobCtx).Infof("[backfill][dry-run] %s", job)
+			continue
+		}
+		logger.FromContext(jobCtx).Debugf("[backfill] %s", job)
+		transportHandle, err := app.transportJob(jobCtx, job, record)
+		if transportHandle != nil {
+			transportHandles = append(transportHandles, transportHandle)
+		}
+		if err != nil {
+			record.finish(AuditStatusFailed, err)
+			app.Audit(jobCtx, record)
+			return err
+		}
+		progress.Bytes += record.Size
+
+		// post load queries are expanded by captures of each object, so they are also the key.
+		key := strings.Join(append([]string{job.Rule, job.LoadingDestination.String()}, job.expandQueries()...), "\n")
+		if l, ok := index[key]; ok && len(l.job.GCSRef.URIs)+len(job.GCSRef.URIs) <= BackfillMaxURIsPerLoad {
+			l.job.GCSRef.URIs = append(l.job.GCSRef.URIs, job.GCSRef.URIs...)
+			l.records = append(l.records, record)
+			continue
+		}
+		merged := *job.LoadingJob
+		ref := *job.GCSRef
+		ref.URIs = append([]string{}, job.GCSRef.URIs...)
+		merged.GCSRef = &ref
+		l := &backfillLoad{rule: job.Rule, job: &merged, records: []*AuditRecord{record}}
+		index[key] = l
+		loads = append(loads, l)
+	}
+
+	for _, l := range loads {
+		loadCtx := logger.WithFields(ctx, logger.FieldTable, l.job.LoadingDestination.String())
+		logger.FromContext(loadCtx).Infof("[backfill] load %d objects, %s", len(l.job.GCSRef.URIs), l.job)
+		err := app.loadJob(loadCtx, l.rule, l.job, l.records...)
+		status := AuditStatusSuccess
+		if err != nil {
+			status = AuditStatusFailed
+		}
+		for _, record := range l.records {
+			record.finish(status, err)
+			app.Audit(loadCtx, record)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package bqin_test
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kayac/bqin"
+	"github.com/kayac/bqin/internal/logger"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestBackfill(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	prefix := MustParseURL("s3://bqin.bucket.test/data/user/")
+	expectedURIs := []string{
+		"gs://bqin-import-tmp/data/user/snapshot_at=20200210/part-0001.csv",
+		"gs://bqin-import-tmp/data/user/snapshot_at=20200211/part-0001.csv",
+		"gs://bqin-import-tmp/data/user/snapshot_at=20200211/part-0002.csv",
+	}
+
+	t.Run("micro batch and resume", func(t *testing.T) {
+		mgr := NewStubManager("testdata/s3/")
+		defer mgr.Close()
+		conf, err := bqin.LoadConfig("testdata/config/backfill.yaml")
+		if err != nil {
+			t.Fatalf("Prepare failed, load configure  %s:", err)
+		}
+		mgr.OverwriteConfig(conf)
+		app := bqin.NewApp(conf)
+		opt := &bqin.BackfillOption{
+			BatchSize:      2,
+			CheckpointFile: filepath.Join(t.TempDir(), "checkpoint.json"),
+		}
+		progress, err := app.Backfill(context.Background(), prefix, opt)
+		if err != nil {
+			t.Fatalf("unexpected backfill error: %s", err)
+		}
+		t.Log(progress)
+		if progress.Jobs != 3 || progress.Listed != 4 || progress.Unmatched != 1 {
+			t.Errorf("unexpected progress: %s", progress)
+		}
+		if progress.LastKey != "data/user/snapshot_at=20200211/part-0002.csv" {
+			t.Errorf("unexpected last key: %s", progress.LastKey)
+		}
+		loaded := mgr.BigQuery.LoadedData()["bqin-test-gcp.test.user"]
+		if !reflect.DeepEqual(loaded, expectedURIs) {
+			t.Errorf("unexpected loaded data: %s", pretty.Compare(loaded, expectedURIs))
+		}
+
+		progress, err = app.Backfill(context.Background(), prefix, opt)
+		if err != nil {
+			t.Fatalf("unexpected backfill error: %s", err)
+		}
+		if progress.Listed != 0 {
+			t.Errorf("resumed backfill must list nothing: %s", progress)
+		}
+		if n := len(mgr.BigQuery.LoadedData()["bqin-test-gcp.test.user"]); n != len(expectedURIs) {
+			t.Errorf("objects are loaded again: %d", n)
+		}
+
+		_, err = app.Backfill(context.Background(), MustParseURL("s3://bqin.bucket.test/data/"), opt)
+		if err == nil {
+			t.Error("checkpoint of other prefix must be error")
+		}
+	})
+
+	t.Run("dry run and time range", func(t *testing.T) {
+		mgr := NewStubManager("testdata/s3/")
+		defer mgr.Close()
+		conf, err := bqin.LoadConfig("testdata/config/backfill.yaml")
+		if err != nil {
+			t.Fatalf("Prepare failed, load configure  %s:", err)
+		}
+		mgr.OverwriteConfig(conf)
+		app := bqin.NewApp(conf)
+
+		progress, err := app.Backfill(context.Background(), prefix, &bqin.BackfillOption{DryRun: true})
+		if err != nil {
+			t.Fatalf("unexpected backfill error: %s", err)
+		}
+		if progress.Jobs != 3 {
+			t.Errorf("unexpected progress: %s", progress)
+		}
+		progress, err = app.Backfill(context.Background(), prefix, &bqin.BackfillOption{
+			Until: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		})
+		if err != nil {
+			t.Fatalf("unexpected backfill error: %s", err)
+		}
+		if progress.Listed != 4 || progress.Objects != 0 {
+			t.Errorf("unexpected progress: %s", progress)
+		}
+		if loaded := mgr.BigQuery.LoadedData(); len(loaded) != 0 {
+			t.Errorf("dry run must not load: %v", loaded)
+		}
+	})
+
+	t.Run("post load queries and max uris", func(t *testing.T) {
+		mgr := NewStubManager("testdata/s3/")
+		defer mgr.Close()
+		conf, err := bqin.LoadConfig("testdata/config/backfill_post_load.yaml")
+		if err != nil {
+			t.Fatalf("Prepare failed, load configure  %s:", err)
+		}
+		mgr.OverwriteConfig(conf)
+		app := bqin.NewApp(conf)
+
+		// objects of 20200211 are loaded by one job, and 20200210 is not merged because the query differs.
+		if _, err := app.Backfill(context.Background(), prefix, &bqin.BackfillOption{BatchSize: 10}); err != nil {
+			t.Fatalf("unexpected backfill error: %s", err)
+		}
+		if n := mgr.BigQuery.NumberOfLoadJobsCreated; n != 2 {
+			t.Errorf("unexpected number of load jobs: %d", n)
+		}
+		expectedQueries := []string{
+			"DELETE FROM `bqin-test-gcp.test.user` WHERE snapshot_at < '20200210'",
+			"DELETE FROM `bqin-test-gcp.test.user` WHERE snapshot_at < '20200211'",
+		}
+		if queries := mgr.BigQuery.ExecutedQueries(); !reflect.DeepEqual(queries, expectedQueries) {
+			t.Errorf("unexpected queries: %s", pretty.Compare(queries, expectedQueries))
+		}
+		if loaded := mgr.BigQuery.LoadedData()["bqin-test-gcp.test.user"]; !reflect.DeepEqual(loaded, expectedURIs) {
+			t.Errorf("unexpected loaded data: %s", pretty.Compare(loaded, expectedURIs))
+		}
+
+		defer func(n int) {
+			bqin.BackfillMaxURIsPerLoad = n
+		}(bqin.BackfillMaxURIsPerLoad)
+		bqin.BackfillMaxURIsPerLoad = 1
+		mgr.BigQuery.NumberOfLoadJobsCreated = 0
+		if _, err := app.Backfill(context.Background(), prefix, &bqin.BackfillOption{BatchSize: 10}); err != nil {
+			t.Fatalf("unexpected backfill error: %s", err)
+		}
+		if n := mgr.BigQuery.NumberOfLoadJobsCreated; n != 3 {
+			t.Errorf("unexpected number of load jobs with max uris: %d", n)
+		}
+	})
+}
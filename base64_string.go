@@ -24,6 +24,10 @@ func (s *Base64String) UnmarshalYAML(unmarshal func(interface{}) error) (err err
 	return
 }
 
+func (s Base64String) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
+
 func (s Base64String) Bytes() []byte {
 	return []byte(s)
 }
@@ -2,16 +2,24 @@ package bqin
 
 import (
 	"context"
-	"errors"
+	"time"
 
 	"github.com/kayac/bqin/internal/logger"
+	"github.com/pkg/errors"
 )
 
 type App struct {
 	*Receiver
 	*Resolver
+	*Inspector
+	*UnmatchedHandler
+	*FailureHandler
+	*Notifier
 	*Transporter
 	*Loader
+	*Auditor
+
+	Health *HealthChecker
 }
 
 func NewApp(conf *Config) *App {
@@ -20,12 +28,26 @@ func NewApp(conf *Config) *App {
 }
 
 func (app *App) Run(ctx context.Context, opts ...RunOption) error {
-	logger.Infof("Starting up bqin worker")
-	defer logger.Infof("Shutdown bqin worker")
+	log := logger.FromContext(ctx)
+	log.Infof("Starting up bqin worker")
+	defer log.Infof("Shutdown bqin worker")
 	settings := &RunSettings{}
 	for _, opt := range opts {
 		opt.Apply(settings)
 	}
+	if settings.DryRun && !settings.ExitNoMessage {
+		// a worker waiting for messages would hold live messages, or receive the released messages again and again.
+		return errors.New("dry run is supported only until no message is received, such as batch")
+	}
+	// messages of dry run are kept invisible while receiving, for planning each message once.
+	// they are released at the end, for other workers not to wait for the visibility timeout.
+	defer func() {
+		for _, h := range settings.dryRunHandles {
+			if err := h.Release(); err != nil {
+				h.Errorf("%s", err)
+			}
+		}
+	}()
 	if settings.QueueName != "" {
 		defaultQueueName := app.GetQueueName()
 		app.SetQueueName(settings.QueueName)
@@ -33,20 +55,23 @@ func (app *App) Run(ctx context.Context, opts ...RunOption) error {
 	}
 
 	for {
+		app.Health.beat()
 		select {
 		case <-ctx.Done():
 			if err := ctx.Err(); err != context.Canceled {
 				return err
 			}
-			logger.Infof("canceled")
+			log.Infof("canceled")
 			return nil
 		default:
 		}
 
-		switch err := app.batch(context.Background()); err {
+		switch err := app.batch(ctx, settings); err {
+		case errShutdown:
+			//receiving is canceled, and returns at the next iteration
 		case ErrNoMessage:
 			if settings.ExitNoMessage {
-				logger.Infof("success all")
+				log.Infof("success all")
 				return nil
 			}
 		case nil:
@@ -55,37 +80,138 @@ func (app *App) Run(ctx context.Context, opts ...RunOption) error {
 			if settings.ExitError {
 				return err
 			}
-			logger.Errorf("process failed. reason:%s", err)
+			log.Errorf("process failed. reason:%s", err)
 		}
 	}
 }
 
-func (app *App) batch(ctx context.Context) error {
-	urls, receiptHandle, err := app.Receive(ctx)
+func (app *App) batch(ctx context.Context, settings *RunSettings) (err error) {
+	ctx, span := startSpan(ctx, "bqin.message")
+	defer func() {
+		endSpan(span, err)
+	}()
+	records, receiptHandle, err := app.Receive(ctx)
 	defer receiptHandle.Cleanup()
-	if err != nil {
+	if receiptHandle == nil && ctx.Err() != nil {
+		return errShutdown
+	}
+	if receiptHandle != nil {
+		// the slot is acquired after receiving, for idle queues not to hold slots while long polling.
+		// the received message waits for the slot, and the worker beats the health check while waiting.
+		if err := settings.scheduler.acquire(ctx, settings.schedulerQueue, app.Health.beat); err != nil {
+			// shutdown while waiting, the message is not started and is released for other workers.
+			if err := receiptHandle.Release(); err != nil {
+				receiptHandle.Errorf("%s", err)
+			}
+			return errShutdown
+		}
+		defer settings.scheduler.release()
+		span.SetAttributes(attrMessageID.String(receiptHandle.MessageID()))
+		ctx = receiptHandle.WithLogFields(ctx)
+		// attributes of objects are cached only while processing the message.
+		ctx = withObjectCache(ctx)
+		// receiving stops at shutdown, but the received message is processed until the drain timeout.
+		var cancel context.CancelFunc
+		ctx, cancel = drainContext(ctx, settings.DrainTimeout)
+		defer cancel()
+	}
+	if err == nil && settings.DryRun {
+		settings.dryRunHandles = append(settings.dryRunHandles, receiptHandle)
+		return app.dryRun(ctx, receiptHandle, records)
+	}
+	if err == nil {
+		err = app.process(ctx, receiptHandle, records)
+	}
+	if err == nil || err == ErrNoMessage {
 		return err
 	}
-	jobs := app.Resolve(urls)
-	if len(jobs) == 0 {
-		return errors.New("nothing to do")
+	if receiptHandle != nil && ctx.Err() != nil {
+		return app.interrupt(receiptHandle, err)
+	}
+	metricMessagesFailed.WithLabelValues(string(ErrorClassOf(err))).Inc()
+	if err == ErrMaxRetry {
+		app.notify(ctx, NotifyMaxRetry, receiptHandle, err)
+		return err
+	}
+	routed, routeErr := app.HandleFailure(ctx, receiptHandle, err)
+	if routeErr != nil {
+		receiptHandle.Errorf("%s", routeErr)
+	}
+	if !routed {
+		if receiptHandle.IsLastReceive() {
+			app.notify(ctx, NotifyDeadLetter, receiptHandle, err)
+		} else {
+			app.notify(ctx, NotifyJobFailure, receiptHandle, err)
+		}
+		return err
+	}
+	app.notify(ctx, NotifyDeadLetter, receiptHandle, err)
+	receiptHandle.Errorf("process failed by permanent error. reason:%s", err)
+	if err := receiptHandle.Complete(); err != nil {
+		app.notify(ctx, NotifyMaxRetry, receiptHandle, err)
+		return err
+	}
+	return nil
+}
+
+// interrupt releases the message canceled by shutdown, for retrying by other workers immediately.
+// it is neither routed to the failure queue nor notified.
+func (app *App) interrupt(receiptHandle *ReceiptHandle, cause error) error {
+	metricMessagesFailed.WithLabelValues(string(ErrorRetryable)).Inc()
+	receiptHandle.Errorf("canceled by shutdown: %s", cause)
+	if err := receiptHandle.Release(); err != nil {
+		receiptHandle.Errorf("%s", err)
+	}
+	return ErrInterrupted
+}
+
+func (app *App) notify(ctx context.Context, kind string, receiptHandle *ReceiptHandle, cause error) {
+	if receiptHandle == nil {
+		return
+	}
+	event := NewNotificationEvent(kind, receiptHandle, cause)
+	event.QueueName = app.GetQueueName()
+	app.Notify(ctx, event)
+}
+
+func (app *App) process(ctx context.Context, receiptHandle *ReceiptHandle, records []*S3Record) error {
+	jobs, unmatched, err := app.ResolveWithUnmatched(ctx, records)
+	if err != nil {
+		return newJobError("resolve", err)
+	}
+	app.CountUnmatched(ctx, unmatched, jobs)
+	if len(jobs) == 0 && len(unmatched) == 0 {
+		return ErrNothingToDo
+	}
+	if err := app.HandleUnmatched(ctx, unmatched); err != nil {
+		//when unmatched.action is error, the message is failed only if no jobs.
+		if err != ErrNothingToDo || len(jobs) == 0 {
+			return err
+		}
 	}
 
 	transportHandles := make([]*TransportJobHandle, 0, len(jobs))
 	defer func() {
+		cleanupCtx, cancel := cleanupContext(ctx)
+		defer cancel()
 		for _, h := range transportHandles {
-			h.Cleanup(ctx)
+			h.Cleanup(cleanupCtx)
 		}
 	}()
 
 	for i, job := range jobs {
 		receiptHandle.Infof("[job %02d]%s", i, job)
-		transportHandle, err := app.Transport(ctx, job.TransportJob)
-		if err != nil {
-			return err
+		transportHandle, err := app.execJob(ctx, receiptHandle, job)
+		if transportHandle != nil {
+			transportHandles = append(transportHandles, transportHandle)
+		}
+		if errors.Cause(err) == ErrSkipObject {
+			receiptHandle.Infof("[job %02d]skipped: %s", i, err)
+			continue
 		}
-		transportHandles = append(transportHandles, transportHandle)
-		if err := app.Load(ctx, job.LoadingJob); err != nil {
+		if err != nil {
+			// completed jobs are not routed to the failure queue, for avoiding duplicated rows by replay.
+			receiptHandle.setFailedJobs(jobs[i:])
 			return err
 		}
 		receiptHandle.Infof("[job %02d]complte job", i)
@@ -93,6 +219,87 @@ func (app *App) batch(ctx context.Context) error {
 	return receiptHandle.Complete()
 }
 
+// execJob inspects the job and runs it, and audits the result.
+// when the object is skipped, returns error caused by ErrSkipObject.
+func (app *App) execJob(ctx context.Context, receiptHandle *ReceiptHandle, job *Job) (*TransportJobHandle, error) {
+	record := newAuditRecord(receiptHandle, job)
+	if err := app.Inspect(ctx, job); err != nil {
+		if errors.Cause(err) == ErrSkipObject {
+			record.finish(AuditStatusSkipped, err)
+			app.Audit(ctx, record)
+			return nil, err
+		}
+		err = newJobError("inspect", err)
+		record.finish(AuditStatusFailed, err)
+		app.Audit(ctx, record)
+		return nil, err
+	}
+	transportHandle, err := app.runJob(ctx, job, record)
+	if err != nil {
+		record.finish(AuditStatusFailed, err)
+	} else {
+		record.finish(AuditStatusSuccess, nil)
+	}
+	app.Audit(ctx, record)
+	return transportHandle, err
+}
+
+// runJob transports the object and loads it, and fills the record with the results.
+// returned handle must be cleaned up even if loading failed.
+func (app *App) runJob(ctx context.Context, job *Job, record *AuditRecord) (_ *TransportJobHandle, err error) {
+	ctx, span := startSpan(ctx, "bqin.job",
+		attrRule.String(job.Rule),
+		attrS3URI.String(job.Source.String()),
+		attrTable.String(job.LoadingDestination.String()),
+	)
+	defer func() {
+		endSpan(span, err)
+	}()
+	ctx = logger.WithFields(ctx,
+		logger.FieldRule, job.Rule,
+		logger.FieldS3URI, job.Source.String(),
+		logger.FieldTable, job.LoadingDestination.String(),
+	)
+	metricJobsInFlight.Inc()
+	defer metricJobsInFlight.Dec()
+	metricJobs.WithLabelValues(job.Rule).Inc()
+	transportHandle, err := app.transportJob(ctx, job, record)
+	if err != nil {
+		return nil, err
+	}
+	return transportHandle, app.loadJob(ctx, job.Rule, job.LoadingJob, record)
+}
+
+func (app *App) transportJob(ctx context.Context, job *Job, record *AuditRecord) (*TransportJobHandle, error) {
+	start := time.Now()
+	transportHandle, err := app.Transport(ctx, job.TransportJob)
+	record.TransportDuration = time.Since(start).Seconds()
+	if err != nil {
+		return nil, err
+	}
+	if info := transportHandle.SourceInfo(); info != nil {
+		record.ETag = info.ETag
+		record.Size = info.Size
+	}
+	return transportHandle, nil
+}
+
+// loadJob loads the job of the rule, and fills the records of the transported objects with the result.
+func (app *App) loadJob(ctx context.Context, rule string, job *LoadingJob, records ...*AuditRecord) error {
+	start := time.Now()
+	result, err := app.LoadWithResult(ctx, job)
+	metricLoadDuration.WithLabelValues(rule).Observe(time.Since(start).Seconds())
+	for _, record := range records {
+		record.LoadDuration = time.Since(start).Seconds()
+		if result != nil {
+			record.BigQueryJobID = result.JobID
+			record.OutputRows = result.OutputRows
+			record.OutputBytes = result.OutputBytes
+		}
+	}
+	return err
+}
+
 type RunOption interface {
 	Apply(*RunSettings)
 }
@@ -101,11 +308,27 @@ type RunSettings struct {
 	ExitNoMessage bool
 	ExitError     bool
 	QueueName     string
+	// only shows plans of jobs, messages are not deleted and are released at the end.
+	// only supported with ExitNoMessage.
+	DryRun bool
+	// the message in process is canceled after this duration since shutdown, zero means no limit.
+	DrainTimeout time.Duration
+
+	// shares max_concurrency over queues, set by MultiApp.
+	scheduler      *fairScheduler
+	schedulerQueue string
+
+	// messages received by dry run, released when Run returns.
+	dryRunHandles []*ReceiptHandle
 }
 
 func (s *RunSettings) Apply(o *RunSettings) {
 	o.ExitNoMessage = s.ExitNoMessage
 	o.ExitError = s.ExitError
+	o.DryRun = s.DryRun
+	o.DrainTimeout = s.DrainTimeout
+	o.scheduler = s.scheduler
+	o.schedulerQueue = s.schedulerQueue
 }
 
 type withExitNoMessage bool
@@ -137,3 +360,23 @@ func (opt withQueueName) Apply(settings *RunSettings) {
 func WithQueueName(queueName string) RunOption {
 	return withQueueName(queueName)
 }
+
+type withDryRun bool
+
+func (opt withDryRun) Apply(settings *RunSettings) {
+	settings.DryRun = bool(opt)
+}
+
+func WithDryRun(flag bool) RunOption {
+	return withDryRun(flag)
+}
+
+type withDrainTimeout time.Duration
+
+func (opt withDrainTimeout) Apply(settings *RunSettings) {
+	settings.DrainTimeout = time.Duration(opt)
+}
+
+func WithDrainTimeout(d time.Duration) RunOption {
+	return withDrainTimeout(d)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/url"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/kayac/bqin"
+	"github.com/kayac/bqin/internal/logger"
+	"github.com/pkg/errors"
+)
+
+type backfillCmd struct {
+	config     string
+	queue      string
+	since      string
+	until      string
+	dryRun     bool
+	batchSize  int
+	checkpoint string
+}
+
+func (r *backfillCmd) Name() string { return "backfill" }
+func (r *backfillCmd) Synopsis() string {
+	return "Load S3 objects under the prefix into BigQuery without SQS"
+}
+
+func (r *backfillCmd) Usage() string {
+	return `bqin backfill [-config <config.yaml> -queue <name> -since <time> -until <time> -batch-size <n> -checkpoint <file> -dry-run -debug] s3://bucket/prefix
+
+List S3 objects under the prefix and load them into BigQuery by the rules, without SQS messages.
+Use this command to load historical objects which never produced S3 event notifications.
+-since and -until are compared with the last modified time of objects, in RFC3339 or 2006-01-02 format.
+With -checkpoint, the last key of completed batches is saved, and the next backfill resumes after it.
+`
+}
+
+func (r *backfillCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&r.config, "config", "config.yaml", "config file path")
+	f.StringVar(&r.queue, "queue", "", "use the rules of the queue of this name in queues")
+	f.StringVar(&r.since, "since", "", "load objects last modified at or after this time")
+	f.StringVar(&r.until, "until", "", "load objects last modified before this time")
+	f.BoolVar(&r.dryRun, "dry-run", false, "only show jobs, objects are not loaded")
+	f.IntVar(&r.batchSize, "batch-size", 1, "number of objects loaded by one load job per table")
+	f.StringVar(&r.checkpoint, "checkpoint", "", "checkpoint file path for resuming")
+}
+
+func (r *backfillCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 {
+		logger.Errorf("s3 prefix is required")
+		return subcommands.ExitUsageError
+	}
+	prefix, err := url.Parse(f.Arg(0))
+	if err != nil || prefix.Scheme != "s3" {
+		logger.Errorf("invalid s3 prefix: %s", f.Arg(0))
+		return subcommands.ExitUsageError
+	}
+	opt := &bqin.BackfillOption{
+		DryRun:         r.dryRun,
+		BatchSize:      r.batchSize,
+		CheckpointFile: r.checkpoint,
+	}
+	if opt.Since, err = parseTimeFlag(r.since); err != nil {
+		logger.Errorf("invalid -since: %s", err)
+		return subcommands.ExitUsageError
+	}
+	if opt.Until, err = parseTimeFlag(r.until); err != nil {
+		logger.Errorf("invalid -until: %s", err)
+		return subcommands.ExitUsageError
+	}
+
+	conf, err := loadConfig(r.config, r.queue)
+	if err != nil {
+		logger.Errorf("load config failed: %s", err)
+		return subcommands.ExitFailure
+	}
+	shutdownTracing := bqin.SetupTracing(conf.Tracing)
+	defer shutdownTracing(context.Background())
+	progress, err := bqin.NewApp(conf).Backfill(ctx, prefix, opt)
+	if err != nil {
+		logger.Errorf("backfill error: %v", err)
+		if progress != nil {
+			logger.Errorf("backfill stopped: %s", progress)
+		}
+		return subcommands.ExitFailure
+	}
+	logger.Infof("backfill completed: %s", progress)
+	return subcommands.ExitSuccess
+}
+
+func parseTimeFlag(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("`%s` is neither RFC3339 nor 2006-01-02", s)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"time"
 
 	"github.com/google/subcommands"
 	"github.com/kayac/bqin"
@@ -10,8 +11,10 @@ import (
 )
 
 type batchCmd struct {
-	config string
-	queue  string
+	config       string
+	queue        string
+	dryRun       bool
+	drainTimeout time.Duration
 }
 
 func (r *batchCmd) Name() string { return "batch" }
@@ -20,17 +23,24 @@ func (r *batchCmd) Synopsis() string {
 }
 
 func (r *batchCmd) Usage() string {
-	return `bqin batch [-config <config.yaml> -queue <queueName> -debug]
+	return `bqin batch [-config <config.yaml> -queue <queueName> -dry-run -drain-timeout <duration> -debug]
 
 Load S3 objects into BigQuery based on messages currently in queue
 Use this command to reprocess messages in the DLQ.
+When queues are defined in the config, all of them are processed, or only the queue of -queue.
 When all messages in the queue have been processed, the process exit with code 0.
+With -dry-run, plans of jobs are shown without transport and load, and messages are not deleted.
+The messages are kept invisible until all messages are received, and are released when the process exits.
+On SIGINT or SIGTERM, receiving stops and the message in process is finished within -drain-timeout.
+The second SIGINT or SIGTERM exits immediately with code 1.
 `
 }
 
 func (r *batchCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&r.config, "config", "config.yaml", "config file path")
-	f.StringVar(&r.queue, "queue", "", "sqs queue name")
+	f.StringVar(&r.queue, "queue", "", "sqs queue name, or the name in queues")
+	f.BoolVar(&r.dryRun, "dry-run", false, "only show plans of jobs, messages are released without deleting")
+	f.DurationVar(&r.drainTimeout, "drain-timeout", bqin.DefaultDrainTimeout, "max duration to finish the message in process at shutdown, 0 means no limit")
 }
 
 func (r *batchCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
@@ -39,11 +49,15 @@ func (r *batchCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{
 		logger.Errorf("load config failed: %s", err)
 		return subcommands.ExitFailure
 	}
-	err = bqin.NewApp(conf).Run(
+	shutdownTracing := bqin.SetupTracing(conf.Tracing)
+	defer shutdownTracing(context.Background())
+	err = bqin.NewMultiApp(conf).Run(
 		ctx,
 		bqin.WithQueueName(r.queue),
 		bqin.WithExitNoMessage(true),
 		bqin.WithExitError(true),
+		bqin.WithDryRun(r.dryRun),
+		bqin.WithDrainTimeout(r.drainTimeout),
 	)
 	if err != nil {
 		logger.Errorf("run error: %v", err)
@@ -3,9 +3,13 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
 	"net/url"
 	"os"
+	"text/tabwriter"
 
 	"github.com/google/subcommands"
 	"github.com/kayac/bqin"
@@ -14,6 +18,10 @@ import (
 
 type checkCmd struct {
 	config string
+	queue  string
+	dryRun bool
+	format string
+	strict bool
 }
 
 func (r *checkCmd) Name() string { return "check" }
@@ -22,47 +30,201 @@ func (r *checkCmd) Synopsis() string {
 }
 
 func (r *checkCmd) Usage() string {
-	return `bqin check [-config <config.yaml>]
+	return `bqin check [-config <config.yaml> -queue <name> -format <json|table> -strict -dry-run]
 
 Check rule matching.
 By entering the AWS S3 resource URL line by line into the standard input, you can check whether the rule matches.
 for example:
 $ echo "s3://bucket.example.com/object/data.txt" | bqin check --config config.yaml
+With -format, all matched rules, captures, destinations and options are written to the standard output.
+With -strict, exit with non-zero status when any URL is unmatched or matched by multiple rules.
+With -dry-run, jobs are also validated by HeadObject of the source and the destination table.
 `
 }
 
 func (r *checkCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&r.config, "config", "config.yaml", "config file path")
+	f.StringVar(&r.queue, "queue", "", "use the rules of the queue of this name in queues")
+	f.BoolVar(&r.dryRun, "dry-run", false, "validate jobs by HeadObject and the destination table")
+	f.StringVar(&r.format, "format", "", "output format: json (a line per URL) or table. results are logged if empty")
+	f.BoolVar(&r.strict, "strict", false, "exit with non-zero status when any URL is unmatched or multiply matched")
+}
+
+type checkResult struct {
+	URL     string            `json:"url"`
+	Matches []*bqin.RuleMatch `json:"matches"`
+	Plans   []string          `json:"plans,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+type checkWriter interface {
+	Write(*checkResult) error
+	Flush() error
 }
 
 func (r *checkCmd) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	conf, err := bqin.LoadConfig(r.config)
+	var w checkWriter
+	switch r.format {
+	case "":
+		w = &checkLogWriter{}
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		w = &checkJSONWriter{enc: enc}
+	case "table":
+		w = newCheckTableWriter(os.Stdout)
+	default:
+		logger.Errorf("format `%s` is not supported", r.format)
+		return subcommands.ExitUsageError
+	}
+	conf, err := loadConfig(r.config, r.queue)
 	if err != nil {
 		logger.Errorf("load config failed: %s", err)
 		return subcommands.ExitFailure
 	}
 	app := bqin.NewApp(conf)
 
+	var violated int
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
-		src, err := url.Parse(scanner.Text())
-		if err != nil {
-			logger.Errorf("url parse error:%s", err)
-			continue
+		result := r.check(ctx, app, scanner.Text())
+		if result.Error != "" || len(result.Matches) != 1 {
+			violated++
 		}
-		logger.Debugf("parsed url:%#v", src)
-		jobs := app.Resolve([]*url.URL{src})
-		if len(jobs) == 0 {
-			logger.Errorf("no match rules")
-			continue
-		}
-		for _, job := range jobs {
-			logger.Infof("mach job: %s", job)
+		if err := w.Write(result); err != nil {
+			logger.Errorf("write result error:%s", err)
+			return subcommands.ExitFailure
 		}
 	}
+	if err := w.Flush(); err != nil {
+		logger.Errorf("write result error:%s", err)
+		return subcommands.ExitFailure
+	}
 	if err := scanner.Err(); err != nil {
 		logger.Errorf("reading standard input error:%s", err)
 		return subcommands.ExitFailure
 	}
+	if r.strict && violated > 0 {
+		logger.Errorf("%d URLs are unmatched, multiply matched or failed", violated)
+		return subcommands.ExitFailure
+	}
 	return subcommands.ExitSuccess
 }
+
+func (r *checkCmd) check(ctx context.Context, app *bqin.App, raw string) *checkResult {
+	result := &checkResult{URL: raw, Matches: []*bqin.RuleMatch{}}
+	src, err := url.Parse(raw)
+	if err != nil {
+		result.Error = fmt.Sprintf("url parse error: %s", err)
+		return result
+	}
+	logger.Debugf("parsed url:%#v", src)
+	record := bqin.NewS3Record(src)
+	if result.Matches, err = app.Explain(ctx, record); err != nil {
+		result.Error = fmt.Sprintf("resolve error: %s", err)
+		return result
+	}
+	if !r.dryRun {
+		return result
+	}
+	jobs, err := app.Resolve(ctx, []*bqin.S3Record{record})
+	if err != nil {
+		result.Error = fmt.Sprintf("resolve error: %s", err)
+		return result
+	}
+	for _, job := range jobs {
+		plan, err := app.Plan(ctx, job)
+		if err != nil {
+			result.Error = fmt.Sprintf("dry run error: %s", err)
+			return result
+		}
+		result.Plans = append(result.Plans, plan.String())
+	}
+	return result
+}
+
+// checkLogWriter logs results as before -format is introduced.
+type checkLogWriter struct{}
+
+func (w *checkLogWriter) Write(result *checkResult) error {
+	if result.Error != "" {
+		logger.Errorf("%s", result.Error)
+		return nil
+	}
+	if len(result.Matches) == 0 {
+		logger.Errorf("no match rules")
+		return nil
+	}
+	if len(result.Matches) > 1 {
+		logger.Infof("warning: %s is matched by %d rules", result.URL, len(result.Matches))
+		for _, m := range result.Matches {
+			logger.Infof("warning: matched rule: %s", m.Rule)
+		}
+	}
+	for _, m := range result.Matches {
+		if m.Resolved {
+			logger.Infof("mach job: transport from %s to %s, and load to %s", result.URL, m.TemporaryURI, m.Destination)
+		}
+	}
+	for _, plan := range result.Plans {
+		logger.Infof("plan: %s", plan)
+	}
+	return nil
+}
+
+func (w *checkLogWriter) Flush() error {
+	return nil
+}
+
+type checkJSONWriter struct {
+	enc *json.Encoder
+}
+
+func (w *checkJSONWriter) Write(result *checkResult) error {
+	return w.enc.Encode(result)
+}
+
+func (w *checkJSONWriter) Flush() error {
+	return nil
+}
+
+type checkTableWriter struct {
+	tw *tabwriter.Writer
+}
+
+func newCheckTableWriter(out io.Writer) *checkTableWriter {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "URL\tINDEX\tRULE\tDESTINATION\tTEMPORARY_URI\tRESOLVED\tCAPTURES\tOPTION")
+	return &checkTableWriter{tw: tw}
+}
+
+func (w *checkTableWriter) Write(result *checkResult) error {
+	if result.Error != "" {
+		_, err := fmt.Fprintf(w.tw, "%s\t-\t(%s)\t-\t-\t-\t-\t-\n", result.URL, result.Error)
+		return err
+	}
+	if len(result.Matches) == 0 {
+		_, err := fmt.Fprintf(w.tw, "%s\t-\t(no match rules)\t-\t-\t-\t-\t-\n", result.URL)
+		return err
+	}
+	for _, m := range result.Matches {
+		captures, err := json.Marshal(m.Captures)
+		if err != nil {
+			return err
+		}
+		option, err := json.Marshal(m.Option)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w.tw, "%s\t%d\t%s\t%s\t%s\t%t\t%s\t%s\n",
+			result.URL, m.Index, m.Rule, m.Destination, m.TemporaryURI, m.Resolved, captures, option)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *checkTableWriter) Flush() error {
+	return w.tw.Flush()
+}
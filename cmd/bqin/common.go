@@ -5,7 +5,6 @@ import (
 	"flag"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 
 	"github.com/google/subcommands"
@@ -15,12 +14,16 @@ import (
 
 type cmdWrap struct {
 	subcommands.Command
-	debug bool
-	help  bool
+	debug     bool
+	logLevel  string
+	logFormat string
+	help      bool
 }
 
 func (w *cmdWrap) SetFlags(f *flag.FlagSet) {
-	f.BoolVar(&w.debug, "debug", false, "enable debug logging")
+	f.BoolVar(&w.debug, "debug", false, "enable debug logging, same as -log-level debug")
+	f.StringVar(&w.logLevel, "log-level", logger.InfoLevel, "minimum log level: debug, info, warn or error")
+	f.StringVar(&w.logFormat, "log-format", logger.TextFormat, "log format: text or json")
 	f.BoolVar(&w.help, "help", false, "show help")
 	w.Command.SetFlags(f)
 }
@@ -32,11 +35,15 @@ func (w *cmdWrap) Execute(ctx context.Context, f *flag.FlagSet, args ...interfac
 		return subcommands.HelpCommand().Execute(ctx, f, args...)
 	}
 
-	minLevel := logger.InfoLevel
+	minLevel := w.logLevel
 	if w.debug {
 		minLevel = logger.DebugLevel
 	}
-	logger.Setup(os.Stderr, minLevel)
+	if err := logger.SetupWithFormat(os.Stderr, minLevel, w.logFormat); err != nil {
+		logger.Setup(os.Stderr, logger.InfoLevel)
+		logger.Errorf("%s", err)
+		return subcommands.ExitUsageError
+	}
 	logger.Infof("bqin version: %s", bqin.Version)
 
 	return w.Command.Execute(ctx, f, args...)
@@ -46,6 +53,11 @@ type signalTrapper struct {
 	subcommands.Command
 }
 
+// reloadable is the command which reloads config by SIGHUP instead of shutdown.
+type reloadable interface {
+	Reload()
+}
+
 func (w *signalTrapper) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
 
 	trapSignals := []os.Signal{
@@ -56,17 +68,45 @@ func (w *signalTrapper) Execute(ctx context.Context, f *flag.FlagSet, args ...in
 	}
 	sigint := make(chan os.Signal, 1)
 	signal.Notify(sigint, trapSignals...)
+	defer signal.Stop(sigint)
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	var wg sync.WaitGroup
-	wg.Add(2)
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
-		defer wg.Done()
-		sig := <-sigint
-		logger.Infof("Got signal: %s(%d)", sig, sig)
-		logger.Infof("sutdown...")
-		cancel()
+		shutdown := false
+		for {
+			var sig os.Signal
+			select {
+			case <-done:
+				return
+			case sig = <-sigint:
+			}
+			logger.Infof("Got signal: %s(%d)", sig, sig)
+			if shutdown {
+				// the second signal does not wait for the message in process.
+				logger.Warnf("forced shutdown")
+				os.Exit(1)
+			}
+			if r, ok := w.Command.(reloadable); ok && sig == syscall.SIGHUP {
+				// reloading does not block handling the following signals, such as SIGTERM.
+				go r.Reload()
+				continue
+			}
+			logger.Infof("sutdown... send the signal again to force shutdown")
+			shutdown = true
+			cancel()
+		}
 	}()
 	return w.Command.Execute(ctx, f, args...)
 }
+
+// loadConfig loads the config, and selects the queue of the name in queues when queue is not empty.
+func loadConfig(path, queue string) (*bqin.Config, error) {
+	conf, err := bqin.LoadConfig(path)
+	if err != nil || queue == "" {
+		return conf, err
+	}
+	return conf.ForQueue(queue)
+}
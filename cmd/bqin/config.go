@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/kayac/bqin"
+	"github.com/kayac/bqin/internal/logger"
+)
+
+type configCmd struct{}
+
+func (r *configCmd) Name() string { return "config" }
+func (r *configCmd) Synopsis() string {
+	return "validate or dump config"
+}
+
+func (r *configCmd) Usage() string {
+	return `bqin config <validate|dump> [-config <config.yaml>]
+
+validate: report all errors of the config.
+dump: print the effective config, rules are merged with the top-level defaults and secrets are redacted.
+`
+}
+
+func (r *configCmd) SetFlags(f *flag.FlagSet) {}
+
+func (r *configCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	cdr := subcommands.NewCommander(f, "bqin config")
+	cdr.Register(&configValidateCmd{}, "")
+	cdr.Register(&configDumpCmd{}, "")
+	return cdr.Execute(ctx, args...)
+}
+
+type configValidateCmd struct {
+	config string
+}
+
+func (r *configValidateCmd) Name() string { return "validate" }
+func (r *configValidateCmd) Synopsis() string {
+	return "report all errors of config"
+}
+
+func (r *configValidateCmd) Usage() string {
+	return `bqin config validate [-config <config.yaml>]
+`
+}
+
+func (r *configValidateCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&r.config, "config", "config.yaml", "config file path")
+}
+
+func (r *configValidateCmd) Execute(_ context.Context, _ *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	conf, err := bqin.ReadConfig(r.config)
+	if err != nil {
+		logger.Errorf("%s", err)
+		return subcommands.ExitFailure
+	}
+	if err := conf.ValidateAll(); err != nil {
+		errs, ok := err.(bqin.ConfigErrors)
+		if !ok {
+			errs = bqin.ConfigErrors{err}
+		}
+		for _, e := range errs {
+			logger.Errorf("%s", e)
+		}
+		logger.Errorf("%s is invalid: %d errors", r.config, len(errs))
+		return subcommands.ExitFailure
+	}
+	logger.Infof("%s is valid", r.config)
+	return subcommands.ExitSuccess
+}
+
+type configDumpCmd struct {
+	config string
+	format string
+}
+
+func (r *configDumpCmd) Name() string { return "dump" }
+func (r *configDumpCmd) Synopsis() string {
+	return "print effective config"
+}
+
+func (r *configDumpCmd) Usage() string {
+	return `bqin config dump [-config <config.yaml> -format <yaml|json>]
+
+Print the effective config to the standard output.
+Rules are merged with the top-level defaults, and secrets such as base64_credential and secret_access_key are redacted.
+`
+}
+
+func (r *configDumpCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&r.config, "config", "config.yaml", "config file path")
+	f.StringVar(&r.format, "format", "yaml", "output format: yaml or json")
+}
+
+func (r *configDumpCmd) Execute(_ context.Context, _ *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	conf, err := bqin.LoadConfig(r.config)
+	if err != nil {
+		logger.Errorf("load config failed: %s", err)
+		return subcommands.ExitFailure
+	}
+	if err := conf.Dump(os.Stdout, r.format); err != nil {
+		logger.Errorf("dump config failed: %s", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
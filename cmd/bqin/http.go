@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/kayac/bqin"
+	"github.com/kayac/bqin/internal/logger"
+)
+
+// startHTTPServer serves /metrics, /healthz and /readyz on addr until ctx is canceled.
+func startHTTPServer(ctx context.Context, addr string, health http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", bqin.MetricsHandler())
+	mux.Handle("/healthz", health)
+	mux.Handle("/readyz", health)
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		logger.Infof("http server listening on %s", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("http server failed: %s", err)
+		}
+	}()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/google/subcommands"
+	"github.com/kayac/bqin"
+	"github.com/kayac/bqin/internal/logger"
+)
+
+type loadCmd struct {
+	config           string
+	queue            string
+	table            string
+	writeDisposition string
+}
+
+func (r *loadCmd) Name() string { return "load" }
+func (r *loadCmd) Synopsis() string {
+	return "Load S3 objects of the given URLs into BigQuery without SQS"
+}
+
+func (r *loadCmd) Usage() string {
+	return `bqin load [-config <config.yaml> -queue <name> -table <[project.]dataset.table> -write-disposition <append|truncate|empty> -debug] [s3://... ...]
+
+Load S3 objects into BigQuery by the matched rules, without SQS messages.
+When no URLs are given as arguments, URLs are read from the standard input line by line.
+for example:
+$ bqin load -config config.yaml s3://bucket.example.com/object/data.csv
+$ cat missing.txt | bqin load -config config.yaml -table dataset.table_20200210 -write-disposition truncate
+`
+}
+
+func (r *loadCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&r.config, "config", "config.yaml", "config file path")
+	f.StringVar(&r.queue, "queue", "", "use the rules of the queue of this name in queues")
+	f.StringVar(&r.table, "table", "", "override destination table: [project.]dataset.table or table")
+	f.StringVar(&r.writeDisposition, "write-disposition", "", "override write disposition: append, truncate or empty")
+}
+
+func (r *loadCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	override := &bqin.LoadOverride{Table: r.table}
+	if r.writeDisposition != "" {
+		d, err := bqin.ParseWriteDisposition(r.writeDisposition)
+		if err != nil {
+			logger.Errorf("%s", err)
+			return subcommands.ExitUsageError
+		}
+		override.WriteDisposition = d
+	}
+	if err := override.Validate(); err != nil {
+		logger.Errorf("%s", err)
+		return subcommands.ExitUsageError
+	}
+
+	raws := f.Args()
+	if len(raws) == 0 {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				raws = append(raws, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			logger.Errorf("reading standard input error:%s", err)
+			return subcommands.ExitFailure
+		}
+	}
+	locs := make([]*url.URL, 0, len(raws))
+	for _, raw := range raws {
+		loc, err := url.Parse(raw)
+		if err != nil || loc.Scheme != "s3" {
+			logger.Errorf("invalid s3 url: %s", raw)
+			return subcommands.ExitUsageError
+		}
+		locs = append(locs, loc)
+	}
+	if len(locs) == 0 {
+		logger.Errorf("no s3 urls")
+		return subcommands.ExitUsageError
+	}
+
+	conf, err := loadConfig(r.config, r.queue)
+	if err != nil {
+		logger.Errorf("load config failed: %s", err)
+		return subcommands.ExitFailure
+	}
+	shutdownTracing := bqin.SetupTracing(conf.Tracing)
+	defer shutdownTracing(context.Background())
+	if err := bqin.NewApp(conf).LoadObjects(ctx, locs, override); err != nil {
+		logger.Errorf("load error: %v", err)
+		return subcommands.ExitFailure
+	}
+	logger.Infof("all successed goodbye.")
+	return subcommands.ExitSuccess
+}
@@ -21,9 +21,25 @@ func main() {
 			Command: &batchCmd{},
 		},
 	}, "")
+	subcommands.Register(&cmdWrap{
+		Command: &signalTrapper{
+			Command: &backfillCmd{},
+		},
+	}, "")
+	subcommands.Register(&cmdWrap{
+		Command: &signalTrapper{
+			Command: &loadCmd{},
+		},
+	}, "")
 	subcommands.Register(&cmdWrap{
 		Command: &checkCmd{},
 	}, "")
+	subcommands.Register(&cmdWrap{
+		Command: &testCmd{},
+	}, "")
+	subcommands.Register(&cmdWrap{
+		Command: &configCmd{},
+	}, "")
 	flag.Parse()
 
 	os.Exit(int(subcommands.Execute(context.Background())))
@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"flag"
+	"sync"
+	"time"
 
 	"github.com/google/subcommands"
 	"github.com/kayac/bqin"
@@ -10,7 +12,14 @@ import (
 )
 
 type runCmd struct {
-	config string
+	config          string
+	http            string
+	healthThreshold time.Duration
+	watchConfig     bool
+	drainTimeout    time.Duration
+
+	mu       sync.Mutex
+	reloader *bqin.ConfigReloader
 }
 
 func (r *runCmd) Name() string { return "run" }
@@ -19,14 +28,39 @@ func (r *runCmd) Synopsis() string {
 }
 
 func (r *runCmd) Usage() string {
-	return `bqin run [-config <config.yaml> -debug]
+	return `bqin run [-config <config.yaml> -http <address> -health-threshold <duration> -watch-config -drain-timeout <duration> -debug]
 
 Wait for SQS message reception and load the target S3 Object into BigQuery as soon as it is received.
+Use batch -dry-run for showing plans of jobs in the queue.
+Rules are reloaded by SIGHUP, or by changes of the config file with -watch-config.
+When the new config is invalid, the current config is kept.
+On SIGINT or SIGTERM, receiving stops and the message in process is finished within -drain-timeout.
+The second SIGINT or SIGTERM exits immediately with code 1.
+The message not finished is released for retrying by other workers immediately.
+When queues are defined in the config, all of them are served in this process.
 `
 }
 
 func (r *runCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&r.config, "config", "config.yaml", "config file path")
+	f.StringVar(&r.http, "http", "", "listen address for /metrics, /healthz and /readyz (e.g. :8080), disabled if empty")
+	f.DurationVar(&r.healthThreshold, "health-threshold", bqin.DefaultHealthThreshold, "max duration since the last loop iteration for /healthz")
+	f.BoolVar(&r.watchConfig, "watch-config", false, "reload rules when the config file is changed")
+	f.DurationVar(&r.drainTimeout, "drain-timeout", bqin.DefaultDrainTimeout, "max duration to finish the message in process at shutdown, 0 means no limit")
+}
+
+// Reload reloads rules of the running app, called by SIGHUP.
+func (r *runCmd) Reload() {
+	r.mu.Lock()
+	reloader := r.reloader
+	r.mu.Unlock()
+	if reloader == nil {
+		logger.Warnf("app is not started yet, reload is ignored")
+		return
+	}
+	if err := reloader.Reload(); err != nil {
+		logger.Errorf("%s", err)
+	}
 }
 
 func (r *runCmd) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
@@ -35,7 +69,26 @@ func (r *runCmd) Execute(ctx context.Context, _ *flag.FlagSet, _ ...interface{})
 		logger.Errorf("load config failed: %s", err)
 		return subcommands.ExitFailure
 	}
-	if err := bqin.NewApp(conf).Run(ctx); err != nil {
+	shutdownTracing := bqin.SetupTracing(conf.Tracing)
+	defer shutdownTracing(context.Background())
+	app := bqin.NewMultiApp(conf)
+	reloader := bqin.NewConfigReloader(r.config, conf, app)
+	r.mu.Lock()
+	r.reloader = reloader
+	r.mu.Unlock()
+	if r.watchConfig {
+		go func() {
+			if err := reloader.Watch(ctx, bqin.DefaultReloadDebounce); err != nil {
+				logger.Errorf("watch config failed: %s", err)
+			}
+		}()
+	}
+	if r.http != "" {
+		health := app.Health()
+		health.SetThreshold(r.healthThreshold)
+		startHTTPServer(ctx, r.http, health.Handler())
+	}
+	if err := app.Run(ctx, bqin.WithDrainTimeout(r.drainTimeout)); err != nil {
 		logger.Errorf("run error: %v", err)
 		return subcommands.ExitFailure
 	}
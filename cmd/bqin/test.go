@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/kayac/bqin"
+	"github.com/kayac/bqin/internal/logger"
+)
+
+type testCmd struct {
+	config string
+	queue  string
+}
+
+func (r *testCmd) Name() string { return "test" }
+func (r *testCmd) Synopsis() string {
+	return "test rules by fixtures"
+}
+
+func (r *testCmd) Usage() string {
+	return `bqin test [-config <config.yaml> -queue <name>] <rules_test.yaml> [...]
+
+Test rules by the fixture files, which list S3 URIs and the expected destination tables.
+Results and diffs (- expected, + actual) are written to the standard output,
+and the process exits with non-zero status when any test failed.
+for example rules_test.yaml:
+tests:
+  - uri: s3://bucket.example.com/data/user/part-0001.csv
+    tables:
+      - project.dataset.user
+  - uri: s3://bucket.example.com/tmp/data.csv
+    tables: []  # no match
+`
+}
+
+func (r *testCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&r.config, "config", "config.yaml", "config file path")
+	f.StringVar(&r.queue, "queue", "", "use the rules of the queue of this name in queues")
+}
+
+func (r *testCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		logger.Errorf("test files are required")
+		return subcommands.ExitUsageError
+	}
+	conf, err := loadConfig(r.config, r.queue)
+	if err != nil {
+		logger.Errorf("load config failed: %s", err)
+		return subcommands.ExitFailure
+	}
+	factory := &bqin.Factory{Config: conf}
+	resolver := factory.NewResolver()
+
+	var passed, failed int
+	for _, path := range f.Args() {
+		suite, err := bqin.LoadRuleTestSuite(path)
+		if err != nil {
+			logger.Errorf("%s", err)
+			return subcommands.ExitFailure
+		}
+		for _, result := range resolver.RunRuleTests(ctx, suite) {
+			fmt.Fprintln(os.Stdout, result)
+			if result.OK() {
+				passed++
+				continue
+			}
+			fmt.Fprint(os.Stdout, result.Diff())
+			failed++
+		}
+	}
+	fmt.Fprintf(os.Stdout, "%d passed, %d failed\n", passed, failed)
+	if failed > 0 {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,169 @@
+package bqin
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Knetic/govaluate"
+	"github.com/pkg/errors"
+)
+
+// ruleCondition is compiled `when` expression of the rule.
+// example: size > 1024 && principal_id =~ 'etl' && number([metadata.version]) >= 2
+type ruleCondition struct {
+	expr *govaluate.EvaluableExpression
+}
+
+var conditionVariables = map[string]bool{
+	"bucket":       true,
+	"key":          true,
+	"size":         true,
+	"content_type": true,
+	"event_name":   true,
+	"event_time":   true,
+	"principal_id": true,
+}
+
+// map values are referred as escaped variable, such as [metadata.version] or [captures.1]
+var conditionMapVariablePrefixes = []string{"captures.", "metadata.", "tags."}
+
+var conditionFuncs = map[string]govaluate.ExpressionFunction{
+	// example: number([metadata.version]) >= 2
+	"number": func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, errors.New("number() requires 1 argument")
+		}
+		switch v := args[0].(type) {
+		case float64:
+			return v, nil
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, errors.Errorf("number(): `%s` is not a number", v)
+			}
+			return f, nil
+		}
+		return nil, errors.Errorf("number(): unexpected argument type %T", args[0])
+	},
+	// example: hour(event_time) >= 9 && hour(event_time) < 18, in UTC.
+	"hour": conditionTimeFunc("hour", func(t time.Time) float64 {
+		return float64(t.Hour())
+	}),
+	// 0 is Sunday, 6 is Saturday in UTC.
+	"weekday": conditionTimeFunc("weekday", func(t time.Time) float64 {
+		return float64(t.Weekday())
+	}),
+	"has_prefix": conditionStringFunc("has_prefix", strings.HasPrefix),
+	"has_suffix": conditionStringFunc("has_suffix", strings.HasSuffix),
+	"contains":   conditionStringFunc("contains", strings.Contains),
+}
+
+func conditionTimeFunc(name string, f func(time.Time) float64) govaluate.ExpressionFunction {
+	return func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, errors.Errorf("%s() requires 1 argument", name)
+		}
+		unix, ok := args[0].(float64)
+		if !ok {
+			return nil, errors.Errorf("%s(): unexpected argument type %T", name, args[0])
+		}
+		return f(time.Unix(int64(unix), 0).UTC()), nil
+	}
+}
+
+func conditionStringFunc(name string, f func(s, substr string) bool) govaluate.ExpressionFunction {
+	return func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, errors.Errorf("%s() requires 2 arguments", name)
+		}
+		s, ok1 := args[0].(string)
+		substr, ok2 := args[1].(string)
+		if !ok1 || !ok2 {
+			return nil, errors.Errorf("%s(): arguments must be string", name)
+		}
+		return f(s, substr), nil
+	}
+}
+
+func compileCondition(s string) (*ruleCondition, error) {
+	expr, err := govaluate.NewEvaluableExpressionWithFunctions(s, conditionFuncs)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range expr.Vars() {
+		if !isConditionVariable(name) {
+			return nil, errors.Errorf("unknown variable `%s`", name)
+		}
+	}
+	return &ruleCondition{expr: expr}, nil
+}
+
+func isConditionVariable(name string) bool {
+	if conditionVariables[name] {
+		return true
+	}
+	for _, prefix := range conditionMapVariablePrefixes {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// eval returns whether the condition is satisfied.
+// object attributes are fetched only when the expression refers them.
+func (c *ruleCondition) eval(p *placeHolder) (bool, error) {
+	ret, err := c.expr.Eval(p)
+	if err != nil {
+		return false, err
+	}
+	ok, isBool := ret.(bool)
+	if !isBool {
+		return false, errors.Errorf("result is not boolean: %v", ret)
+	}
+	return ok, nil
+}
+
+// Get implements govaluate.Parameters for the rule condition.
+func (p *placeHolder) Get(name string) (interface{}, error) {
+	switch name {
+	case "bucket":
+		return p.Bucket(), nil
+	case "key":
+		return p.Key(), nil
+	case "size":
+		size, err := p.Size()
+		return float64(size), err
+	case "content_type":
+		return p.ContentType()
+	case "event_name":
+		return p.record.EventName, nil
+	case "event_time":
+		return float64(p.record.EventTime.Unix()), nil
+	case "principal_id":
+		return p.record.PrincipalID, nil
+	}
+	var values map[string]string
+	var err error
+	switch {
+	case strings.HasPrefix(name, "captures."):
+		values = p.Captures()
+	case strings.HasPrefix(name, "metadata."):
+		values, err = p.Metadata()
+	case strings.HasPrefix(name, "tags."):
+		values, err = p.Tags()
+	default:
+		return nil, errors.Errorf("unknown variable `%s`", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key := name[strings.Index(name, ".")+1:]
+	if strings.HasPrefix(name, "metadata.") {
+		// keys of user metadata are case-insensitive, and lowercased by HeadObject.
+		key = strings.ToLower(key)
+	}
+	// undefined key is an empty string, same as S3 metadata and tags conditions.
+	return values[key], nil
+}
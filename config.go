@@ -1,15 +1,33 @@
 package bqin
 
 import (
+	"io/ioutil"
 	"os"
+	"regexp"
+	"strings"
 
 	goconfig "github.com/kayac/go-config"
 	"github.com/pkg/errors"
 )
 
 type Config struct {
-	QueueName string `yaml:"queue_name"`
-	Cloud     *Cloud `yaml:"cloud"`
+	QueueName   string      `yaml:"queue_name,omitempty"`
+	Cloud       *Cloud      `yaml:"cloud"`
+	MatchPolicy MatchPolicy `yaml:"match_policy,omitempty"`
+	// messages failed by permanent errors are sent to this queue.
+	FailureQueueName string `yaml:"failure_queue_name,omitempty"`
+	// how to process objects which are not matched to any rules.
+	Unmatched *UnmatchedOption `yaml:"unmatched,omitempty"`
+	// notify failures to webhooks, slack or sns.
+	Notification *NotificationConfig `yaml:"notification,omitempty"`
+	// export traces via OTLP, no-op when not configured.
+	Tracing *TracingConfig `yaml:"tracing,omitempty"`
+	// record every job to BigQuery table or NDJSON file.
+	Audit *AuditConfig `yaml:"audit,omitempty"`
+	// serve multiple queues in one process instead of queue_name, each queue has own rules.
+	Queues []*QueueConfig `yaml:"queues,omitempty"`
+	// max number of messages processed at once over all queues, zero means no limit.
+	MaxConcurrency int `yaml:"max_concurrency,omitempty"`
 
 	Rules []*Rule `yaml:"rules"`
 	Rule  `yaml:",inline"`
@@ -26,6 +44,7 @@ type AWS struct {
 	S3ForcePathStyle        bool   `yaml:"s3_force_path_style,omitempty"`
 	S3Endpoint              string `yaml:"s3_endpoint,omitempty"`
 	SQSEndpoint             string `yaml:"sqs_endpoint,omitempty"`
+	SNSEndpoint             string `yaml:"sns_endpoint,omitempty"`
 	AccessKeyID             string `yaml:"access_key_id,omitempty"`
 	SecretAccessKey         string `yaml:"secret_access_key,omitempty"`
 	DisableShardConfigState bool   `yaml:"disable_shard_config_state,omitempty"`
@@ -56,8 +75,7 @@ func NewDefaultConfig() *Config {
 }
 
 func LoadConfig(path string) (*Config, error) {
-	conf := NewDefaultConfig()
-	err := goconfig.LoadWithEnv(conf, path)
+	conf, err := ReadConfig(path)
 	if err != nil {
 		return nil, err
 	}
@@ -67,25 +85,113 @@ func LoadConfig(path string) (*Config, error) {
 	return conf, nil
 }
 
+// ReadConfig loads the config without Validate, rules are not merged with the defaults yet.
+func ReadConfig(path string) (*Config, error) {
+	conf := NewDefaultConfig()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s read failed", path)
+	}
+	if err := goconfig.LoadWithEnvBytes(conf, escapeRuntimeTemplate(data)); err != nil {
+		return nil, errors.Wrapf(err, "%s load failed", path)
+	}
+	return conf, nil
+}
+
+var templateActionRegexp = regexp.MustCompile(`{{-?\s*(.*?)\s*-?}}`)
+
+// go-config expands only `{{ env "FOO" }}` and `{{ must_env "FOO" }}` when loading,
+// other template actions such as `{{ .Table }}` are kept for expanding at job runtime.
+func escapeRuntimeTemplate(data []byte) []byte {
+	return templateActionRegexp.ReplaceAllFunc(data, func(action []byte) []byte {
+		pipeline := string(templateActionRegexp.FindSubmatch(action)[1])
+		if strings.HasPrefix(pipeline, "env ") || strings.HasPrefix(pipeline, "must_env ") {
+			return action
+		}
+		return append([]byte(`{{"{{"}}`), action[2:]...)
+	})
+}
+
+// ConfigErrors is all errors of the config found by ValidateAll.
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Validate merges the defaults into rules, and returns the first error.
 func (c *Config) Validate() error {
-	if c.QueueName == "" {
-		return errors.New("queue_name is not defined")
+	if errs := c.validate(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// ValidateAll is same as Validate, but returns ConfigErrors of all errors.
+func (c *Config) ValidateAll() error {
+	if errs := c.validate(); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (c *Config) validate() ConfigErrors {
+	var errs ConfigErrors
+	if c.QueueName == "" && len(c.Queues) == 0 {
+		errs = append(errs, errors.New("queue_name is not defined"))
+	}
+	if c.QueueName != "" && len(c.Queues) > 0 {
+		errs = append(errs, errors.New("queue_name and queues can not be used together"))
+	}
+	if c.MaxConcurrency < 0 {
+		errs = append(errs, errors.New("max_concurrency must be positive"))
 	}
 	if err := c.Cloud.Validate(); err != nil {
-		return errors.Wrap(err, "cloud is invalid")
+		errs = append(errs, errors.Wrap(err, "cloud is invalid"))
 	}
-	if len(c.Rules) == 0 {
-		return errors.New("rules is not defined")
+	if !c.MatchPolicy.IsSupport() {
+		errs = append(errs, errors.Errorf("match_policy `%s` is not supported", c.MatchPolicy))
 	}
+	if len(c.Rules) == 0 && c.usesTopLevelRules() {
+		errs = append(errs, errors.New("rules is not defined"))
+	}
+	names := make(map[string]bool, len(c.Rules))
 	for i, dst := range c.Rules {
+		if dst == nil {
+			errs = append(errs, errors.Errorf("rule[%d] is empty", i))
+			continue
+		}
 		other := c.Rule.Clone()
 		dst.MergeIn(other)
 		if err := dst.Validate(); err != nil {
-			return errors.Wrapf(err, "rule[%d]", i)
+			errs = append(errs, errors.Wrapf(err, "rule[%d]", i))
+		}
+		if dst.Name != "" {
+			if names[dst.Name] {
+				errs = append(errs, errors.Errorf("rule[%d]: name `%s` is duplicated", i, dst.Name))
+			}
+			names[dst.Name] = true
 		}
 		c.Rules[i] = dst
 	}
-	return nil
+	if err := c.Unmatched.Validate(&c.Rule); err != nil {
+		errs = append(errs, errors.Wrap(err, "unmatched"))
+	}
+	errs = append(errs, c.validateQueues()...)
+	if err := c.Notification.Validate(); err != nil {
+		errs = append(errs, errors.Wrap(err, "notification"))
+	}
+	if err := c.Tracing.Validate(); err != nil {
+		errs = append(errs, errors.Wrap(err, "tracing"))
+	}
+	if err := c.Audit.Validate(); err != nil {
+		errs = append(errs, errors.Wrap(err, "audit"))
+	}
+	return errs
 }
 
 func (c *Cloud) Validate() error {
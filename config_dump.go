@@ -0,0 +1,144 @@
+package bqin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// RedactedValue replaces the secrets in the dumped config.
+const RedactedValue = "(redacted)"
+
+// values of these keys are redacted, and all values of headers are redacted too.
+var secretConfigKeys = map[string]bool{
+	"secret_access_key": true,
+	"base64_credential": true,
+}
+
+// values of these paths are redacted, elements of lists have the path of the list.
+// webhook URLs of Slack and others contain the token.
+var secretConfigPaths = map[string]bool{
+	"notification.sinks.url": true,
+}
+
+// Dump writes the config in yaml or json with secrets redacted.
+// after Validate, rules are dumped as effective rules merged with the defaults.
+func (c *Config) Dump(w io.Writer, format string) error {
+	dump := *c
+	dump.Rules = effectiveRules(c.Rules)
+	dump.Queues = make([]*QueueConfig, 0, len(c.Queues))
+	for _, q := range c.Queues {
+		if q == nil {
+			dump.Queues = append(dump.Queues, q)
+			continue
+		}
+		queue := *q
+		queue.Rules = effectiveRules(q.Rules)
+		dump.Queues = append(dump.Queues, &queue)
+	}
+	bs, err := yaml.Marshal(&dump)
+	if err != nil {
+		return errors.Wrap(err, "marshal config failed")
+	}
+	var tree yaml.MapSlice
+	if err := yaml.Unmarshal(bs, &tree); err != nil {
+		return errors.Wrap(err, "marshal config failed")
+	}
+	redactConfig(tree, "", false)
+	switch format {
+	case "yaml", "":
+		bs, err = yaml.Marshal(tree)
+	case "json":
+		bs, err = json.MarshalIndent(jsonMapSlice(tree), "", "  ")
+		bs = append(bs, '\n')
+	default:
+		return errors.Errorf("format `%s` is not supported", format)
+	}
+	if err != nil {
+		return errors.Wrap(err, "marshal config failed")
+	}
+	_, err = w.Write(bs)
+	return err
+}
+
+func effectiveRules(rules []*Rule) []*Rule {
+	ret := make([]*Rule, 0, len(rules))
+	for _, r := range rules {
+		if r == nil {
+			ret = append(ret, r)
+			continue
+		}
+		rule := *r
+		rule.Option = r.Option.effective()
+		ret = append(ret, &rule)
+	}
+	return ret
+}
+
+func redactConfig(v interface{}, path string, all bool) {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		for i, item := range v {
+			key := fmt.Sprint(item.Key)
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			if all || secretConfigKeys[key] || secretConfigPaths[keyPath] {
+				if s, ok := item.Value.(string); !ok || s != "" {
+					v[i].Value = RedactedValue
+				}
+				continue
+			}
+			redactConfig(item.Value, keyPath, key == "headers")
+		}
+	case []interface{}:
+		for _, item := range v {
+			redactConfig(item, path, false)
+		}
+	}
+}
+
+// jsonMapSlice marshals yaml.MapSlice into JSON object keeping the order of keys.
+type jsonMapSlice yaml.MapSlice
+
+func (m jsonMapSlice) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, item := range m {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, err := json.Marshal(fmt.Sprint(item.Key))
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(toJSONValue(item.Value))
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+func toJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		return jsonMapSlice(v)
+	case []interface{}:
+		ret := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			ret = append(ret, toJSONValue(item))
+		}
+		return ret
+	}
+	return v
+}
@@ -1,10 +1,14 @@
 package bqin_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/kayac/bqin"
+	yaml "gopkg.in/yaml.v2"
 )
 
 var ExpectedDefault = []string{}
@@ -53,6 +57,45 @@ func TestLoadConfig(t *testing.T) {
 					"s3://bqin.bucket.test/data/(.+)/snapshot_at=([0-9]{8})/.+ => bqin-test-gcp.test.$1_$2",
 				},
 			},
+			{
+				"testdata/config/pre_load.yaml",
+				[]string{
+					"s3://bqin.bucket.test/data/user => bqin-test-gcp.test.user",
+				},
+			},
+			{
+				"testdata/config/object_attributes.yaml",
+				[]string{
+					"s3://bqin.bucket.test/data/user => bqin-test-gcp.test.user_v1",
+					`s3://bqin.bucket.test/data/user => bqin-test-gcp.{{ .Tags.dataset }}.user_v{{ index .Metadata "schema-version" }}`,
+				},
+			},
+			{
+				"testdata/config/template.yaml",
+				[]string{
+					`s3://bqin.bucket.test/data/(?P<table>[a-z]+)/snapshot_at=(?P<date>[0-9]{8})/.+ => bqin-test-gcp.test.{{ .Captures.table | upper }}_{{ .Captures.date | parseDate "20060102" | date "2006" }}`,
+					`s3://bqin.bucket.test/char/(.)(.)(.)(.)(.)(.)(.)(.)(.)(.)\.csv => bqin-test-gcp.test.t_$10_$1`,
+					`s3://bqin.bucket.test/logs/ => bqin-test-gcp.{{ .Bucket | sanitize }}.{{ .Key | replace "logs/" "" | sanitize }}_{{ .EventTime | date "20060102" }}`,
+				},
+			},
+			{
+				"testdata/config/post_load.yaml",
+				[]string{
+					"s3://bqin.bucket.test/data/(.+)/snapshot_at=([0-9]{8})/.+ => bqin-test-gcp.test.$1_$2",
+				},
+			},
+			{
+				"testdata/config/notification.yaml",
+				[]string{
+					"s3://bqin.bucket.test/data/user => bqin-test-gcp.test.user",
+				},
+			},
+			{
+				"testdata/config/audit.yaml",
+				[]string{
+					"s3://bqin.bucket.test/data/user => bqin-test-gcp.test.user",
+				},
+			},
 		}
 		for _, p := range patterns {
 			t.Run(p.path, func(t *testing.T) {
@@ -77,11 +120,23 @@ func TestLoadConfig(t *testing.T) {
 		patterns := []pattern{
 			{path: "testdata/config/not_found.yaml"},
 			{path: "testdata/config/broken_invalid_key_regexp.yaml"},
+			{path: "testdata/config/broken_invalid_key_glob.yaml"},
+			{path: "testdata/config/broken_invalid_match_policy.yaml"},
+			{path: "testdata/config/broken_invalid_when.yaml"},
+			{path: "testdata/config/broken_invalid_unmatched.yaml"},
+			{path: "testdata/config/broken_invalid_retry.yaml"},
+			{path: "testdata/config/broken_invalid_notification.yaml"},
+			{path: "testdata/config/broken_invalid_tracing.yaml"},
+			{path: "testdata/config/broken_invalid_audit.yaml"},
 			{path: "testdata/config/broken_invalid_source_format.yaml"},
+			{path: "testdata/config/broken_invalid_queues.yaml"},
 			{path: "testdata/config/broken_no_source_format.yaml"},
 			{path: "testdata/config/broken_no_queue_name.yaml"},
 			{path: "testdata/config/broken_no_key_matcher.yaml"},
 			{path: "testdata/config/broken_no_tempbucket_option.yaml"},
+			{path: "testdata/config/broken_invalid_pre_load.yaml"},
+			{path: "testdata/config/broken_invalid_destination_template.yaml"},
+			{path: "testdata/config/broken_invalid_post_load_query.yaml"},
 			{path: "testdata/config/with_gcp_credntial.yaml"},
 		}
 		for _, p := range patterns {
@@ -108,3 +163,163 @@ func errorOrPanic(target func() error) (result bool) {
 	result = target() != nil
 	return
 }
+
+func TestLoadConfigRetry(t *testing.T) {
+	conf, err := bqin.LoadConfig("testdata/config/retry.yaml")
+	if err != nil {
+		t.Fatalf("unexpected error :%s", err)
+	}
+	cases := []struct {
+		retry    *bqin.RetryConfig
+		stage    string
+		expected string
+	}{
+		{conf.Retry, bqin.RetryStageDeleteMessage, "max_attempts=3 interval=100ms jitter=0.05 max_elapsed=0s"},
+		{conf.Retry, bqin.RetryStageLoad, "max_attempts=5 interval=100ms jitter=0.05 max_elapsed=0s"},
+		{conf.Rules[0].Retry, bqin.RetryStageTransport, "max_attempts=1 interval=100ms jitter=0.05 max_elapsed=30s"},
+		{conf.Rules[0].Retry, bqin.RetryStageLoad, "max_attempts=5 interval=100ms jitter=0.05 max_elapsed=30s"},
+		{conf.Rules[0].Retry, bqin.RetryStagePostLoad, "max_attempts=3 interval=100ms jitter=0.05 max_elapsed=30s"},
+		{conf.Rules[1].Retry, bqin.RetryStageTransport, "max_attempts=3 interval=100ms jitter=0.05 max_elapsed=0s"},
+		{nil, bqin.RetryStageTransport, "max_attempts=4 interval=1s jitter=0.05 max_elapsed=0s"},
+	}
+	for i, c := range cases {
+		if actual := c.retry.Option(c.stage).String(); actual != c.expected {
+			t.Errorf("case[%d] %s unexpected: %s", i, c.stage, actual)
+		}
+	}
+}
+
+func TestValidateAll(t *testing.T) {
+	conf, err := bqin.ReadConfig("testdata/config/broken_multiple_errors.yaml")
+	if err != nil {
+		t.Fatalf("unexpected error :%s", err)
+	}
+	err = conf.ValidateAll()
+	errs, ok := err.(bqin.ConfigErrors)
+	if !ok {
+		t.Fatalf("unexpected error type: %T %s", err, err)
+	}
+	expected := []string{
+		"queue_name is not defined",
+		"match_policy `random` is not supported",
+		"rule[0]: rule.s3:",
+		"rule[1]: rule.s3.min_size is larger than max_size",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("unexpected errors count: %d\n%s", len(errs), errs)
+	}
+	for i, e := range errs {
+		if !strings.HasPrefix(e.Error(), expected[i]) {
+			t.Errorf("errors[%d] unexpected: %s", i, e)
+		}
+	}
+	if _, err := bqin.LoadConfig("testdata/config/broken_multiple_errors.yaml"); err == nil || err.Error() != errs[0].Error() {
+		t.Errorf("LoadConfig must return the first error: %v", err)
+	}
+}
+
+func TestConfigDump(t *testing.T) {
+	os.Setenv("AWS_REGION", "ap-northeast-1")
+	os.Setenv("GCP_CREDENTIAL", "SE9HRUhPR0U=")
+	defer os.Unsetenv("GCP_CREDENTIAL")
+
+	conf, err := bqin.LoadConfig("testdata/config/with_gcp_credntial.yaml")
+	if err != nil {
+		t.Fatalf("unexpected error :%s", err)
+	}
+	conf.Cloud.AWS.SecretAccessKey = "SECRET"
+	conf.Notification = &bqin.NotificationConfig{
+		Sinks: []*bqin.NotifierSinkConfig{
+			{Type: bqin.NotifierWebhook, URL: "http://example.com", Headers: map[string]string{"Authorization": "Bearer TOKEN"}},
+		},
+	}
+	var yamlBuf, jsonBuf bytes.Buffer
+	if err := conf.Dump(&yamlBuf, "yaml"); err != nil {
+		t.Fatalf("unexpected error :%s", err)
+	}
+	if err := conf.Dump(&jsonBuf, "json"); err != nil {
+		t.Fatalf("unexpected error :%s", err)
+	}
+	t.Log(yamlBuf.String())
+	for _, dump := range []string{yamlBuf.String(), jsonBuf.String()} {
+		for _, secret := range []string{"SE9HRUhPR0U", "SECRET", "TOKEN"} {
+			if strings.Contains(dump, secret) {
+				t.Errorf("secret %s is not redacted", secret)
+			}
+		}
+	}
+
+	var dumped struct {
+		Rules []*bqin.Rule `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(yamlBuf.Bytes(), &dumped); err != nil {
+		t.Fatalf("unexpected error :%s", err)
+	}
+	var fromJSON struct {
+		Rules []struct {
+			Option *bqin.JobOption `json:"option"`
+		} `json:"rules"`
+	}
+	if err := json.Unmarshal(jsonBuf.Bytes(), &fromJSON); err != nil {
+		t.Fatalf("unexpected error :%s", err)
+	}
+	if len(dumped.Rules) != 2 || len(fromJSON.Rules) != 2 {
+		t.Fatalf("unexpected rules: %d, %d", len(dumped.Rules), len(fromJSON.Rules))
+	}
+	for i, rule := range dumped.Rules {
+		if rule.Option.TemporaryBucket != "bqin-import-tmp" || rule.BigQuery.ProjectID != "bqin-test-gcp" {
+			t.Errorf("rules[%d] is not merged with defaults: %s", i, rule)
+		}
+		if rule.Option.GZip == nil || *rule.Option.GZip {
+			t.Errorf("rules[%d] gzip is not dumped as false", i)
+		}
+		if fromJSON.Rules[i].Option.SourceFormat != bqin.JSON {
+			t.Errorf("rules[%d] unexpected source_format in json: %s", i, fromJSON.Rules[i].Option.SourceFormat)
+		}
+	}
+	if err := conf.Dump(&yamlBuf, "toml"); err == nil {
+		t.Error("unsupported format must be failed")
+	}
+}
+
+func TestConfigDumpNotification(t *testing.T) {
+	conf, err := bqin.LoadConfig("testdata/config/notification.yaml")
+	if err != nil {
+		t.Fatalf("unexpected error :%s", err)
+	}
+	var yamlBuf, jsonBuf bytes.Buffer
+	if err := conf.Dump(&yamlBuf, "yaml"); err != nil {
+		t.Fatalf("unexpected error :%s", err)
+	}
+	if err := conf.Dump(&jsonBuf, "json"); err != nil {
+		t.Fatalf("unexpected error :%s", err)
+	}
+	t.Log(yamlBuf.String())
+	for _, dump := range []string{yamlBuf.String(), jsonBuf.String()} {
+		for _, secret := range []string{"https://example.com/hooks/bqin", "https://hooks.slack.com/services/XXXX/YYYY/ZZZZ", "dummy"} {
+			if strings.Contains(dump, secret) {
+				t.Errorf("secret %s is not redacted", secret)
+			}
+		}
+	}
+
+	var dumped struct {
+		Notification *bqin.NotificationConfig `yaml:"notification"`
+	}
+	if err := yaml.Unmarshal(yamlBuf.Bytes(), &dumped); err != nil {
+		t.Fatalf("unexpected error :%s", err)
+	}
+	if dumped.Notification == nil || len(dumped.Notification.Sinks) != 3 {
+		t.Fatalf("unexpected notification: %#v", dumped.Notification)
+	}
+	sinks := dumped.Notification.Sinks
+	if sinks[0].URL != bqin.RedactedValue || sinks[1].URL != bqin.RedactedValue {
+		t.Errorf("urls of sinks are not redacted: %s, %s", sinks[0].URL, sinks[1].URL)
+	}
+	if sinks[2].URL != "" {
+		t.Errorf("empty url must be kept: %s", sinks[2].URL)
+	}
+	if sinks[1].Channel != "#bqin-alert" || sinks[2].TopicARN != "arn:aws:sns:ap-northeast-1:123456789012:bqin-alert" {
+		t.Errorf("values except secrets must be kept: %#v, %#v", sinks[1], sinks[2])
+	}
+}
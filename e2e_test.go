@@ -2,9 +2,12 @@ package bqin_test
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"reflect"
 	"testing"
 
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/kayac/bqin"
 	"github.com/kayac/bqin/internal/logger"
 	"github.com/kylelemons/godebug/pretty"
@@ -12,10 +15,12 @@ import (
 
 func TestE2E(t *testing.T) {
 	cases := []struct {
-		CaseName  string
-		Configure string
-		Messages  []string
-		Expected  map[string][]string
+		CaseName        string
+		Configure       string
+		Messages        []string
+		Expected        map[string][]string
+		ExpectedQueries []string
+		ExpectedSent    []string
 	}{
 		{
 			CaseName:  "default",
@@ -41,6 +46,104 @@ func TestE2E(t *testing.T) {
 				},
 			},
 		},
+		{
+			CaseName:  "pre_load_checks",
+			Configure: "testdata/config/pre_load.yaml",
+			Messages: []string{
+				"testdata/sqs/user_with_marker.json",
+			},
+			Expected: map[string][]string{
+				"bqin-test-gcp.test.user": []string{
+					"gs://bqin-import-tmp/data/user/snapshot_at=20200210/part-0001.csv",
+				},
+			},
+		},
+		{
+			CaseName:  "object_attributes_rule",
+			Configure: "testdata/config/object_attributes.yaml",
+			Messages: []string{
+				"testdata/sqs/user.json",
+			},
+			Expected: map[string][]string{
+				"bqin-test-gcp.member.user_v2": []string{
+					"gs://bqin-import-tmp/data/user/snapshot_at=20200210/part-0001.csv",
+				},
+			},
+		},
+		{
+			CaseName:  "post_load_queries",
+			Configure: "testdata/config/post_load.yaml",
+			Messages: []string{
+				"testdata/sqs/user.json",
+			},
+			Expected: map[string][]string{
+				"bqin-test-gcp.test.user_20200210": []string{
+					"gs://bqin-import-tmp/data/user/snapshot_at=20200210/part-0001.csv",
+				},
+			},
+			ExpectedQueries: []string{
+				"DELETE FROM `bqin-test-gcp.test.user_20200210` WHERE snapshot_at < '20200210'",
+				"CALL `bqin-test-gcp.test`.refresh_user_summary()",
+			},
+		},
+		{
+			CaseName:  "unmatched_ack",
+			Configure: "testdata/config/unmatched_ack.yaml",
+			Messages: []string{
+				"testdata/sqs/user.json",
+			},
+			Expected: map[string][]string{},
+		},
+		{
+			CaseName:  "unmatched_forward",
+			Configure: "testdata/config/unmatched_forward.yaml",
+			Messages: []string{
+				"testdata/sqs/user.json",
+			},
+			Expected: map[string][]string{},
+			ExpectedSent: []string{
+				"s3_to_bq_unmatched: s3://bqin.bucket.test/data/user/snapshot_at=20200210/part-0001.csv",
+			},
+		},
+		{
+			CaseName:  "unmatched_catch_all",
+			Configure: "testdata/config/unmatched_catch_all.yaml",
+			Messages: []string{
+				"testdata/sqs/user.json",
+			},
+			Expected: map[string][]string{
+				"bqin-test-gcp.test.unmatched": []string{
+					"gs://bqin-import-tmp/data/user/snapshot_at=20200210/part-0001.csv",
+				},
+			},
+		},
+		{
+			CaseName:  "permanent_failure",
+			Configure: "testdata/config/failure_queue.yaml",
+			Messages: []string{
+				"testdata/sqs/user_not_found.json",
+			},
+			Expected: map[string][]string{},
+			ExpectedSent: []string{
+				"s3_to_bq_failure: s3://bqin.bucket.test/data/user/snapshot_at=20200210/not_found.csv (transport: NoSuchKey)",
+			},
+		},
+		{
+			CaseName:  "partial_permanent_failure",
+			Configure: "testdata/config/failure_queue.yaml",
+			Messages: []string{
+				"testdata/sqs/user_partial_not_found.json",
+			},
+			Expected: map[string][]string{
+				"bqin-test-gcp.test.user": []string{
+					"gs://bqin-import-tmp/data/user/snapshot_at=20200210/part-0001.csv",
+				},
+			},
+			ExpectedSent: []string{
+				"s3_to_bq_failure: s3://bqin.bucket.test/data/user/snapshot_at=20200210/not_found.csv (transport: NoSuchKey)",
+				"s3_to_bq_failure: s3://bqin.bucket.test/data/user/snapshot_at=20200211/part-0001.csv (transport: NoSuchKey)",
+			},
+		},
 	}
 
 	for _, c := range cases {
@@ -71,6 +174,30 @@ func TestE2E(t *testing.T) {
 			if !reflect.DeepEqual(loaded, c.Expected) {
 				t.Errorf("bigquery loaded data status unexpected: %s", pretty.Compare(loaded, c.Expected))
 			}
+			queries := mgr.BigQuery.ExecutedQueries()
+			if !reflect.DeepEqual(queries, c.ExpectedQueries) {
+				t.Errorf("bigquery executed queries unexpected: %s", pretty.Compare(queries, c.ExpectedQueries))
+			}
+			var sent []string
+			for _, msg := range mgr.SQS.SentMessages() {
+				var event events.S3Event
+				if err := json.Unmarshal([]byte(msg.Body), &event); err != nil {
+					t.Fatalf("sent message is not s3 event: %s", err)
+				}
+				for _, r := range event.Records {
+					s := fmt.Sprintf("%s: s3://%s/%s", msg.QueueName, r.S3.Bucket.Name, r.S3.Object.Key)
+					if stage, ok := msg.Attributes["ErrorStage"]; ok {
+						s += fmt.Sprintf(" (%s: %s)", stage, msg.Attributes["ErrorReason"])
+					}
+					sent = append(sent, s)
+				}
+			}
+			if !reflect.DeepEqual(sent, c.ExpectedSent) {
+				t.Errorf("sqs sent messages unexpected: %s", pretty.Compare(sent, c.ExpectedSent))
+			}
+			if mgr.SQS.NumberOfMessagesDeleted != 1 {
+				t.Errorf("message is not deleted")
+			}
 		})
 	}
 
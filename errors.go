@@ -5,4 +5,14 @@ import "errors"
 var (
 	ErrMaxRetry  = errors.New("max retry count reached")
 	ErrNoMessage = errors.New("no sqs message")
+
+	ErrNothingToDo = errors.New("nothing to do")
+	// ErrSkipObject is the cause of errors for objects skipped by the inspector, such as matching skip patterns.
+	ErrSkipObject = errors.New("skip object")
+
+	// ErrInterrupted is returned when the message in process is canceled by drain timeout of shutdown.
+	ErrInterrupted = errors.New("interrupted by shutdown")
+
+	// errShutdown is returned when receiving is canceled by shutdown.
+	errShutdown = errors.New("shutdown")
 )
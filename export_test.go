@@ -0,0 +1,48 @@
+package bqin
+
+import (
+	"context"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/option"
+)
+
+// exported for tests in bqin_test.
+
+var (
+	NewFairScheduler = newFairScheduler
+	NewJobError      = newJobError
+)
+
+func (s *fairScheduler) Acquire(ctx context.Context, queue string) error {
+	return s.acquire(ctx, queue, nil)
+}
+
+func (s *fairScheduler) AcquireWithBeat(ctx context.Context, queue string, beat func()) error {
+	return s.acquire(ctx, queue, beat)
+}
+
+func (s *fairScheduler) Release() {
+	s.release()
+}
+
+// Waiting returns the number of waiters of the queue.
+func (s *fairScheduler) Waiting(queue string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.waiters[queue])
+}
+
+// UnmatchedCounts returns number of objects which are not matched to any rules, by the key prefix.
+func (r *Resolver) UnmatchedCounts() map[string]int64 {
+	return r.unmatched.snapshot()
+}
+
+// SetNewAuditBigQueryClient replaces the client constructor of the audit sink, returns the function to restore it.
+func SetNewAuditBigQueryClient(f func(ctx context.Context, projectID string, opts []option.ClientOption) (*bigquery.Client, error)) func() {
+	orig := newAuditBigQueryClient
+	newAuditBigQueryClient = f
+	return func() {
+		newAuditBigQueryClient = orig
+	}
+}
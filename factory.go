@@ -20,7 +20,7 @@ func (f *Factory) NewAWSSession() *session.Session {
 		Region:           aws.String(c.Region),
 		S3ForcePathStyle: aws.Bool(c.S3ForcePathStyle),
 	}
-	if c.S3Endpoint != "" || c.SQSEndpoint != "" {
+	if c.S3Endpoint != "" || c.SQSEndpoint != "" || c.SNSEndpoint != "" {
 		defaultResolver := endpoints.DefaultResolver()
 		customResolver := endpoints.ResolverFunc(
 			func(service, region string, optFns ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
@@ -36,6 +36,12 @@ func (f *Factory) NewAWSSession() *session.Session {
 						SigningRegion: region,
 					}, nil
 				}
+				if c.SNSEndpoint != "" && service == endpoints.SnsServiceID {
+					return endpoints.ResolvedEndpoint{
+						URL:           c.SNSEndpoint,
+						SigningRegion: region,
+					}, nil
+				}
 				return defaultResolver.EndpointFor(service, region, optFns...)
 			},
 		)
@@ -52,6 +58,7 @@ func (f *Factory) NewAWSSession() *session.Session {
 		Config:            *conf,
 		SharedConfigState: shardConfigState,
 	}))
+	addTracingHandlers(sess)
 	return sess
 }
 
@@ -84,15 +91,52 @@ func (f *Factory) NewGCPOptions() []option.ClientOption {
 }
 
 func (f *Factory) NewReceiver() *Receiver {
-	return NewReceiver(
+	receiver := NewReceiver(
 		f.Config.QueueName,
 		f.NewAWSSession(),
 	)
+	receiver.SetRetryConfig(f.Config.Retry)
+	return receiver
 }
 
 func (f *Factory) NewResolver() *Resolver {
-	return NewResolver(
+	return f.newResolver(f.NewInspector())
+}
+
+func (f *Factory) newResolver(inspector *Inspector) *Resolver {
+	resolver := NewResolver(
 		f.Config.Rules,
+		f.Config.MatchPolicy,
+		inspector,
+	)
+	resolver.SetCatchAllRule(f.Config.Unmatched.getCatchAllRule())
+	return resolver
+}
+
+func (f *Factory) NewInspector() *Inspector {
+	return NewInspector(
+		f.NewAWSSession(),
+	)
+}
+
+func (f *Factory) NewUnmatchedHandler() *UnmatchedHandler {
+	return NewUnmatchedHandler(
+		f.Config.Unmatched,
+		f.NewAWSSession(),
+	)
+}
+
+func (f *Factory) NewFailureHandler() *FailureHandler {
+	return NewFailureHandler(
+		f.Config.FailureQueueName,
+		f.NewAWSSession(),
+	)
+}
+
+func (f *Factory) NewNotifier() *Notifier {
+	return NewNotifier(
+		f.Config.Notification,
+		f.NewAWSSession(),
 	)
 }
 
@@ -109,11 +153,62 @@ func (f *Factory) NewLoader() *Loader {
 	)
 }
 
+func (f *Factory) NewAuditor() *Auditor {
+	return NewAuditor(
+		f.Config.Audit,
+		f.NewBigQueryOptions()...,
+	)
+}
+
+func (f *Factory) NewHealthChecker(receiver *Receiver) *HealthChecker {
+	return NewHealthChecker(
+		receiver,
+		f.NewAWSSession(),
+		f.Config.Cloud.GCP,
+	)
+}
+
 func (f *Factory) NewApp() *App {
+	inspector := f.NewInspector()
+	receiver := f.NewReceiver()
 	return &App{
-		Receiver:    f.NewReceiver(),
-		Resolver:    f.NewResolver(),
-		Transporter: f.NewTransporter(),
-		Loader:      f.NewLoader(),
+		Receiver:         receiver,
+		Resolver:         f.newResolver(inspector),
+		Inspector:        inspector,
+		UnmatchedHandler: f.NewUnmatchedHandler(),
+		FailureHandler:   f.NewFailureHandler(),
+		Notifier:         f.NewNotifier(),
+		Transporter:      f.NewTransporter(),
+		Loader:           f.NewLoader(),
+		Auditor:          f.NewAuditor(),
+		Health:           f.NewHealthChecker(receiver),
+	}
+}
+
+func (f *Factory) NewMultiApp() *MultiApp {
+	if len(f.Config.Queues) == 0 {
+		return &MultiApp{
+			Queues: []*QueueApp{{App: f.NewApp(), Name: f.Config.QueueName, Concurrency: 1}},
+			single: true,
+		}
+	}
+	queues := make([]*QueueApp, 0, len(f.Config.Queues))
+	names := make([]string, 0, len(f.Config.Queues))
+	// audit sinks are shared by all queues, they write to the same table and file.
+	auditor := f.NewAuditor()
+	for _, q := range f.Config.Queues {
+		factory := &Factory{Config: f.Config.queueConfig(q)}
+		app := factory.NewApp()
+		app.Auditor = auditor
+		queues = append(queues, &QueueApp{
+			App:         app,
+			Name:        q.Name,
+			Concurrency: q.getConcurrency(),
+		})
+		names = append(names, q.Name)
+	}
+	return &MultiApp{
+		Queues:    queues,
+		scheduler: newFairScheduler(f.Config.MaxConcurrency, names),
 	}
 }
@@ -0,0 +1,59 @@
+package bqin
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/pkg/errors"
+)
+
+// maxErrorMessageLength is the limit of ErrorMessage attribute, for avoiding too large message.
+const maxErrorMessageLength = 1024
+
+// FailureHandler routes messages failed by permanent errors to the failure queue.
+type FailureHandler struct {
+	sender *sqsSender
+}
+
+func NewFailureHandler(queueName string, sess *session.Session) *FailureHandler {
+	h := &FailureHandler{}
+	if queueName != "" {
+		h.sender = newSQSSender(queueName, sess)
+	}
+	return h
+}
+
+// HandleFailure sends the message to the failure queue with the reason as message attributes,
+// when the error is permanent and failure_queue_name is defined.
+// returns true when the message is routed, then the message should be completed.
+func (h *FailureHandler) HandleFailure(ctx context.Context, handle *ReceiptHandle, cause error) (bool, error) {
+	if h.sender == nil || handle == nil {
+		return false, nil
+	}
+	jobErr, ok := asJobError(cause)
+	if !ok || jobErr.Class != ErrorPermanent {
+		return false, nil
+	}
+	msg := cause.Error()
+	if len(msg) > maxErrorMessageLength {
+		msg = msg[:maxErrorMessageLength]
+	}
+	attributes := map[string]string{
+		"ErrorStage":      jobErr.Stage,
+		"ErrorClass":      string(jobErr.Class),
+		"ErrorMessage":    msg,
+		"SourceMessageId": handle.msgId,
+	}
+	if jobErr.Reason != "" {
+		attributes["ErrorReason"] = jobErr.Reason
+	}
+	body, err := handle.failedBody()
+	if err != nil {
+		return false, errors.Wrap(err, "route to failure queue failed")
+	}
+	if err := h.sender.send(ctx, body, attributes); err != nil {
+		return false, errors.Wrap(err, "route to failure queue failed")
+	}
+	handle.Infof("Routed message to failure queue %s.", h.sender.queueName)
+	return true, nil
+}
@@ -0,0 +1,173 @@
+package bqin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2/google"
+)
+
+// DefaultHealthThreshold is the max duration since the last loop iteration, for the worker to be healthy.
+var DefaultHealthThreshold = 15 * time.Minute
+
+// HealthChecker reports liveness and readiness of the worker.
+type HealthChecker struct {
+	receiver *Receiver
+	sess     *session.Session
+	gcp      *GCP
+
+	mu        sync.Mutex
+	threshold time.Duration
+	lastLoop  time.Time
+	// credentials are checked only once they obtained.
+	awsReady bool
+	gcpReady bool
+}
+
+func NewHealthChecker(receiver *Receiver, sess *session.Session, gcp *GCP) *HealthChecker {
+	return &HealthChecker{
+		receiver:  receiver,
+		sess:      sess,
+		gcp:       gcp,
+		threshold: DefaultHealthThreshold,
+	}
+}
+
+func (h *HealthChecker) SetThreshold(threshold time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.threshold = threshold
+}
+
+// beat records the loop iteration.
+func (h *HealthChecker) beat() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastLoop = time.Now()
+}
+
+// Healthy returns error when the worker loop is not started, or it is stuck over the threshold.
+func (h *HealthChecker) Healthy() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lastLoop.IsZero() {
+		return errors.New("worker loop is not started")
+	}
+	if elapsed := time.Since(h.lastLoop); elapsed > h.threshold {
+		return errors.Errorf("last loop iteration was %s ago, over threshold %s", elapsed.Truncate(time.Second), h.threshold)
+	}
+	return nil
+}
+
+// Ready returns error when the queue url is not resolved, or the credentials are not obtained.
+// the credentials are checked without the lock, for not blocking the worker loop and Healthy.
+func (h *HealthChecker) Ready(ctx context.Context) error {
+	if _, err := h.receiver.getQueueURL(); err != nil {
+		return errors.Wrap(err, "queue url is not resolved")
+	}
+	h.mu.Lock()
+	awsReady, gcpReady := h.awsReady, h.gcpReady
+	h.mu.Unlock()
+	if !awsReady {
+		if _, err := h.sess.Config.Credentials.Get(); err != nil {
+			return errors.Wrap(err, "aws credentials are not obtained")
+		}
+		h.mu.Lock()
+		h.awsReady = true
+		h.mu.Unlock()
+	}
+	if !gcpReady {
+		if err := h.checkGCPCredentials(ctx); err != nil {
+			return errors.Wrap(err, "gcp credentials are not obtained")
+		}
+		h.mu.Lock()
+		h.gcpReady = true
+		h.mu.Unlock()
+	}
+	return nil
+}
+
+func (h *HealthChecker) checkGCPCredentials(ctx context.Context) error {
+	if h.gcp == nil || h.gcp.WithoutAuthentication {
+		return nil
+	}
+	var creds *google.Credentials
+	var err error
+	if !h.gcp.Base64Credential.IsEmpty() {
+		creds, err = google.CredentialsFromJSON(ctx, h.gcp.Base64Credential.Bytes(), bigquery.Scope)
+	} else {
+		creds, err = google.FindDefaultCredentials(ctx, bigquery.Scope)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = creds.TokenSource.Token()
+	return err
+}
+
+// Handler serves /healthz and /readyz.
+func (h *HealthChecker) Handler() http.Handler {
+	return healthHandler(h.Healthy, h.Ready)
+}
+
+// HealthCheckers reports the health of the workers of queues, healthy and ready only when all of them are.
+type HealthCheckers []*HealthChecker
+
+func (hs HealthCheckers) SetThreshold(threshold time.Duration) {
+	for _, h := range hs {
+		h.SetThreshold(threshold)
+	}
+}
+
+func (hs HealthCheckers) Healthy() error {
+	for _, h := range hs {
+		if err := h.Healthy(); err != nil {
+			return errors.Wrapf(err, "queue %s", h.receiver.GetQueueName())
+		}
+	}
+	return nil
+}
+
+func (hs HealthCheckers) Ready(ctx context.Context) error {
+	for _, h := range hs {
+		if err := h.Ready(ctx); err != nil {
+			return errors.Wrapf(err, "queue %s", h.receiver.GetQueueName())
+		}
+	}
+	return nil
+}
+
+// Handler serves /healthz and /readyz.
+func (hs HealthCheckers) Handler() http.Handler {
+	return healthHandler(hs.Healthy, hs.Ready)
+}
+
+func healthHandler(healthy func() error, ready func(context.Context) error) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, healthy())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, ready(r.Context()))
+	})
+	return mux
+}
+
+func writeHealth(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
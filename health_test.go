@@ -0,0 +1,111 @@
+package bqin_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/kayac/bqin"
+	"github.com/kayac/bqin/internal/logger"
+)
+
+func TestHealthChecker(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	mgr := NewStubManager("testdata/s3/")
+	defer mgr.Close()
+
+	conf, err := bqin.LoadConfig("testdata/config/standard.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	mgr.OverwriteConfig(conf)
+	app := bqin.NewApp(conf)
+	handler := app.Health.Handler()
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		t.Logf("%s: %d %s", path, w.Code, w.Body.String())
+		return w.Code
+	}
+
+	if code := get("/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("healthz must be unavailable before the loop started: %d", code)
+	}
+	if code := get("/readyz"); code != http.StatusOK {
+		t.Errorf("readyz unexpected status: %d", code)
+	}
+
+	err = app.Run(context.Background(), bqin.WithExitNoMessage(true))
+	if err != nil {
+		t.Fatalf("unexpected run error: %s", err)
+	}
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Errorf("healthz unexpected status: %d", code)
+	}
+
+	app.Health.SetThreshold(time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if code := get("/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("healthz must be unavailable over the threshold: %d", code)
+	}
+}
+
+// blockingProvider blocks retrieving credentials until released.
+type blockingProvider struct {
+	called  chan struct{}
+	release chan struct{}
+}
+
+func (p *blockingProvider) Retrieve() (credentials.Value, error) {
+	close(p.called)
+	<-p.release
+	return credentials.Value{AccessKeyID: "ACCESS_KEY_ID", SecretAccessKey: "SECRET_ACCESS_KEY"}, nil
+}
+
+func (p *blockingProvider) IsExpired() bool {
+	return true
+}
+
+func TestHealthCheckerReadyNotBlocking(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	mgr := NewStubManager("testdata/s3/")
+	defer mgr.Close()
+
+	conf, err := bqin.LoadConfig("testdata/config/standard.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	mgr.OverwriteConfig(conf)
+	factory := &bqin.Factory{Config: conf}
+	sess := factory.NewAWSSession()
+	provider := &blockingProvider{called: make(chan struct{}), release: make(chan struct{})}
+	health := bqin.NewHealthChecker(
+		bqin.NewReceiver(conf.QueueName, sess),
+		sess.Copy(&aws.Config{Credentials: credentials.NewCredentials(provider)}),
+		conf.Cloud.GCP,
+	)
+
+	ready := make(chan error)
+	go func() {
+		ready <- health.Ready(context.Background())
+	}()
+	<-provider.called
+	healthy := make(chan error)
+	go func() {
+		healthy <- health.Healthy()
+	}()
+	select {
+	case <-healthy:
+	case <-time.After(time.Second):
+		t.Error("Healthy must not be blocked while Ready obtains credentials")
+	}
+	close(provider.release)
+	if err := <-ready; err != nil {
+		t.Errorf("unexpected ready error: %s", err)
+	}
+}
@@ -25,6 +25,10 @@ func MustParseURL(raw string) *url.URL {
 	return u
 }
 
+func MustParseRecord(raw string) *bqin.S3Record {
+	return bqin.NewS3Record(MustParseURL(raw))
+}
+
 type StubManager struct {
 	SQS          *stub.StubSQS
 	S3           *stub.StubS3
@@ -49,6 +53,9 @@ func (m *StubManager) Close() {
 }
 
 func (m *StubManager) OverwriteConfig(conf *bqin.Config) {
+	if conf.Cloud.AWS.Region == "" {
+		conf.Cloud.AWS.Region = "ap-northeast-1"
+	}
 	conf.Cloud.AWS.DisableSSL = true
 	conf.Cloud.AWS.S3Endpoint = m.S3.Endpoint()
 	conf.Cloud.AWS.SQSEndpoint = m.SQS.Endpoint()
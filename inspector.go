@@ -0,0 +1,226 @@
+package bqin
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/kayac/bqin/internal/logger"
+	"github.com/pkg/errors"
+)
+
+type Inspector struct {
+	//for s3 client session
+	sess *session.Session
+}
+
+func NewInspector(sess *session.Session) *Inspector {
+	return &Inspector{
+		sess: sess,
+	}
+}
+
+// objectCache caches head and tagging results during processing a message,
+// an object overwritten at the same key is inspected again by the next message.
+type objectCache struct {
+	mu    sync.Mutex
+	items map[string]interface{}
+}
+
+type objectCacheKey struct{}
+
+// withObjectCache returns the context which caches object attributes while it is used.
+func withObjectCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, objectCacheKey{}, &objectCache{
+		items: make(map[string]interface{}),
+	})
+}
+
+func getObjectCache(ctx context.Context) *objectCache {
+	c, _ := ctx.Value(objectCacheKey{}).(*objectCache)
+	return c
+}
+
+func (c *objectCache) get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.items[key]
+	return v, ok
+}
+
+func (c *objectCache) add(key string, v interface{}) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items[key] = v
+}
+
+type S3ObjectInfo struct {
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+	Metadata     map[string]string
+}
+
+func (info *S3ObjectInfo) String() string {
+	return fmt.Sprintf("size=%d, content_type=%s", info.Size, info.ContentType)
+}
+
+// Inspect checks the source object of the job by rule.pre_load before transport.
+// if the object should be skipped, returns error caused by ErrSkipObject.
+func (i *Inspector) Inspect(ctx context.Context, job *Job) error {
+	check := job.PreLoad
+	if check == nil {
+		return nil
+	}
+	if pattern, ok := check.matchSkipPattern(job.Source); ok {
+		return errors.Wrapf(ErrSkipObject, "object key matches skip pattern `%s`", pattern)
+	}
+	if !check.needsHead() {
+		return nil
+	}
+	info, err := i.Head(ctx, job.Source)
+	if err != nil {
+		return err
+	}
+	logger.FromContext(ctx).Debugf("head object %s: %s", job.Source, info)
+	return check.Check(info)
+}
+
+// Head returns the object attributes by HeadObject.
+// the result is cached per object in the context by withObjectCache.
+func (i *Inspector) Head(ctx context.Context, loc *url.URL) (*S3ObjectInfo, error) {
+	if loc.Scheme != "s3" {
+		return nil, errors.New("source is not s3 object")
+	}
+	cache := getObjectCache(ctx)
+	cacheKey := "head:" + loc.String()
+	if v, ok := cache.get(cacheKey); ok {
+		return v.(*S3ObjectInfo), nil
+	}
+	resp, err := s3.New(i.sess).HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(loc.Host),
+		Key:    aws.String(loc.Path),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "head object from s3 failed")
+	}
+	info := &S3ObjectInfo{
+		Size:         aws.Int64Value(resp.ContentLength),
+		ContentType:  aws.StringValue(resp.ContentType),
+		ETag:         strings.Trim(aws.StringValue(resp.ETag), `"`),
+		LastModified: aws.TimeValue(resp.LastModified),
+		Metadata:     make(map[string]string, len(resp.Metadata)),
+	}
+	for k, v := range resp.Metadata {
+		info.Metadata[strings.ToLower(k)] = aws.StringValue(v)
+	}
+	cache.add(cacheKey, info)
+	return info, nil
+}
+
+// Tags returns the object tags by GetObjectTagging.
+// the result is cached per object in the context by withObjectCache.
+func (i *Inspector) Tags(ctx context.Context, loc *url.URL) (map[string]string, error) {
+	if loc.Scheme != "s3" {
+		return nil, errors.New("source is not s3 object")
+	}
+	cache := getObjectCache(ctx)
+	cacheKey := "tags:" + loc.String()
+	if v, ok := cache.get(cacheKey); ok {
+		return v.(map[string]string), nil
+	}
+	resp, err := s3.New(i.sess).GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(loc.Host),
+		Key:    aws.String(loc.Path),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "get object tagging from s3 failed")
+	}
+	tags := make(map[string]string, len(resp.TagSet))
+	for _, tag := range resp.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	cache.add(cacheKey, tags)
+	return tags, nil
+}
+
+// S3ListedObject is the object listed by List.
+type S3ListedObject struct {
+	*url.URL
+	S3ObjectInfo
+}
+
+// List calls fn for each object under the prefix in key order, starting after startAfter.
+// listing stops when fn returns error, and the error is returned.
+func (i *Inspector) List(ctx context.Context, prefix *url.URL, startAfter string, fn func(*S3ListedObject) error) error {
+	if prefix.Scheme != "s3" {
+		return errors.New("prefix is not s3 uri")
+	}
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(prefix.Host),
+		Prefix: aws.String(strings.TrimPrefix(prefix.Path, "/")),
+	}
+	if startAfter != "" {
+		input.StartAfter = aws.String(startAfter)
+	}
+	var fnErr error
+	err := s3.New(i.sess).ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, obj := range page.Contents {
+			o := &S3ListedObject{
+				URL: &url.URL{
+					Scheme: "s3",
+					Host:   prefix.Host,
+					Path:   aws.StringValue(obj.Key),
+				},
+				S3ObjectInfo: S3ObjectInfo{
+					Size:         aws.Int64Value(obj.Size),
+					ETag:         strings.Trim(aws.StringValue(obj.ETag), `"`),
+					LastModified: aws.TimeValue(obj.LastModified),
+				},
+			}
+			if fnErr = fn(o); fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return errors.Wrap(err, "list objects from s3 failed")
+}
+
+// objectRef is lazy reference to the s3 object attributes.
+// HeadObject and GetObjectTagging are called only when the attributes are needed.
+type objectRef struct {
+	ctx       context.Context
+	inspector *Inspector
+	loc       *url.URL
+}
+
+func (o *objectRef) Info() (*S3ObjectInfo, error) {
+	if o.inspector == nil {
+		return nil, errors.New("inspector is not available")
+	}
+	return o.inspector.Head(o.ctx, o.loc)
+}
+
+func (o *objectRef) Tags() (map[string]string, error) {
+	if o.inspector == nil {
+		return nil, errors.New("inspector is not available")
+	}
+	return o.inspector.Tags(o.ctx, o.loc)
+}
@@ -0,0 +1,149 @@
+package bqin_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kayac/bqin"
+	"github.com/kayac/bqin/internal/logger"
+	"github.com/kayac/bqin/internal/stub"
+	"github.com/pkg/errors"
+)
+
+func TestInspector(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	stubS3 := stub.NewStubS3("testdata/s3/")
+	defer stubS3.Close()
+
+	conf := bqin.NewDefaultConfig()
+	conf.Cloud.AWS = &bqin.AWS{
+		Region:           "local",
+		DisableSSL:       true,
+		S3ForcePathStyle: true,
+		S3Endpoint:       stubS3.Endpoint(),
+		AccessKeyID:      "AWS_ACCESS_KEY_ID",
+		SecretAccessKey:  "AWS_SECRET_ACCESS_KEY",
+	}
+	factory := &bqin.Factory{Config: conf}
+	inspector := factory.NewInspector()
+
+	cases := []struct {
+		Comment string
+		Source  string
+		PreLoad *bqin.PreLoadOption
+		IsSkip  bool
+		IsErr   bool
+	}{
+		{
+			Comment: "no checks",
+			Source:  "s3://bqin.bucket.test/data/user/snapshot_at=20200210/_SUCCESS",
+			PreLoad: nil,
+		},
+		{
+			Comment: "match skip pattern",
+			Source:  "s3://bqin.bucket.test/data/user/snapshot_at=20200210/_SUCCESS",
+			PreLoad: &bqin.PreLoadOption{SkipPatterns: []string{"_SUCCESS"}},
+			IsSkip:  true,
+		},
+		{
+			Comment: "empty object",
+			Source:  "s3://bqin.bucket.test/data/user/snapshot_at=20200210/_SUCCESS",
+			PreLoad: &bqin.PreLoadOption{MinSize: 1},
+			IsSkip:  true,
+		},
+		{
+			Comment: "oversized object",
+			Source:  "s3://bqin.bucket.test/data/user/snapshot_at=20200210/part-0001.csv",
+			PreLoad: &bqin.PreLoadOption{MaxSize: 10},
+			IsSkip:  true,
+		},
+		{
+			Comment: "content type not allowed",
+			Source:  "s3://bqin.bucket.test/data/user/snapshot_at=20200210/part-0001.csv",
+			PreLoad: &bqin.PreLoadOption{ContentTypes: []string{"application/json"}},
+			IsSkip:  true,
+		},
+		{
+			Comment: "pass all checks",
+			Source:  "s3://bqin.bucket.test/data/user/snapshot_at=20200210/part-0001.csv",
+			PreLoad: &bqin.PreLoadOption{
+				MinSize:      1,
+				MaxSize:      1024,
+				ContentTypes: []string{"text/*"},
+				SkipPatterns: []string{"_SUCCESS"},
+			},
+		},
+		{
+			Comment: "s3 object not found",
+			Source:  "s3://bqin.bucket.test/data/not_found.csv",
+			PreLoad: &bqin.PreLoadOption{MinSize: 1},
+			IsErr:   true,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("case-%02d", i), func(t *testing.T) {
+			t.Log(c.Comment)
+			job := &bqin.Job{
+				TransportJob: &bqin.TransportJob{
+					Source: MustParseURL(c.Source),
+				},
+				PreLoad: c.PreLoad,
+			}
+			err := inspector.Inspect(context.Background(), job)
+			t.Logf("err is %v", err)
+			isSkip := errors.Cause(err) == bqin.ErrSkipObject
+			if isSkip != c.IsSkip {
+				t.Error("unexpected skip state")
+			}
+			if (err != nil && !isSkip) != c.IsErr {
+				t.Error("unexpected error state")
+			}
+		})
+	}
+}
+
+func TestInspectorHeadOverwritten(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	dir, err := ioutil.TempDir("", "bqin-inspector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	objectPath := filepath.Join(dir, "bqin.bucket.test", "data", "user.csv")
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	stubS3 := stub.NewStubS3(dir + "/")
+	defer stubS3.Close()
+
+	conf := bqin.NewDefaultConfig()
+	conf.Cloud.AWS = &bqin.AWS{
+		Region:           "local",
+		DisableSSL:       true,
+		S3ForcePathStyle: true,
+		S3Endpoint:       stubS3.Endpoint(),
+		AccessKeyID:      "AWS_ACCESS_KEY_ID",
+		SecretAccessKey:  "AWS_SECRET_ACCESS_KEY",
+	}
+	inspector := (&bqin.Factory{Config: conf}).NewInspector()
+	loc, _ := url.Parse("s3://bqin.bucket.test/data/user.csv")
+
+	// the object is overwritten at the same key between messages.
+	for _, body := range []string{"1\n", "1\n2\n"} {
+		if err := ioutil.WriteFile(objectPath, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, err := inspector.Head(context.Background(), loc)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if info.Size != int64(len(body)) {
+			t.Errorf("head must return attributes of the current object, size=%d expected=%d", info.Size, len(body))
+		}
+	}
+}
@@ -1,53 +1,167 @@
 package logger
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
-	"log"
-
-	"github.com/hashicorp/logutils"
+	"log/slog"
+	"sync"
 )
 
 const (
 	DebugLevel = "debug"
 	InfoLevel  = "info"
+	WarnLevel  = "warn"
 	ErrorLevel = "error"
 )
 
+const (
+	TextFormat = "text"
+	JSONFormat = "json"
+)
+
+var levels = map[string]slog.Level{
+	DebugLevel: slog.LevelDebug,
+	InfoLevel:  slog.LevelInfo,
+	WarnLevel:  slog.LevelWarn,
+	ErrorLevel: slog.LevelError,
+}
+
+var (
+	mu      sync.RWMutex
+	handler slog.Handler = slog.NewTextHandler(io.Discard, nil)
+)
+
+// Setup sets up the logger of text format.
 func Setup(out io.Writer, minLevel string) {
-	filter := &logutils.LevelFilter{
-		Levels:   []logutils.LogLevel{DebugLevel, InfoLevel, ErrorLevel},
-		MinLevel: logutils.LogLevel(minLevel),
-		Writer:   out,
+	if err := SetupWithFormat(out, minLevel, TextFormat); err != nil {
+		panic(err)
+	}
+}
+
+// SetupWithFormat sets up the logger, format is text or json.
+// the standard log package is also written by the logger in info level.
+func SetupWithFormat(out io.Writer, minLevel, format string) error {
+	level, ok := levels[minLevel]
+	if !ok {
+		return fmt.Errorf("log level `%s` is not supported", minLevel)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch format {
+	case TextFormat, "":
+		h = slog.NewTextHandler(out, opts)
+	case JSONFormat:
+		h = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("log format `%s` is not supported", format)
 	}
-	log.SetOutput(filter)
+	mu.Lock()
+	handler = h
+	mu.Unlock()
+	slog.SetDefault(slog.New(h))
+	return nil
 }
 
+func getHandler() slog.Handler {
+	mu.RLock()
+	defer mu.RUnlock()
+	return handler
+}
+
+// Logger writes logs with the fields.
+type Logger struct {
+	attrs []slog.Attr
+}
+
+// keys of the fields carried by the context.
+const (
+	FieldQueue     = "queue"
+	FieldMessageID = "message_id"
+	FieldRule      = "rule"
+	FieldS3URI     = "s3_uri"
+	FieldTable     = "table"
+	FieldBQJobID   = "bq_job_id"
+)
+
+type contextKey struct{}
+
+// WithFields returns the context which carries the fields in addition to the fields of ctx.
+// keysAndValues are pairs of the key and value, such as "message_id", id.
+func WithFields(ctx context.Context, keysAndValues ...string) context.Context {
+	return context.WithValue(ctx, contextKey{}, FromContext(ctx).With(keysAndValues...))
+}
+
+// With returns the logger with the fields in addition to the fields of l.
+func (l *Logger) With(keysAndValues ...string) *Logger {
+	attrs := make([]slog.Attr, 0, len(l.attrs)+len(keysAndValues)/2)
+	attrs = append(attrs, l.attrs...)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		attrs = append(attrs, slog.String(keysAndValues[i], keysAndValues[i+1]))
+	}
+	return &Logger{attrs: attrs}
+}
+
+// FromContext returns the logger with the fields carried by ctx.
+func FromContext(ctx context.Context) *Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+			return l
+		}
+	}
+	return &Logger{}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.printf(slog.LevelDebug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.printf(slog.LevelInfo, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.printf(slog.LevelWarn, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.printf(slog.LevelError, format, args...)
+}
+
+func (l *Logger) printf(level slog.Level, format string, args ...interface{}) {
+	h := getHandler()
+	ctx := context.Background()
+	if !h.Enabled(ctx, level) {
+		return
+	}
+	logger := slog.New(h)
+	logger.LogAttrs(ctx, level, fmt.Sprintf(format, args...), l.attrs...)
+}
+
+var std = &Logger{}
+
 func Debugf(format string, args ...interface{}) {
-	printf(DebugLevel, format, args...)
+	std.Debugf(format, args...)
 }
 
 func Infof(format string, args ...interface{}) {
-	printf(InfoLevel, format, args...)
+	std.Infof(format, args...)
 }
 
-func Errorf(format string, args ...interface{}) {
-	printf(ErrorLevel, format, args...)
+func Warnf(format string, args ...interface{}) {
+	std.Warnf(format, args...)
 }
 
-func printf(level, format string, args ...interface{}) {
-	log.Printf("["+level+"] "+format, args...)
+func Errorf(format string, args ...interface{}) {
+	std.Errorf(format, args...)
 }
 
 func InfoDump(v interface{}) {
-	dump(InfoLevel, v)
-}
-
-func dump(level string, v interface{}) {
 	s, err := json.Marshal(v)
 	if err != nil {
-		printf(level, "%+v", v)
+		Infof("%+v", v)
 		return
 	}
-	printf(level, string(s))
+	Infof("%s", s)
 }
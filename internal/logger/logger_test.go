@@ -0,0 +1,62 @@
+package logger_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/kayac/bqin/internal/logger"
+)
+
+func TestJSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	if err := logger.SetupWithFormat(&buf, logger.WarnLevel, logger.JSONFormat); err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Setup(logger.NewTestingLogWriter(t), logger.InfoLevel)
+
+	ctx := logger.WithFields(context.Background(), logger.FieldMessageID, "msg-1")
+	ctx = logger.WithFields(ctx, logger.FieldTable, "project.dataset.table")
+	logger.FromContext(ctx).Infof("this is filtered")
+	logger.FromContext(ctx).Warnf("retry %d", 1)
+	logger.Errorf("without fields")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected lines: %v", lines)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("log is not json: %s", err)
+	}
+	expected := map[string]string{
+		"level":      "WARN",
+		"msg":        "retry 1",
+		"message_id": "msg-1",
+		"table":      "project.dataset.table",
+	}
+	for k, v := range expected {
+		if entry[k] != v {
+			t.Errorf("%s is unexpected: %v", k, entry[k])
+		}
+	}
+	entry = map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatalf("log is not json: %s", err)
+	}
+	if _, ok := entry["message_id"]; ok || entry["level"] != "ERROR" {
+		t.Errorf("unexpected entry: %v", entry)
+	}
+}
+
+func TestSetupWithFormatInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	if err := logger.SetupWithFormat(&buf, "verbose", logger.TextFormat); err == nil {
+		t.Error("invalid level must be error")
+	}
+	if err := logger.SetupWithFormat(&buf, logger.InfoLevel, "xml"); err == nil {
+		t.Error("invalid format must be error")
+	}
+}
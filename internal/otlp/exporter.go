@@ -0,0 +1,261 @@
+// Package otlp is a span exporter of the OTLP/HTTP protocol with JSON encoding.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Exporter posts spans to `<endpoint>/v1/traces`.
+type Exporter struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+
+	mu       sync.Mutex
+	shutdown bool
+}
+
+func NewExporter(endpoint string, headers map[string]string) *Exporter {
+	return &Exporter{
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		headers: headers,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *Exporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.mu.Lock()
+	shutdown := e.shutdown
+	e.mu.Unlock()
+	if shutdown || len(spans) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(newTracesData(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("otlp export failed: %s", resp.Status)
+	}
+	return nil
+}
+
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.shutdown = true
+	return nil
+}
+
+// see https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+type tracesData struct {
+	ResourceSpans []*resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource      `json:"resource"`
+	ScopeSpans []*scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes,omitempty"`
+}
+
+type scopeSpans struct {
+	Scope scope   `json:"scope"`
+	Spans []*span `json:"spans"`
+}
+
+type scope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type span struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Events            []event    `json:"events,omitempty"`
+	Status            status     `json:"status"`
+}
+
+type event struct {
+	Name         string     `json:"name"`
+	TimeUnixNano string     `json:"timeUnixNano"`
+	Attributes   []keyValue `json:"attributes,omitempty"`
+}
+
+type status struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string     `json:"stringValue,omitempty"`
+	BoolValue   *bool       `json:"boolValue,omitempty"`
+	IntValue    *string     `json:"intValue,omitempty"`
+	DoubleValue *float64    `json:"doubleValue,omitempty"`
+	ArrayValue  *arrayValue `json:"arrayValue,omitempty"`
+}
+
+type arrayValue struct {
+	Values []anyValue `json:"values"`
+}
+
+func newTracesData(spans []sdktrace.ReadOnlySpan) *tracesData {
+	data := &tracesData{}
+	resources := make(map[string]*resourceSpans)
+	scopes := make(map[string]*scopeSpans)
+	for _, s := range spans {
+		resKey := s.Resource().Encoded(attribute.DefaultEncoder())
+		rs, ok := resources[resKey]
+		if !ok {
+			rs = &resourceSpans{Resource: resource{Attributes: keyValues(s.Resource().Attributes())}}
+			resources[resKey] = rs
+			data.ResourceSpans = append(data.ResourceSpans, rs)
+		}
+		lib := s.InstrumentationScope()
+		scopeKey := resKey + "\x00" + lib.Name + "\x00" + lib.Version
+		ss, ok := scopes[scopeKey]
+		if !ok {
+			ss = &scopeSpans{Scope: scope{Name: lib.Name, Version: lib.Version}}
+			scopes[scopeKey] = ss
+			rs.ScopeSpans = append(rs.ScopeSpans, ss)
+		}
+		ss.Spans = append(ss.Spans, newSpan(s))
+	}
+	return data
+}
+
+func newSpan(s sdktrace.ReadOnlySpan) *span {
+	ret := &span{
+		TraceID:           s.SpanContext().TraceID().String(),
+		SpanID:            s.SpanContext().SpanID().String(),
+		Name:              s.Name(),
+		Kind:              int(s.SpanKind()),
+		StartTimeUnixNano: unixNano(s.StartTime()),
+		EndTimeUnixNano:   unixNano(s.EndTime()),
+		Attributes:        keyValues(s.Attributes()),
+	}
+	if s.Parent().IsValid() {
+		ret.ParentSpanID = s.Parent().SpanID().String()
+	}
+	for _, e := range s.Events() {
+		ret.Events = append(ret.Events, event{
+			Name:         e.Name,
+			TimeUnixNano: unixNano(e.Time),
+			Attributes:   keyValues(e.Attributes),
+		})
+	}
+	// OTLP status codes are UNSET=0, OK=1, ERROR=2.
+	switch s.Status().Code {
+	case codes.Ok:
+		ret.Status.Code = 1
+	case codes.Error:
+		ret.Status.Code = 2
+		ret.Status.Message = s.Status().Description
+	}
+	return ret
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func keyValues(attrs []attribute.KeyValue) []keyValue {
+	ret := make([]keyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		ret = append(ret, keyValue{Key: string(attr.Key), Value: newAnyValue(attr.Value)})
+	}
+	return ret
+}
+
+func newAnyValue(value attribute.Value) anyValue {
+	var v anyValue
+	switch value.Type() {
+	case attribute.BOOL:
+		v.BoolValue = boolValue(value.AsBool())
+	case attribute.INT64:
+		v.IntValue = intValue(value.AsInt64())
+	case attribute.FLOAT64:
+		v.DoubleValue = doubleValue(value.AsFloat64())
+	case attribute.STRING:
+		v.StringValue = stringValue(value.AsString())
+	case attribute.BOOLSLICE:
+		v.ArrayValue = &arrayValue{}
+		for _, b := range value.AsBoolSlice() {
+			v.ArrayValue.Values = append(v.ArrayValue.Values, anyValue{BoolValue: boolValue(b)})
+		}
+	case attribute.INT64SLICE:
+		v.ArrayValue = &arrayValue{}
+		for _, i := range value.AsInt64Slice() {
+			v.ArrayValue.Values = append(v.ArrayValue.Values, anyValue{IntValue: intValue(i)})
+		}
+	case attribute.FLOAT64SLICE:
+		v.ArrayValue = &arrayValue{}
+		for _, f := range value.AsFloat64Slice() {
+			v.ArrayValue.Values = append(v.ArrayValue.Values, anyValue{DoubleValue: doubleValue(f)})
+		}
+	case attribute.STRINGSLICE:
+		v.ArrayValue = &arrayValue{}
+		for _, s := range value.AsStringSlice() {
+			v.ArrayValue.Values = append(v.ArrayValue.Values, anyValue{StringValue: stringValue(s)})
+		}
+	default:
+		v.StringValue = stringValue(value.Emit())
+	}
+	return v
+}
+
+func boolValue(b bool) *bool {
+	return &b
+}
+
+// intValue returns int64 as string, the JSON encoding of OTLP.
+func intValue(i int64) *string {
+	s := strconv.FormatInt(i, 10)
+	return &s
+}
+
+func doubleValue(f float64) *float64 {
+	return &f
+}
+
+func stringValue(s string) *string {
+	return &s
+}
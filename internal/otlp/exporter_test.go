@@ -0,0 +1,268 @@
+package otlp_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/kayac/bqin/internal/otlp"
+	"github.com/kylelemons/godebug/pretty"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type collector struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []map[string]interface{}
+	status   int
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	bs, _ := ioutil.ReadAll(req.Body)
+	var body map[string]interface{}
+	if err := json.Unmarshal(bs, &body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, req)
+	c.bodies = append(c.bodies, body)
+	if c.status != 0 {
+		w.WriteHeader(c.status)
+	}
+}
+
+func newTracerProvider(e *otlp.Exporter) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(e),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "bqin"))),
+	)
+}
+
+func TestExporterEncoding(t *testing.T) {
+	c := &collector{}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	e := otlp.NewExporter(server.URL+"/", map[string]string{"Authorization": "Bearer token"})
+	tp := newTracerProvider(e)
+	tracer := tp.Tracer("github.com/kayac/bqin", trace.WithInstrumentationVersion("v0.0.0"))
+
+	ctx, parent := tracer.Start(context.Background(), "process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("string", "value"),
+			attribute.Bool("bool", true),
+			attribute.Int64("int", 42),
+			attribute.Float64("double", 1.5),
+			attribute.StringSlice("strings", []string{"a", "b"}),
+			attribute.Int64Slice("ints", []int64{1, 2}),
+		),
+	)
+	_, child := tracer.Start(ctx, "BigQuery.POST", trace.WithSpanKind(trace.SpanKindClient))
+	child.AddEvent("retry", trace.WithAttributes(attribute.Int("attempt", 2)))
+	child.SetStatus(codes.Error, "backend error")
+	child.End()
+	parent.SetStatus(codes.Ok, "")
+	parent.End()
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.requests) != 2 {
+		t.Fatalf("unexpected number of exports: %d", len(c.requests))
+	}
+	req := c.requests[0]
+	if req.URL.Path != "/v1/traces" {
+		t.Errorf("unexpected path: %s", req.URL.Path)
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected content type: %s", ct)
+	}
+	if auth := req.Header.Get("Authorization"); auth != "Bearer token" {
+		t.Errorf("unexpected authorization header: %s", auth)
+	}
+
+	childSpan := onlySpan(t, c.bodies[0])
+	parentSpan := onlySpan(t, c.bodies[1])
+	hexID := regexp.MustCompile(`^[0-9a-f]+$`)
+	for _, s := range []map[string]interface{}{childSpan, parentSpan} {
+		traceID, _ := s["traceId"].(string)
+		spanID, _ := s["spanId"].(string)
+		if len(traceID) != 32 || !hexID.MatchString(traceID) {
+			t.Errorf("unexpected traceId: %v", s["traceId"])
+		}
+		if len(spanID) != 16 || !hexID.MatchString(spanID) {
+			t.Errorf("unexpected spanId: %v", s["spanId"])
+		}
+		if _, ok := s["startTimeUnixNano"].(string); !ok {
+			t.Errorf("startTimeUnixNano is not encoded as string: %v", s["startTimeUnixNano"])
+		}
+	}
+	if childSpan["traceId"] != parentSpan["traceId"] {
+		t.Errorf("trace ids are not same: %v, %v", childSpan["traceId"], parentSpan["traceId"])
+	}
+	if childSpan["parentSpanId"] != parentSpan["spanId"] {
+		t.Errorf("unexpected parentSpanId: %v", childSpan["parentSpanId"])
+	}
+	if _, ok := parentSpan["parentSpanId"]; ok {
+		t.Errorf("parentSpanId of the root span is encoded: %v", parentSpan["parentSpanId"])
+	}
+
+	resourceSpans := c.bodies[1]["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	expectedResource := map[string]interface{}{
+		"attributes": []interface{}{
+			map[string]interface{}{"key": "service.name", "value": map[string]interface{}{"stringValue": "bqin"}},
+		},
+	}
+	if diff := pretty.Compare(resourceSpans["resource"], expectedResource); diff != "" {
+		t.Errorf("unexpected resource: %s", diff)
+	}
+	scope := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})["scope"]
+	expectedScope := map[string]interface{}{"name": "github.com/kayac/bqin", "version": "v0.0.0"}
+	if diff := pretty.Compare(scope, expectedScope); diff != "" {
+		t.Errorf("unexpected scope: %s", diff)
+	}
+
+	// OTLP span kinds are INTERNAL=1, SERVER=2, CLIENT=3, PRODUCER=4, CONSUMER=5.
+	if parentSpan["kind"] != float64(5) {
+		t.Errorf("unexpected kind of consumer span: %v", parentSpan["kind"])
+	}
+	if childSpan["kind"] != float64(3) {
+		t.Errorf("unexpected kind of client span: %v", childSpan["kind"])
+	}
+	// OTLP status codes are UNSET=0, OK=1, ERROR=2.
+	if diff := pretty.Compare(parentSpan["status"], map[string]interface{}{"code": float64(1)}); diff != "" {
+		t.Errorf("unexpected status of ok span: %s", diff)
+	}
+	expectedStatus := map[string]interface{}{"code": float64(2), "message": "backend error"}
+	if diff := pretty.Compare(childSpan["status"], expectedStatus); diff != "" {
+		t.Errorf("unexpected status of error span: %s", diff)
+	}
+
+	expectedAttributes := []interface{}{
+		map[string]interface{}{"key": "bool", "value": map[string]interface{}{"boolValue": true}},
+		map[string]interface{}{"key": "double", "value": map[string]interface{}{"doubleValue": 1.5}},
+		map[string]interface{}{"key": "int", "value": map[string]interface{}{"intValue": "42"}},
+		map[string]interface{}{"key": "ints", "value": map[string]interface{}{"arrayValue": map[string]interface{}{
+			"values": []interface{}{
+				map[string]interface{}{"intValue": "1"},
+				map[string]interface{}{"intValue": "2"},
+			},
+		}}},
+		map[string]interface{}{"key": "string", "value": map[string]interface{}{"stringValue": "value"}},
+		map[string]interface{}{"key": "strings", "value": map[string]interface{}{"arrayValue": map[string]interface{}{
+			"values": []interface{}{
+				map[string]interface{}{"stringValue": "a"},
+				map[string]interface{}{"stringValue": "b"},
+			},
+		}}},
+	}
+	if diff := pretty.Compare(sortedAttributes(parentSpan["attributes"]), expectedAttributes); diff != "" {
+		t.Errorf("unexpected attributes: %s", diff)
+	}
+	events, _ := childSpan["events"].([]interface{})
+	if len(events) != 1 {
+		t.Fatalf("unexpected events: %v", childSpan["events"])
+	}
+	ev := events[0].(map[string]interface{})
+	if ev["name"] != "retry" {
+		t.Errorf("unexpected event name: %v", ev["name"])
+	}
+	expectedEventAttributes := []interface{}{
+		map[string]interface{}{"key": "attempt", "value": map[string]interface{}{"intValue": "2"}},
+	}
+	if diff := pretty.Compare(ev["attributes"], expectedEventAttributes); diff != "" {
+		t.Errorf("unexpected event attributes: %s", diff)
+	}
+}
+
+func TestExporterFailure(t *testing.T) {
+	c := &collector{status: http.StatusServiceUnavailable}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	e := otlp.NewExporter(server.URL, nil)
+	var exportErr error
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(&recordingProcessor{exporter: e, err: &exportErr}))
+	_, span := tp.Tracer("test").Start(context.Background(), "span")
+	span.End()
+	if exportErr == nil {
+		t.Error("error status of the collector is not returned")
+	}
+
+	// after shutdown, spans are dropped without requests.
+	if err := e.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	exportErr = errors.New("not exported")
+	_, span = tp.Tracer("test").Start(context.Background(), "span")
+	span.End()
+	if exportErr != nil {
+		t.Errorf("unexpected error after shutdown: %s", exportErr)
+	}
+	if len(c.requests) != 1 {
+		t.Errorf("unexpected number of exports: %d", len(c.requests))
+	}
+}
+
+// recordingProcessor exports each span synchronously and records the error of the exporter.
+type recordingProcessor struct {
+	exporter *otlp.Exporter
+	err      *error
+}
+
+func (p *recordingProcessor) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+
+func (p *recordingProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	*p.err = p.exporter.ExportSpans(context.Background(), []sdktrace.ReadOnlySpan{s})
+}
+
+func (p *recordingProcessor) Shutdown(context.Context) error { return nil }
+
+func (p *recordingProcessor) ForceFlush(context.Context) error { return nil }
+
+func onlySpan(t *testing.T, body map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	resourceSpans, _ := body["resourceSpans"].([]interface{})
+	if len(resourceSpans) != 1 {
+		t.Fatalf("unexpected resourceSpans: %v", body)
+	}
+	scopeSpans, _ := resourceSpans[0].(map[string]interface{})["scopeSpans"].([]interface{})
+	if len(scopeSpans) != 1 {
+		t.Fatalf("unexpected scopeSpans: %v", body)
+	}
+	spans, _ := scopeSpans[0].(map[string]interface{})["spans"].([]interface{})
+	if len(spans) != 1 {
+		t.Fatalf("unexpected spans: %v", body)
+	}
+	return spans[0].(map[string]interface{})
+}
+
+// sortedAttributes returns attributes sorted by the key, the SDK sorts attributes on export.
+func sortedAttributes(v interface{}) []interface{} {
+	attrs, _ := v.([]interface{})
+	ret := make([]interface{}, len(attrs))
+	copy(ret, attrs)
+	for i := 1; i < len(ret); i++ {
+		for j := i; j > 0 && key(ret[j]) < key(ret[j-1]); j-- {
+			ret[j], ret[j-1] = ret[j-1], ret[j]
+		}
+	}
+	return ret
+}
+
+func key(v interface{}) string {
+	return v.(map[string]interface{})["key"].(string)
+}
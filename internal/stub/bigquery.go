@@ -6,6 +6,9 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/kayac/bqin/internal/logger"
@@ -15,18 +18,39 @@ type StubBigQuery struct {
 	stub
 	createdJobs map[string]*StubBigQueryResponseJob
 	loaded      map[string][]string
+	queries     []string
+	retried     map[string]bool
+	tables      map[string]interface{}
+	inserted    map[string][]map[string]interface{}
+
+	// Delay delays responses of inserting load jobs, until the request is canceled.
+	Delay time.Duration
+	// FailGetJob is the number of getting jobs failed by internalError before succeeding.
+	FailGetJob int
+	// FailGetQueryJob is same as FailGetJob, only for query jobs.
+	FailGetQueryJob int
+
+	NumberOfLoadJobsCreated  int
+	NumberOfQueryJobsCreated int
 }
 
 func NewStubBigQuery() *StubBigQuery {
 	s := &StubBigQuery{
 		createdJobs: make(map[string]*StubBigQueryResponseJob, 1),
 		loaded:      make(map[string][]string, 0),
+		retried:     make(map[string]bool),
+		tables:      make(map[string]interface{}),
+		inserted:    make(map[string][]map[string]interface{}),
 	}
 	s.setSvcName("bigquery")
 	r := s.getRouter()
 	r.HandleFunc("/projects/{dummy}", s.serveIfNotSetProjectID)
 	r.HandleFunc("/projects/{project_id}/jobs/{job_id}", s.serveGetJob).Methods("GET")
 	r.HandleFunc("/projects/{project_id}/jobs", s.serveInsertJobs).Methods("POST")
+	r.HandleFunc("/projects/{project_id}/queries/{job_id}", s.serveGetQueryResults).Methods("GET")
+	r.HandleFunc("/projects/{project_id}/datasets/{dataset_id}/tables", s.serveInsertTable).Methods("POST")
+	r.HandleFunc("/projects/{project_id}/datasets/{dataset_id}/tables/{table_id}", s.serveGetTable).Methods("GET")
+	r.HandleFunc("/projects/{project_id}/datasets/{dataset_id}/tables/{table_id}/insertAll", s.serveInsertAll).Methods("POST")
 	return s
 }
 
@@ -47,11 +71,23 @@ func (s *StubBigQuery) serveInsertJobs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if job.Configuration.Query != nil {
+		s.serveInsertQueryJob(w, job)
+		return
+	}
 	if job.Configuration.Load == nil {
 		logger.Debugf("[stub_bigquery] unsupported jobType: %#v", job.Configuration)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if s.Delay > 0 {
+		select {
+		case <-time.After(s.Delay):
+		case <-r.Context().Done():
+			logger.Debugf("[stub_bigquery] request canceled")
+			return
+		}
+	}
 	job.Configuration.JobType = "LOAD"
 	job.ID = job.JobReference.JobID
 	sources := job.Configuration.Load.SourceUris
@@ -91,6 +127,7 @@ func (s *StubBigQuery) serveInsertJobs(w http.ResponseWriter, r *http.Request) {
 
 	job.Status = &StubBigQueryResponseJobStatus{State: "PENDING"}
 	s.createdJobs[job.ID] = job
+	s.NumberOfLoadJobsCreated++
 	w.WriteHeader(http.StatusOK)
 	encoder.Encode(job)
 	logger.Debugf("[stub_bigquery] job created id = %s", job.ID)
@@ -99,6 +136,12 @@ func (s *StubBigQuery) serveInsertJobs(w http.ResponseWriter, r *http.Request) {
 
 // see https://cloud.google.com/bigquery/docs/reference/rest/v2/jobs/get?hl=ja
 func (s *StubBigQuery) serveGetJob(w http.ResponseWriter, r *http.Request) {
+	if s.FailGetJob > 0 {
+		s.FailGetJob--
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, `{"error":{"code":500,"message":"internal error","errors":[{"reason":"internalError","message":"internal error"}]}}`)
+		return
+	}
 	params := mux.Vars(r)
 	job, ok := s.createdJobs[params["job_id"]]
 	if !ok {
@@ -106,13 +149,35 @@ func (s *StubBigQuery) serveGetJob(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	if job.Configuration.Query != nil && s.FailGetQueryJob > 0 {
+		s.FailGetQueryJob--
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, `{"error":{"code":500,"message":"internal error","errors":[{"reason":"internalError","message":"internal error"}]}}`)
+		return
+	}
 	job.Status.State = "DONE"
+	if job.Configuration.Query != nil {
+		s.serveJob(w, job)
+		return
+	}
 	target := job.Configuration.Load.DestinationTable.String()
 	if _, ok := s.loaded[target]; !ok {
 		s.loaded[target] = make([]string, 0, len(job.Configuration.Load.SourceUris))
 	}
 	s.loaded[target] = append(s.loaded[target], job.Configuration.Load.SourceUris...)
+	// stub does not read objects, so each source is counted as a row.
+	n := len(job.Configuration.Load.SourceUris)
+	job.Statistics = map[string]interface{}{
+		"load": map[string]string{
+			"inputFiles":  strconv.Itoa(n),
+			"outputRows":  strconv.Itoa(n),
+			"outputBytes": strconv.Itoa(n * 100),
+		},
+	}
+	s.serveJob(w, job)
+}
 
+func (s *StubBigQuery) serveJob(w http.ResponseWriter, job *StubBigQueryResponseJob) {
 	w.WriteHeader(http.StatusOK)
 	encoder := json.NewEncoder(w)
 	if err := encoder.Encode(job); err != nil {
@@ -120,13 +185,169 @@ func (s *StubBigQuery) serveGetJob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	logger.Debugf("[stub_bigquery] job done id = %s", job.ID)
+}
+
+// query containing `FAIL` is always failed, and containing `RETRY` is failed by backendError only at first time.
+func (s *StubBigQuery) serveInsertQueryJob(w http.ResponseWriter, job *StubBigQueryResponseJob) {
+	job.Configuration.JobType = "QUERY"
+	job.ID = job.JobReference.JobID
+	job.Status = &StubBigQueryResponseJobStatus{State: "PENDING"}
+	query := job.Configuration.Query.Query
+	var respErr *StubBigQueryResponseErrorProto
+	switch {
+	case strings.Contains(query, "FAIL"):
+		respErr = &StubBigQueryResponseErrorProto{
+			Message: "query failed",
+			Reason:  "invalidQuery",
+		}
+	case strings.Contains(query, "RETRY") && !s.retried[query] && !job.Configuration.DryRun:
+		s.retried[query] = true
+		respErr = &StubBigQueryResponseErrorProto{
+			Message: "backend error",
+			Reason:  "backendError",
+		}
+	}
+	if respErr != nil {
+		job.Status.Errors = []StubBigQueryResponseErrorProto{*respErr}
+		job.Status.ErrorResult = respErr
+	}
+	if job.Configuration.DryRun {
+		job.Status.State = "DONE"
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(job)
+		logger.Debugf("[stub_bigquery] query dry run")
+		return
+	}
+	s.createdJobs[job.ID] = job
+	s.queries = append(s.queries, job.Configuration.Query.Query)
+	s.NumberOfQueryJobsCreated++
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(job)
+	logger.Debugf("[stub_bigquery] query job created id = %s", job.ID)
+}
+
+// see https://cloud.google.com/bigquery/docs/reference/rest/v2/jobs/getQueryResults?hl=ja
+func (s *StubBigQuery) serveGetQueryResults(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	job, ok := s.createdJobs[params["job_id"]]
+	if !ok {
+		logger.Debugf("[stub_bigquery] job not found id = %s", params["job_id"])
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"kind":         "bigquery#getQueryResultsResponse",
+		"jobReference": job.JobReference,
+		"jobComplete":  true,
+		"totalRows":    "0",
+	})
+}
 
+// see https://cloud.google.com/bigquery/docs/reference/rest/v2/tables/insert
+func (s *StubBigQuery) serveInsertTable(w http.ResponseWriter, r *http.Request) {
+	var table struct {
+		TableReference *StubBigQueryResponseDestinationTable `json:"tableReference"`
+		Schema         interface{}                           `json:"schema"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&table); err != nil || table.TableReference == nil {
+		logger.Debugf("[stub_bigquery] can not decode table object: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	name := table.TableReference.String()
+	if _, ok := s.tables[name]; ok {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": map[string]interface{}{
+				"code":    http.StatusConflict,
+				"message": "Already Exists: Table " + name,
+			},
+		})
+		return
+	}
+	s.tables[name] = table.Schema
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(table)
+	logger.Debugf("[stub_bigquery] table created %s", name)
+}
+
+// see https://cloud.google.com/bigquery/docs/reference/rest/v2/tables/get
+func (s *StubBigQuery) serveGetTable(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	ref := &StubBigQueryResponseDestinationTable{
+		ProjectID: params["project_id"],
+		DatasetID: params["dataset_id"],
+		TableID:   params["table_id"],
+	}
+	schema, ok := s.tables[ref.String()]
+	if !ok {
+		logger.Debugf("[stub_bigquery] table not found %s", ref)
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": map[string]interface{}{
+				"code":    http.StatusNotFound,
+				"message": "Not found: Table " + ref.String(),
+			},
+		})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"kind":           "bigquery#table",
+		"tableReference": ref,
+		"schema":         schema,
+		"numRows":        strconv.Itoa(len(s.loaded[ref.String()])),
+	})
+}
+
+// AddTable adds the table, schema is the TableSchema such as {"fields": [{"name": "id", "type": "INTEGER"}]}.
+func (s *StubBigQuery) AddTable(name string, schema interface{}) {
+	s.tables[name] = schema
+}
+
+// see https://cloud.google.com/bigquery/docs/reference/rest/v2/tabledata/insertAll
+func (s *StubBigQuery) serveInsertAll(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	name := fmt.Sprintf("%s.%s.%s", params["project_id"], params["dataset_id"], params["table_id"])
+	if _, ok := s.tables[name]; !ok {
+		logger.Debugf("[stub_bigquery] table not found %s", name)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Rows []struct {
+			JSON map[string]interface{} `json:"json"`
+		} `json:"rows"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Debugf("[stub_bigquery] can not decode rows: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, row := range req.Rows {
+		s.inserted[name] = append(s.inserted[name], row.JSON)
+	}
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, `{"kind":"bigquery#tableDataInsertAllResponse"}`)
 }
 
 func (s *StubBigQuery) LoadedData() map[string][]string {
 	return s.loaded
 }
 
+func (s *StubBigQuery) ExecutedQueries() []string {
+	return s.queries
+}
+
+func (s *StubBigQuery) CreatedTables() map[string]interface{} {
+	return s.tables
+}
+
+func (s *StubBigQuery) InsertedRows() map[string][]map[string]interface{} {
+	return s.inserted
+}
+
 //as https://cloud.google.com/bigquery/docs/reference/rest/v2/Job?hl=ja
 type StubBigQueryResponseJob struct {
 	Kind          string                               `json:"kind"`
@@ -166,14 +387,14 @@ type StubBigQueryResponseJobReference struct {
 
 //as https://cloud.google.com/bigquery/docs/reference/rest/v2/Job?hl=ja#JobConfiguration
 type StubBigQueryResponseJobConfiguration struct {
-	JobType      string                                    `json:"jobType"`
-	Query        interface{}                               `json:"query,omitempty"`
-	Load         *StubBigQueryResponseJobConfigurationLoad `json:"load,omitempty"`
-	Copy         interface{}                               `json:"copy,omitempty"`
-	Extract      interface{}                               `json:"extract,omitempty"`
-	DryRun       bool                                      `json:"dryRun"`
-	JobTimeoutMs string                                    `json:"jobTimeoutMs,omitempty"`
-	Labels       map[string]string                         `json:"labels,omitempty"`
+	JobType      string                                     `json:"jobType"`
+	Query        *StubBigQueryResponseJobConfigurationQuery `json:"query,omitempty"`
+	Load         *StubBigQueryResponseJobConfigurationLoad  `json:"load,omitempty"`
+	Copy         interface{}                                `json:"copy,omitempty"`
+	Extract      interface{}                                `json:"extract,omitempty"`
+	DryRun       bool                                       `json:"dryRun"`
+	JobTimeoutMs string                                     `json:"jobTimeoutMs,omitempty"`
+	Labels       map[string]string                          `json:"labels,omitempty"`
 }
 
 //as https://cloud.google.com/bigquery/docs/reference/rest/v2/Job?hl=ja#JobConfigurationLoad
@@ -207,6 +428,12 @@ type StubBigQueryResponseJobConfigurationLoad struct {
 	HivePartitioningOptions            interface{}                           `json:"hivePartitioningOptions"`
 }
 
+//as https://cloud.google.com/bigquery/docs/reference/rest/v2/Job?hl=ja#JobConfigurationQuery
+type StubBigQueryResponseJobConfigurationQuery struct {
+	Query        string `json:"query"`
+	UseLegacySql *bool  `json:"useLegacySql,omitempty"`
+}
+
 // as https://cloud.google.com/bigquery/docs/reference/rest/v2/TableReference?hl=ja
 type StubBigQueryResponseDestinationTable struct {
 	ProjectID string `json:"projectId"`
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"mime/multipart"
 	"net/http"
+	"sort"
 	"strings"
 
 	"github.com/gorilla/mux"
@@ -16,14 +17,27 @@ type StubGCS struct {
 }
 
 func NewStubGCS() *StubGCS {
-	s := &StubGCS{}
+	s := &StubGCS{
+		storage: make(map[string]bool),
+	}
 	s.setSvcName("gcs")
 	r := s.getRouter()
 	r.HandleFunc("/b/{bucket_id}", s.serveGetBucket).Methods("GET")
 	r.HandleFunc("/b/{bucket_id}/o", s.serveInsertObject).Methods("POST")
+	r.HandleFunc("/b/{bucket_id}/o/{object:.+}", s.serveDeleteObject).Methods("DELETE")
 	return s
 }
 
+// Objects returns gs:// URIs of the objects uploaded and not deleted.
+func (s *StubGCS) Objects() []string {
+	ret := make([]string, 0, len(s.storage))
+	for uri := range s.storage {
+		ret = append(ret, uri)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
 type StubGCSGetBucketResponse struct {
 	Kind         string `json:"kind"`
 	ID           string `json:"id"`
@@ -66,5 +80,29 @@ func (s *StubGCS) serveInsertObject(w http.ResponseWriter, r *http.Request) {
 	var meta map[string]string
 	json.Unmarshal(bs[0:n], &meta)
 	logger.Debugf("[stub_gcs]:upload palyload :%v", meta)
+	s.storage["gs://"+mux.Vars(r)["bucket_id"]+"/"+meta["name"]] = true
 	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&StubGCSObjectResponse{
+		Kind:   "storage#object",
+		Bucket: mux.Vars(r)["bucket_id"],
+		Name:   meta["name"],
+	})
+}
+
+// see https://cloud.google.com/storage/docs/json_api/v1/objects/delete
+func (s *StubGCS) serveDeleteObject(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	uri := "gs://" + params["bucket_id"] + "/" + params["object"]
+	if !s.storage[uri] {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	delete(s.storage, uri)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type StubGCSObjectResponse struct {
+	Kind   string `json:"kind"`
+	Bucket string `json:"bucket"`
+	Name   string `json:"name"`
 }
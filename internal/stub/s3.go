@@ -1,23 +1,41 @@
 package stub
 
 import (
+	"crypto/md5"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/kayac/bqin/internal/logger"
 )
 
+// StubS3 serves files under basePath as s3 objects.
+// if `<object path>.meta.json` exists, it is used as content type, user metadata and tags of the object.
 type StubS3 struct {
 	stub
 	basePath string
 }
 
+type StubS3ObjectMeta struct {
+	ContentType string            `json:"content_type"`
+	Metadata    map[string]string `json:"metadata"`
+	Tags        map[string]string `json:"tags"`
+}
+
 func NewStubS3(basePath string) *StubS3 {
 	s := &StubS3{basePath: basePath}
 	s.setSvcName("s3")
 	r := s.getRouter()
-	r.PathPrefix("/").HandlerFunc(s.serveObject).Methods("GET")
+	r.PathPrefix("/").HandlerFunc(s.serveObject).Methods("GET", "HEAD")
 	return s
 }
 
@@ -26,14 +44,186 @@ func (s *StubS3) serveObject(w http.ResponseWriter, r *http.Request) {
 	if path[0] == '/' {
 		path = path[1:]
 	}
+	if r.URL.Query().Get("list-type") == "2" {
+		s.serveListObjectsV2(w, r, strings.TrimSuffix(path, "/"))
+		return
+	}
 	testdataPath := s.basePath + path
 	logger.Debugf("%v", testdataPath)
 	body, err := os.Open(testdataPath)
 	if err != nil {
 		logger.Debugf("[stub_s3] %s", err)
 		w.WriteHeader(http.StatusNotFound)
+		if r.Method == http.MethodGet {
+			// HEAD response has no body, so the error code is `NotFound`
+			io.WriteString(w, stubS3NoSuchKeyResponse)
+		}
+		return
+	}
+	defer body.Close()
+	meta, err := s.loadObjectMeta(testdataPath)
+	if err != nil {
+		logger.Debugf("[stub_s3] %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if _, ok := r.URL.Query()["tagging"]; ok {
+		s.serveObjectTagging(w, meta)
+		return
+	}
+	stat, err := body.Stat()
+	if err != nil {
+		logger.Debugf("[stub_s3] %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	hash := md5.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		logger.Debugf("[stub_s3] %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		logger.Debugf("[stub_s3] %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(testdataPath))
+	}
+	if contentType == "" {
+		contentType = "binary/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
+	w.Header().Set("Last-Modified", stat.ModTime().UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, hash.Sum(nil)))
+	for k, v := range meta.Metadata {
+		w.Header().Set("X-Amz-Meta-"+k, v)
+	}
 	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
 	io.Copy(w, body)
 }
+
+// see https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetObjectTagging.html
+func (s *StubS3) serveObjectTagging(w http.ResponseWriter, meta *StubS3ObjectMeta) {
+	type tag struct {
+		Key   string `xml:"Key"`
+		Value string `xml:"Value"`
+	}
+	resp := struct {
+		XMLName xml.Name `xml:"Tagging"`
+		TagSet  []tag    `xml:"TagSet>Tag"`
+	}{}
+	for k, v := range meta.Tags {
+		resp.TagSet = append(resp.TagSet, tag{Key: k, Value: v})
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := xml.NewEncoder(w).Encode(resp); err != nil {
+		logger.Debugf("[stub_s3] can not encode tagging: %s", err)
+	}
+}
+
+// see https://docs.aws.amazon.com/AmazonS3/latest/API/API_ListObjectsV2.html
+// meta files are not listed. continuation token is the last key of the previous page.
+func (s *StubS3) serveListObjectsV2(w http.ResponseWriter, r *http.Request, bucket string) {
+	type content struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int64  `xml:"Size"`
+	}
+	resp := struct {
+		XMLName               xml.Name  `xml:"ListBucketResult"`
+		Name                  string    `xml:"Name"`
+		Prefix                string    `xml:"Prefix"`
+		KeyCount              int       `xml:"KeyCount"`
+		MaxKeys               int       `xml:"MaxKeys"`
+		IsTruncated           bool      `xml:"IsTruncated"`
+		NextContinuationToken string    `xml:"NextContinuationToken,omitempty"`
+		Contents              []content `xml:"Contents"`
+	}{
+		Name:    bucket,
+		Prefix:  r.URL.Query().Get("prefix"),
+		MaxKeys: 1000,
+	}
+	if n, err := strconv.Atoi(r.URL.Query().Get("max-keys")); err == nil && n > 0 {
+		resp.MaxKeys = n
+	}
+	after := r.URL.Query().Get("start-after")
+	if token := r.URL.Query().Get("continuation-token"); token != "" {
+		after = token
+	}
+	root := filepath.Join(s.basePath, bucket)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, ".meta.json") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, resp.Prefix) || key <= after {
+			return nil
+		}
+		if len(resp.Contents) >= resp.MaxKeys {
+			resp.IsTruncated = true
+			return nil
+		}
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		resp.Contents = append(resp.Contents, content{
+			Key:          key,
+			LastModified: info.ModTime().UTC().Format(time.RFC3339),
+			ETag:         fmt.Sprintf(`"%x"`, md5.Sum(bs)),
+			Size:         info.Size(),
+		})
+		return nil
+	})
+	if err != nil {
+		logger.Debugf("[stub_s3] %s", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	resp.KeyCount = len(resp.Contents)
+	if resp.IsTruncated {
+		resp.NextContinuationToken = resp.Contents[len(resp.Contents)-1].Key
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := xml.NewEncoder(w).Encode(resp); err != nil {
+		logger.Debugf("[stub_s3] can not encode list objects: %s", err)
+	}
+}
+
+func (s *StubS3) loadObjectMeta(testdataPath string) (*StubS3ObjectMeta, error) {
+	meta := &StubS3ObjectMeta{}
+	bs, err := ioutil.ReadFile(testdataPath + ".meta.json")
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bs, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// see https://docs.aws.amazon.com/AmazonS3/latest/API/ErrorResponses.html
+const stubS3NoSuchKeyResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<Error>
+  <Code>NoSuchKey</Code>
+  <Message>The specified key does not exist.</Message>
+</Error>
+`
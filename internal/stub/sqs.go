@@ -11,6 +11,9 @@ import (
 	"math/big"
 	"net/http"
 	"net/url"
+	"path"
+	"strconv"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sqs"
@@ -20,13 +23,36 @@ import (
 
 type StubSQS struct {
 	stub
-	msgs                     []*sqs.Message
+	msgs []*sqs.Message
+	// queue names of messages received only from the queue, by message id.
+	msgQueues                map[string]string
+	sent                     []*StubSQSSentMessage
+	receiveCounts            map[string]int
 	NumberOfMessagesReceived int
 	NumberOfMessagesDeleted  int
+	// VisibilityTimeouts are the visibility timeouts changed by ChangeMessageVisibility, by message id.
+	VisibilityTimeouts map[string]int
+
+	// MaxReceiveCount is maxReceiveCount of the redrive policy. 0 means no redrive policy.
+	MaxReceiveCount int
+	// FailGetQueueAttributes makes GetQueueAttributes fail with AccessDenied.
+	FailGetQueueAttributes     bool
+	NumberOfGetQueueAttributes int
+}
+
+// StubSQSSentMessage is a message sent by SendMessage, it is not received by ReceiveMessage.
+type StubSQSSentMessage struct {
+	QueueName  string
+	Body       string
+	Attributes map[string]string
 }
 
 func NewStubSQS() *StubSQS {
-	s := &StubSQS{}
+	s := &StubSQS{
+		receiveCounts:      make(map[string]int),
+		msgQueues:          make(map[string]string),
+		VisibilityTimeouts: make(map[string]int),
+	}
 	s.setSvcName("sqs")
 	r := s.getRouter()
 	r.PathPrefix("/").HandlerFunc(s.serveHTTP).Methods("POST")
@@ -75,6 +101,18 @@ func (s *StubSQS) SetRecivedMessages(msgs []*sqs.Message) {
 	s.msgs = append(s.msgs, msgs...)
 }
 
+// SetQueueMessages adds the messages received only from the queue, for serving multiple queues.
+func (s *StubSQS) SetQueueMessages(queueName string, msgs []*sqs.Message) {
+	for _, msg := range msgs {
+		s.msgQueues[getString(msg.MessageId)] = queueName
+	}
+	s.msgs = append(s.msgs, msgs...)
+}
+
+func (s *StubSQS) SentMessages() []*StubSQSSentMessage {
+	return s.sent
+}
+
 func (s *StubSQS) ClearMetrix() {
 	s.NumberOfMessagesDeleted = 0
 	s.NumberOfMessagesReceived = 0
@@ -98,6 +136,12 @@ func (s *StubSQS) serveHTTP(w http.ResponseWriter, r *http.Request) {
 		s.serveReceiveMessage(w, r, params)
 	case "DeleteMessage":
 		s.serveDeleteMessage(w, r, params)
+	case "SendMessage":
+		s.serveSendMessage(w, r, params)
+	case "GetQueueAttributes":
+		s.serveGetQueueAttributes(w, r, params)
+	case "ChangeMessageVisibility":
+		s.serveChangeMessageVisibility(w, r, params)
 	default:
 		w.WriteHeader(http.StatusBadRequest)
 	}
@@ -117,19 +161,35 @@ func (s *StubSQS) serveGetQueueUrl(w http.ResponseWriter, r *http.Request, param
 func (s *StubSQS) serveReceiveMessage(w http.ResponseWriter, r *http.Request, params url.Values) {
 	w.WriteHeader(http.StatusOK)
 	payload := ""
-	if len(s.msgs) > 0 {
-		msg := s.msgs[0]
+	queueName := path.Base(params.Get("QueueUrl"))
+	var msg *sqs.Message
+	for _, m := range s.msgs {
+		if q, ok := s.msgQueues[getString(m.MessageId)]; !ok || q == queueName {
+			msg = m
+			break
+		}
+	}
+	if msg != nil {
+		s.receiveCounts[getString(msg.MessageId)]++
+		type attribute struct {
+			Name  string `xml:"Name"`
+			Value string `xml:"Value"`
+		}
 		msgStrct := struct {
-			XMLName       xml.Name `xml:"Message"`
-			MessageId     string   `xml:"MessageId"`
-			ReceiptHandle string   `xml:"ReceiptHandle"`
-			Body          string   `xml:"Body"`
-			MD5OfBody     string   `xml:"MD5OfBody"`
+			XMLName       xml.Name    `xml:"Message"`
+			MessageId     string      `xml:"MessageId"`
+			ReceiptHandle string      `xml:"ReceiptHandle"`
+			Body          string      `xml:"Body"`
+			MD5OfBody     string      `xml:"MD5OfBody"`
+			Attributes    []attribute `xml:"Attribute"`
 		}{
 			MessageId:     getString(msg.MessageId),
 			ReceiptHandle: getString(msg.ReceiptHandle),
 			Body:          getString(msg.Body),
 			MD5OfBody:     getString(msg.MD5OfBody),
+			Attributes: []attribute{
+				{Name: "ApproximateReceiveCount", Value: strconv.Itoa(s.receiveCounts[getString(msg.MessageId)])},
+			},
 		}
 
 		payloadBs, err := xml.Marshal(msgStrct)
@@ -158,6 +218,64 @@ func (s *StubSQS) serveDeleteMessage(w http.ResponseWriter, r *http.Request, par
 	io.WriteString(w, "ReceiptHandleIsInvalid")
 }
 
+func (s *StubSQS) serveChangeMessageVisibility(w http.ResponseWriter, r *http.Request, params url.Values) {
+	handle := params.Get("ReceiptHandle")
+	timeout, err := strconv.Atoi(params.Get("VisibilityTimeout"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "InvalidParameterValue")
+		return
+	}
+	for _, msg := range s.msgs {
+		if handle == getString(msg.ReceiptHandle) {
+			s.VisibilityTimeouts[getString(msg.MessageId)] = timeout
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, stubSQSChangeMessageVisibilityResponseTmpl)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	io.WriteString(w, "ReceiptHandleIsInvalid")
+}
+
+func (s *StubSQS) serveSendMessage(w http.ResponseWriter, r *http.Request, params url.Values) {
+	body := params.Get("MessageBody")
+	msg := &StubSQSSentMessage{
+		QueueName:  path.Base(params.Get("QueueUrl")),
+		Body:       body,
+		Attributes: make(map[string]string),
+	}
+	for key := range params {
+		if !strings.HasPrefix(key, "MessageAttribute.") || !strings.HasSuffix(key, ".Name") {
+			continue
+		}
+		prefix := strings.TrimSuffix(key, ".Name")
+		msg.Attributes[params.Get(key)] = params.Get(prefix + ".Value.StringValue")
+	}
+	s.sent = append(s.sent, msg)
+	msgId, _ := uuid.NewRandom()
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, fmt.Sprintf(stubSQSSendMessageResponseTmpl, fmt.Sprintf("%x", md5.Sum([]byte(body))), msgId.String()))
+}
+
+func (s *StubSQS) serveGetQueueAttributes(w http.ResponseWriter, r *http.Request, params url.Values) {
+	s.NumberOfGetQueueAttributes++
+	if s.FailGetQueueAttributes {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, stubSQSAccessDeniedResponse)
+		return
+	}
+	attributes := ""
+	if s.MaxReceiveCount > 0 {
+		policy := fmt.Sprintf(`{"deadLetterTargetArn":"arn:aws:sqs:local:000000000000:dlq","maxReceiveCount":%d}`, s.MaxReceiveCount)
+		var b strings.Builder
+		xml.EscapeText(&b, []byte(policy))
+		attributes = fmt.Sprintf("<Attribute><Name>RedrivePolicy</Name><Value>%s</Value></Attribute>", b.String())
+	}
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, fmt.Sprintf(stubSQSGetQueueAttributesResponseTmpl, attributes))
+}
+
 const (
 	// see https://docs.aws.amazon.com/AWSSimpleQueueService/latest/APIReference/API_GetQueueUrl.html
 	stubSQSGetQueueUrlResponseTmpl = `
@@ -178,6 +296,48 @@ const (
     <RequestId>b6633655-283d-45b4-aee4-4e84e0ae6afa</RequestId>
   </ResponseMetadata>
 </ReceiveMessageResponse>
+`
+
+	// see https://docs.aws.amazon.com/AWSSimpleQueueService/latest/APIReference/API_GetQueueAttributes.html
+	stubSQSGetQueueAttributesResponseTmpl = `
+<GetQueueAttributesResponse>
+  <GetQueueAttributesResult>%s</GetQueueAttributesResult>
+  <ResponseMetadata>
+    <RequestId>1ea71be5-b5a2-4f9d-b85a-945d8d08cd0b</RequestId>
+  </ResponseMetadata>
+</GetQueueAttributesResponse>
+`
+	stubSQSAccessDeniedResponse = `
+<ErrorResponse>
+  <Error>
+    <Type>Sender</Type>
+    <Code>AccessDenied</Code>
+    <Message>Access to the resource is denied.</Message>
+  </Error>
+  <RequestId>42d59b56-7407-4c4a-be0f-4c88daeea257</RequestId>
+</ErrorResponse>
+`
+
+	// see https://docs.aws.amazon.com/AWSSimpleQueueService/latest/APIReference/API_SendMessage.html
+	stubSQSSendMessageResponseTmpl = `
+<SendMessageResponse>
+    <SendMessageResult>
+        <MD5OfMessageBody>%s</MD5OfMessageBody>
+        <MessageId>%s</MessageId>
+    </SendMessageResult>
+    <ResponseMetadata>
+        <RequestId>27daac76-34dd-47df-bd01-1f6e873584a0</RequestId>
+    </ResponseMetadata>
+</SendMessageResponse>
+`
+
+	// see https://docs.aws.amazon.com/AWSSimpleQueueService/latest/APIReference/API_ChangeMessageVisibility.html
+	stubSQSChangeMessageVisibilityResponseTmpl = `
+<ChangeMessageVisibilityResponse>
+    <ResponseMetadata>
+        <RequestId>6a7a282a-d013-4a59-aba9-335b0fa48bed</RequestId>
+    </ResponseMetadata>
+</ChangeMessageVisibilityResponse>
 `
 
 	// see https://docs.aws.amazon.com/AWSSimpleQueueService/latest/APIReference/API_DeleteMessage.html
@@ -16,6 +16,11 @@ type stub struct {
 	logs    []*AccessLog
 	mu      sync.Mutex
 	svcName string
+	// requests are served one by one, for workers of queues requesting concurrently.
+	serveMu sync.Mutex
+
+	// OnRequest is called before serving each request, such as for shutdown while processing.
+	OnRequest func(r *http.Request)
 }
 
 func (s *stub) GetLogs() []string {
@@ -58,6 +63,11 @@ func (s *stub) getRouter() *mux.Router {
 }
 
 func (s *stub) handle(w http.ResponseWriter, r *http.Request) {
+	s.serveMu.Lock()
+	defer s.serveMu.Unlock()
+	if s.OnRequest != nil {
+		s.OnRequest(r)
+	}
 	ww, rr, l := s.wrap(w, r)
 	s.getRouter().ServeHTTP(ww, rr)
 	logger.Debugf("%s", l)
@@ -0,0 +1,209 @@
+package bqin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+)
+
+type ErrorClass string
+
+const (
+	// ErrorRetryable is a transient error, such as 5xx or throttling. retried in process with backoff.
+	ErrorRetryable ErrorClass = "retryable"
+	// ErrorPermanent never succeeds by retry, such as invalid schema or NoSuchKey. routed to the failure queue.
+	ErrorPermanent ErrorClass = "permanent"
+	// ErrorUnknown is not classified. the message is retried by SQS until maxReceiveCount.
+	ErrorUnknown ErrorClass = "unknown"
+)
+
+// JobError is the classified error of the stage.
+type JobError struct {
+	Stage  string
+	Class  ErrorClass
+	Reason string
+	Err    error
+}
+
+func (e *JobError) Error() string {
+	return fmt.Sprintf("%s failed (%s: %s): %s", e.Stage, e.Class, e.Reason, e.Err)
+}
+
+func (e *JobError) Cause() error {
+	return e.Err
+}
+
+func (e *JobError) Unwrap() error {
+	return e.Err
+}
+
+// newJobError classifies the error by the cause. if err is already JobError, returns it as is.
+func newJobError(stage string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if jobErr, ok := asJobError(err); ok {
+		return jobErr
+	}
+	class, reason := classifyError(errors.Cause(err))
+	return &JobError{
+		Stage:  stage,
+		Class:  class,
+		Reason: reason,
+		Err:    err,
+	}
+}
+
+func newPermanentError(stage, reason string, err error) error {
+	return &JobError{
+		Stage:  stage,
+		Class:  ErrorPermanent,
+		Reason: reason,
+		Err:    err,
+	}
+}
+
+// asJobError finds JobError in the chain of errors wrapped by github.com/pkg/errors.
+func asJobError(err error) (*JobError, bool) {
+	for err != nil {
+		if jobErr, ok := err.(*JobError); ok {
+			return jobErr, true
+		}
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = cause.Cause()
+	}
+	return nil, false
+}
+
+func ErrorClassOf(err error) ErrorClass {
+	if jobErr, ok := asJobError(err); ok {
+		return jobErr.Class
+	}
+	return ErrorUnknown
+}
+
+func IsRetryable(err error) bool {
+	return ErrorClassOf(err) == ErrorRetryable
+}
+
+func IsPermanent(err error) bool {
+	return ErrorClassOf(err) == ErrorPermanent
+}
+
+var (
+	permanentAWSErrorCodes = map[string]bool{
+		"NoSuchKey":          true,
+		"NoSuchBucket":       true,
+		"InvalidObjectState": true,
+		"NotFound":           true,
+	}
+	retryableAWSErrorCodes = map[string]bool{
+		// granted permissions take a while to propagate.
+		"AccessDenied":              true,
+		"SlowDown":                  true,
+		"RequestTimeout":            true,
+		"RequestTimeoutException":   true,
+		"ServiceUnavailable":        true,
+		"InternalError":             true,
+		"Throttling":                true,
+		"ThrottlingException":       true,
+		request.ErrCodeRequestError: true,
+		request.ErrCodeRead:         true,
+	}
+	// see https://cloud.google.com/bigquery/docs/error-messages
+	permanentGoogleErrorReasons = map[string]bool{
+		"invalid":           true,
+		"invalidQuery":      true,
+		"notFound":          true,
+		"duplicate":         true,
+		"billingNotEnabled": true,
+		"responseTooLarge":  true,
+	}
+	retryableGoogleErrorReasons = map[string]bool{
+		"accessDenied":      true,
+		"backendError":      true,
+		"internalError":     true,
+		"rateLimitExceeded": true,
+		"timeout":           true,
+	}
+)
+
+func classifyError(err error) (ErrorClass, string) {
+	switch e := err.(type) {
+	case awserr.RequestFailure:
+		if class, ok := classifyAWSErrorCode(e.Code()); ok {
+			return class, e.Code()
+		}
+		return classifyHTTPStatus(e.StatusCode()), e.Code()
+	case awserr.Error:
+		if class, ok := classifyAWSErrorCode(e.Code()); ok {
+			return class, e.Code()
+		}
+		return ErrorUnknown, e.Code()
+	case *googleapi.Error:
+		for _, item := range e.Errors {
+			if class, ok := classifyGoogleErrorReason(item.Reason); ok {
+				return class, item.Reason
+			}
+		}
+		return classifyHTTPStatus(e.Code), http.StatusText(e.Code)
+	case *bigquery.Error:
+		if class, ok := classifyGoogleErrorReason(e.Reason); ok {
+			return class, e.Reason
+		}
+		return ErrorUnknown, e.Reason
+	case net.Error:
+		if e.Timeout() {
+			return ErrorRetryable, "timeout"
+		}
+		return ErrorRetryable, "network error"
+	}
+	switch err {
+	case storage.ErrObjectNotExist, storage.ErrBucketNotExist:
+		return ErrorPermanent, "notFound"
+	case context.DeadlineExceeded:
+		return ErrorRetryable, "timeout"
+	}
+	return ErrorUnknown, ""
+}
+
+func classifyAWSErrorCode(code string) (ErrorClass, bool) {
+	if permanentAWSErrorCodes[code] {
+		return ErrorPermanent, true
+	}
+	if retryableAWSErrorCodes[code] {
+		return ErrorRetryable, true
+	}
+	return "", false
+}
+
+func classifyGoogleErrorReason(reason string) (ErrorClass, bool) {
+	if permanentGoogleErrorReasons[reason] {
+		return ErrorPermanent, true
+	}
+	if retryableGoogleErrorReasons[reason] {
+		return ErrorRetryable, true
+	}
+	return "", false
+}
+
+func classifyHTTPStatus(code int) ErrorClass {
+	switch {
+	case code == http.StatusTooManyRequests || code == http.StatusForbidden || code >= 500:
+		return ErrorRetryable
+	case code >= 400:
+		return ErrorPermanent
+	}
+	return ErrorUnknown
+}
@@ -0,0 +1,216 @@
+package bqin_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/kayac/bqin"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+)
+
+func TestJobErrorClassification(t *testing.T) {
+	cases := []struct {
+		name   string
+		err    error
+		class  bqin.ErrorClass
+		reason string
+	}{
+		{
+			name:   "aws_permanent_code",
+			err:    awserr.NewRequestFailure(awserr.New("NoSuchKey", "not found", nil), 404, "req"),
+			class:  bqin.ErrorPermanent,
+			reason: "NoSuchKey",
+		},
+		{
+			name:   "aws_access_denied",
+			err:    awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, "req"),
+			class:  bqin.ErrorRetryable,
+			reason: "AccessDenied",
+		},
+		{
+			name:   "aws_retryable_code",
+			err:    awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), 503, "req"),
+			class:  bqin.ErrorRetryable,
+			reason: "SlowDown",
+		},
+		{
+			name:   "aws_unknown_code_5xx",
+			err:    awserr.NewRequestFailure(awserr.New("Something", "", nil), 500, "req"),
+			class:  bqin.ErrorRetryable,
+			reason: "Something",
+		},
+		{
+			name:   "aws_unknown_code_4xx",
+			err:    awserr.NewRequestFailure(awserr.New("Something", "", nil), 400, "req"),
+			class:  bqin.ErrorPermanent,
+			reason: "Something",
+		},
+		{
+			name:   "aws_unknown_code_403",
+			err:    awserr.NewRequestFailure(awserr.New("Something", "", nil), 403, "req"),
+			class:  bqin.ErrorRetryable,
+			reason: "Something",
+		},
+		{
+			name:   "aws_unknown_code_3xx",
+			err:    awserr.NewRequestFailure(awserr.New("Something", "", nil), 304, "req"),
+			class:  bqin.ErrorUnknown,
+			reason: "Something",
+		},
+		{
+			name:   "aws_request_error",
+			err:    awserr.New("RequestError", "send request failed", nil),
+			class:  bqin.ErrorRetryable,
+			reason: "RequestError",
+		},
+		{
+			name:   "aws_unknown_error",
+			err:    awserr.New("SerializationError", "", nil),
+			class:  bqin.ErrorUnknown,
+			reason: "SerializationError",
+		},
+		{
+			name:   "google_permanent_reason",
+			err:    &googleapi.Error{Code: 400, Errors: []googleapi.ErrorItem{{Reason: "invalid"}}},
+			class:  bqin.ErrorPermanent,
+			reason: "invalid",
+		},
+		{
+			name:   "google_access_denied",
+			err:    &googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "accessDenied"}}},
+			class:  bqin.ErrorRetryable,
+			reason: "accessDenied",
+		},
+		{
+			name:   "google_rate_limit",
+			err:    &googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}},
+			class:  bqin.ErrorRetryable,
+			reason: "rateLimitExceeded",
+		},
+		{
+			name:   "google_first_known_reason",
+			err:    &googleapi.Error{Code: 400, Errors: []googleapi.ErrorItem{{Reason: "other"}, {Reason: "invalidQuery"}}},
+			class:  bqin.ErrorPermanent,
+			reason: "invalidQuery",
+		},
+		{
+			name:   "google_status_429",
+			err:    &googleapi.Error{Code: 429},
+			class:  bqin.ErrorRetryable,
+			reason: "Too Many Requests",
+		},
+		{
+			name:   "google_status_404",
+			err:    &googleapi.Error{Code: 404},
+			class:  bqin.ErrorPermanent,
+			reason: "Not Found",
+		},
+		{
+			name:   "google_status_403",
+			err:    &googleapi.Error{Code: 403},
+			class:  bqin.ErrorRetryable,
+			reason: "Forbidden",
+		},
+		{
+			name:   "google_status_502",
+			err:    &googleapi.Error{Code: 502},
+			class:  bqin.ErrorRetryable,
+			reason: "Bad Gateway",
+		},
+		{
+			name:   "bigquery_permanent_reason",
+			err:    &bigquery.Error{Reason: "invalidQuery"},
+			class:  bqin.ErrorPermanent,
+			reason: "invalidQuery",
+		},
+		{
+			name:   "bigquery_retryable_reason",
+			err:    &bigquery.Error{Reason: "backendError"},
+			class:  bqin.ErrorRetryable,
+			reason: "backendError",
+		},
+		{
+			name:   "bigquery_unknown_reason",
+			err:    &bigquery.Error{Reason: "stopped"},
+			class:  bqin.ErrorUnknown,
+			reason: "stopped",
+		},
+		{
+			name:   "network_error",
+			err:    &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+			class:  bqin.ErrorRetryable,
+			reason: "network error",
+		},
+		{
+			name:   "network_timeout",
+			err:    &net.DNSError{Err: "i/o timeout", IsTimeout: true},
+			class:  bqin.ErrorRetryable,
+			reason: "timeout",
+		},
+		{
+			name:   "storage_not_exist",
+			err:    storage.ErrObjectNotExist,
+			class:  bqin.ErrorPermanent,
+			reason: "notFound",
+		},
+		{
+			name:   "context_deadline",
+			err:    context.DeadlineExceeded,
+			class:  bqin.ErrorRetryable,
+			reason: "timeout",
+		},
+		{
+			name:  "context_canceled",
+			err:   context.Canceled,
+			class: bqin.ErrorUnknown,
+		},
+		{
+			name:   "wrapped",
+			err:    errors.Wrap(errors.Wrap(awserr.New("NoSuchBucket", "", nil), "get object"), "transport"),
+			class:  bqin.ErrorPermanent,
+			reason: "NoSuchBucket",
+		},
+		{
+			name:  "unclassified",
+			err:   errors.New("something wrong"),
+			class: bqin.ErrorUnknown,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := bqin.NewJobError("test", c.err)
+			jobErr, ok := err.(*bqin.JobError)
+			if !ok {
+				t.Fatalf("unexpected error type: %T", err)
+			}
+			if jobErr.Class != c.class || jobErr.Reason != c.reason {
+				t.Errorf("unexpected classification: %s %q, expected %s %q", jobErr.Class, jobErr.Reason, c.class, c.reason)
+			}
+			if bqin.ErrorClassOf(errors.Wrap(err, "wrapped")) != c.class {
+				t.Errorf("class must be found through wrapped errors")
+			}
+		})
+	}
+}
+
+func TestJobErrorIdempotent(t *testing.T) {
+	if bqin.NewJobError("test", nil) != nil {
+		t.Error("nil must be kept")
+	}
+	inner := bqin.NewJobError("transport", awserr.New("NoSuchKey", "", nil))
+	err := bqin.NewJobError("load", errors.Wrap(inner, "wrapped"))
+	if err != inner {
+		t.Errorf("classified error must be returned as is: %s", err)
+	}
+	if !bqin.IsPermanent(err) || bqin.IsRetryable(err) {
+		t.Errorf("unexpected class: %s", bqin.ErrorClassOf(err))
+	}
+	if bqin.ErrorClassOf(errors.New("not classified")) != bqin.ErrorUnknown {
+		t.Error("unclassified error must be unknown")
+	}
+}
@@ -0,0 +1,166 @@
+package bqin
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/kayac/bqin/internal/logger"
+	"github.com/pkg/errors"
+)
+
+type keyMatcher func(ctx context.Context, key string) (bool, []string)
+
+// S3KeyPattern is conditions for the object key. all defined conditions must be satisfied,
+// except that key_regexp is ignored when key_prefix is defined, same as the former versions.
+type S3KeyPattern struct {
+	KeyPrefix string `yaml:"key_prefix,omitempty" json:"key_prefix,omitempty"`
+	KeySuffix string `yaml:"key_suffix,omitempty" json:"key_suffix,omitempty"`
+	KeyGlob   string `yaml:"key_glob,omitempty" json:"key_glob,omitempty"`
+	KeyRegexp string `yaml:"key_regexp,omitempty" json:"key_regexp,omitempty"`
+}
+
+func (p *S3KeyPattern) String() string {
+	key := p.KeyPrefix
+	if key == "" {
+		key = p.KeyRegexp
+	}
+	if key == "" {
+		key = p.KeyGlob
+	}
+	if p.KeySuffix != "" {
+		key += "*" + p.KeySuffix
+	}
+	return key
+}
+
+func (p *S3KeyPattern) isEmpty() bool {
+	return p.KeyPrefix == "" && p.KeySuffix == "" && p.KeyGlob == "" && p.KeyRegexp == ""
+}
+
+// buildKeyMatcher returns the matcher and the capture names.
+// captures are taken from key_regexp, or wildcards of key_glob, otherwise only whole key.
+// key_prefix takes precedence over key_regexp, the both legacy fields are not combined.
+func (p *S3KeyPattern) buildKeyMatcher() (keyMatcher, []string, error) {
+	if p.isEmpty() {
+		return nil, nil, errors.New("key_prefix, key_suffix, key_glob or key_regexp is not defined")
+	}
+	matchers := make([]keyMatcher, 0, 4)
+	var captureNames []string
+	if p.KeyPrefix != "" {
+		matchers = append(matchers, newPrefixMatcher(p.KeyPrefix))
+	}
+	if p.KeySuffix != "" {
+		matchers = append(matchers, newSuffixMatcher(p.KeySuffix))
+	}
+	if p.KeyGlob != "" {
+		expr, err := globToRegexp(p.KeyGlob)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "key_glob is invalid")
+		}
+		reg, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "key_glob is invalid")
+		}
+		matchers = append(matchers, newRegexpMatcher(reg))
+	}
+	if p.KeyRegexp != "" && p.KeyPrefix == "" {
+		reg, err := regexp.Compile(p.KeyRegexp)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "key_regexp is invalid")
+		}
+		captureNames = reg.SubexpNames()
+		matchers = append(matchers, newRegexpMatcher(reg))
+	}
+	return func(ctx context.Context, key string) (bool, []string) {
+		capture := []string{key}
+		for _, m := range matchers {
+			ok, c := m(ctx, key)
+			if !ok {
+				return false, nil
+			}
+			if c != nil {
+				capture = c
+			}
+		}
+		return true, capture
+	}, captureNames, nil
+}
+
+func newPrefixMatcher(prefix string) keyMatcher {
+	return func(ctx context.Context, key string) (bool, []string) {
+		if strings.HasPrefix(strings.Trim(key, "/"), prefix) {
+			return true, nil
+		}
+		logger.FromContext(ctx).Debugf("object key start %s.key is %s`", prefix, key)
+		return false, nil
+	}
+}
+
+func newSuffixMatcher(suffix string) keyMatcher {
+	return func(ctx context.Context, key string) (bool, []string) {
+		if strings.HasSuffix(key, suffix) {
+			return true, nil
+		}
+		logger.FromContext(ctx).Debugf("object key end %s.key is %s`", suffix, key)
+		return false, nil
+	}
+}
+
+func newRegexpMatcher(reg *regexp.Regexp) keyMatcher {
+	return func(ctx context.Context, key string) (bool, []string) {
+		capture := reg.FindStringSubmatch(key)
+		if len(capture) == 0 {
+			logger.FromContext(ctx).Debugf("object key not match regexp(%s). key is %s`", reg, key)
+			return false, nil
+		}
+		return true, capture
+	}
+}
+
+// globToRegexp converts the glob pattern to the regexp, each wildcard is captured.
+// `**` matches any characters including `/`, `*` and `?` do not match `/`.
+// example: logs/**/*.gz => ^logs/(?:(.*)/)?([^/]*)\.gz$
+func globToRegexp(glob string) (string, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					i++
+					b.WriteString("(?:(.*)/)?")
+				} else {
+					b.WriteString("(.*)")
+				}
+				continue
+			}
+			b.WriteString("([^/]*)")
+		case '?':
+			b.WriteString("([^/])")
+		case '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				return "", errors.New("unclosed character class")
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String(), nil
+}
@@ -0,0 +1,148 @@
+package bqin_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/kayac/bqin"
+	"github.com/kayac/bqin/internal/logger"
+)
+
+func TestKeyMatcher(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+
+	cases := []struct {
+		Comment  string
+		Source   *bqin.S3Soruce
+		URL      string
+		IsMatch  bool
+		Captures []string
+	}{
+		{
+			Comment:  "glob with double star",
+			Source:   &bqin.S3Soruce{KeyGlob: "logs/**/*.json.gz"},
+			URL:      "s3://bqin.bucket.test/logs/2020/02/10/access.json.gz",
+			IsMatch:  true,
+			Captures: []string{"logs/2020/02/10/access.json.gz", "2020/02/10", "access"},
+		},
+		{
+			Comment:  "glob with double star matches zero directory",
+			Source:   &bqin.S3Soruce{KeyGlob: "logs/**/*.json.gz"},
+			URL:      "s3://bqin.bucket.test/logs/access.json.gz",
+			IsMatch:  true,
+			Captures: []string{"logs/access.json.gz", "", "access"},
+		},
+		{
+			Comment: "single star does not match slash",
+			Source:  &bqin.S3Soruce{KeyGlob: "logs/*.json.gz"},
+			URL:     "s3://bqin.bucket.test/logs/2020/access.json.gz",
+			IsMatch: false,
+		},
+		{
+			Comment:  "character class",
+			Source:   &bqin.S3Soruce{KeyGlob: "data/part-[0-9][0-9].csv"},
+			URL:      "s3://bqin.bucket.test/data/part-01.csv",
+			IsMatch:  true,
+			Captures: []string{"data/part-01.csv"},
+		},
+		{
+			Comment:  "prefix and suffix",
+			Source:   &bqin.S3Soruce{KeyPrefix: "logs/", KeySuffix: ".gz"},
+			URL:      "s3://bqin.bucket.test/logs/2020/access.gz",
+			IsMatch:  true,
+			Captures: []string{"logs/2020/access.gz"},
+		},
+		{
+			Comment: "suffix missmatch",
+			Source:  &bqin.S3Soruce{KeyPrefix: "logs/", KeySuffix: ".gz"},
+			URL:     "s3://bqin.bucket.test/logs/2020/access.json",
+			IsMatch: false,
+		},
+		{
+			Comment: "excluded by prefix",
+			Source: &bqin.S3Soruce{
+				KeyPrefix: "logs/",
+				KeySuffix: ".gz",
+				Exclude:   []*bqin.S3KeyPattern{{KeyPrefix: "logs/tmp/"}},
+			},
+			URL:     "s3://bqin.bucket.test/logs/tmp/access.gz",
+			IsMatch: false,
+		},
+		{
+			Comment: "excluded by glob and regexp",
+			Source: &bqin.S3Soruce{
+				KeyPrefix: "logs/",
+				Exclude: []*bqin.S3KeyPattern{
+					{KeyGlob: "**/_SUCCESS"},
+					{KeyRegexp: `\.tmp$`},
+				},
+			},
+			URL:     "s3://bqin.bucket.test/logs/2020/access.gz.tmp",
+			IsMatch: false,
+		},
+		{
+			Comment: "not excluded",
+			Source: &bqin.S3Soruce{
+				KeyPrefix: "logs/",
+				Exclude: []*bqin.S3KeyPattern{
+					{KeyGlob: "**/_SUCCESS"},
+					{KeyRegexp: `\.tmp$`},
+				},
+			},
+			URL:      "s3://bqin.bucket.test/logs/2020/access.gz",
+			IsMatch:  true,
+			Captures: []string{"logs/2020/access.gz"},
+		},
+		{
+			Comment:  "captures from regexp with suffix",
+			Source:   &bqin.S3Soruce{KeyRegexp: `data/([a-z]+)/`, KeySuffix: ".csv"},
+			URL:      "s3://bqin.bucket.test/data/user/part-0001.csv",
+			IsMatch:  true,
+			Captures: []string{"data/user/", "user"},
+		},
+		{
+			Comment:  "prefix takes precedence over regexp",
+			Source:   &bqin.S3Soruce{KeyPrefix: "data/", KeyRegexp: `^logs/([a-z]+)/`},
+			URL:      "s3://bqin.bucket.test/data/user/part-0001.csv",
+			IsMatch:  true,
+			Captures: []string{"data/user/part-0001.csv"},
+		},
+		{
+			Comment: "regexp is ignored with prefix",
+			Source:  &bqin.S3Soruce{KeyPrefix: "data/", KeyRegexp: `^data/([a-z]+)/`},
+			URL:     "s3://bqin.bucket.test/logs/user/part-0001.csv",
+			IsMatch: false,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("case-%02d", i), func(t *testing.T) {
+			t.Log(c.Comment)
+			c.Source.Bucket = "bqin.bucket.test"
+			rule := &bqin.Rule{
+				S3: c.Source,
+				BigQuery: &bqin.LoadingDestination{
+					ProjectID: "bqin-test-gcp",
+					Dataset:   "test",
+					Table:     "test",
+				},
+				Option: &bqin.JobOption{
+					TemporaryBucket: "bqin-import-tmp",
+					SourceFormat:    bqin.CSV,
+				},
+			}
+			if err := rule.Validate(); err != nil {
+				t.Fatalf("unexpected validate error: %s", err)
+			}
+			ok, captures := rule.Match(MustParseURL(c.URL))
+			if ok != c.IsMatch {
+				t.Errorf("unexpected match state: %v", ok)
+			}
+			if !reflect.DeepEqual(captures, c.Captures) {
+				t.Logf("actual:   %#v", captures)
+				t.Logf("expected: %#v", c.Captures)
+				t.Error("unexpected captures")
+			}
+		})
+	}
+}
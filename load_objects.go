@@ -0,0 +1,136 @@
+package bqin
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/kayac/bqin/internal/logger"
+	"github.com/pkg/errors"
+)
+
+var writeDispositions = map[string]bigquery.TableWriteDisposition{
+	"append":   bigquery.WriteAppend,
+	"truncate": bigquery.WriteTruncate,
+	"empty":    bigquery.WriteEmpty,
+}
+
+// ParseWriteDisposition parses append, truncate or empty (or WRITE_APPEND, WRITE_TRUNCATE, WRITE_EMPTY).
+func ParseWriteDisposition(s string) (bigquery.TableWriteDisposition, error) {
+	if d, ok := writeDispositions[strings.ToLower(strings.TrimPrefix(strings.ToUpper(s), "WRITE_"))]; ok {
+		return d, nil
+	}
+	return "", errors.Errorf("write disposition `%s` is not supported", s)
+}
+
+// LoadOverride overrides the jobs resolved by the rules.
+type LoadOverride struct {
+	// `project.dataset.table`, `dataset.table` or `table`. omitted parts are kept as resolved.
+	Table            string
+	WriteDisposition bigquery.TableWriteDisposition
+}
+
+func (o *LoadOverride) Validate() error {
+	if o == nil || o.Table == "" {
+		return nil
+	}
+	parts := strings.Split(o.Table, ".")
+	if len(parts) > 3 {
+		return errors.Errorf("table `%s` is invalid", o.Table)
+	}
+	for _, p := range parts {
+		if p == "" {
+			return errors.Errorf("table `%s` is invalid", o.Table)
+		}
+	}
+	return nil
+}
+
+func (o *LoadOverride) apply(job *LoadingJob) {
+	if o == nil {
+		return
+	}
+	if o.Table != "" {
+		dest := *job.LoadingDestination
+		parts := strings.Split(o.Table, ".")
+		fields := []*string{&dest.ProjectID, &dest.Dataset, &dest.Table}
+		for i, p := range parts {
+			*fields[len(fields)-len(parts)+i] = p
+		}
+		job.LoadingDestination = &dest
+	}
+	if o.WriteDisposition != "" {
+		job.WriteDisposition = o.WriteDisposition
+	}
+}
+
+// LoadObjects runs the jobs of the objects without SQS messages, objects are processed one by one.
+// failed objects do not stop the others, and returned error reports the number of them.
+func (app *App) LoadObjects(ctx context.Context, locs []*url.URL, override *LoadOverride) error {
+	if err := override.Validate(); err != nil {
+		return err
+	}
+	var failed int
+	for _, loc := range locs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := app.loadObject(ctx, loc, override); err != nil {
+			logger.FromContext(ctx).Errorf("[load] %s failed: %s", loc, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("%d of %d objects failed", failed, len(locs))
+	}
+	return nil
+}
+
+func (app *App) loadObject(ctx context.Context, loc *url.URL, override *LoadOverride) (err error) {
+	ctx, span := startSpan(ctx, "bqin.load_object", attrS3URI.String(loc.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
+	if loc.Scheme != "s3" {
+		return errors.New("not s3 uri")
+	}
+	ctx = withObjectCache(ctx)
+	jobs, unmatched, err := app.ResolveWithUnmatched(ctx, []*S3Record{NewS3Record(loc)})
+	if err != nil {
+		return newJobError("resolve", err)
+	}
+	if len(unmatched) > 0 {
+		return errors.New("no rules matched")
+	}
+	transportHandles := make([]*TransportJobHandle, 0, len(jobs))
+	defer func() {
+		cleanupCtx, cancel := cleanupContext(ctx)
+		defer cancel()
+		for _, h := range transportHandles {
+			h.Cleanup(cleanupCtx)
+		}
+	}()
+	for _, job := range jobs {
+		override.apply(job.LoadingJob)
+		jobCtx := logger.WithFields(ctx,
+			logger.FieldRule, job.Rule,
+			logger.FieldS3URI, job.Source.String(),
+			logger.FieldTable, job.LoadingDestination.String(),
+		)
+		logger.FromContext(jobCtx).Infof("[load] %s", job)
+		transportHandle, err := app.execJob(jobCtx, nil, job)
+		if transportHandle != nil {
+			transportHandles = append(transportHandles, transportHandle)
+		}
+		if errors.Cause(err) == ErrSkipObject {
+			logger.FromContext(jobCtx).Infof("[load] skipped: %s", err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		logger.FromContext(jobCtx).Infof("[load] loaded %s to %s", loc, job.LoadingDestination)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package bqin_test
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/kayac/bqin"
+	"github.com/kayac/bqin/internal/logger"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestLoadObjects(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	cases := []struct {
+		Comment  string
+		URLs     []string
+		Override *bqin.LoadOverride
+		IsErr    bool
+		Expected map[string][]string
+	}{
+		{
+			Comment: "load by rule",
+			URLs:    []string{"s3://bqin.bucket.test/data/user/snapshot_at=20200210/part-0001.csv"},
+			Expected: map[string][]string{
+				"bqin-test-gcp.test.user": []string{
+					"gs://bqin-import-tmp/data/user/snapshot_at=20200210/part-0001.csv",
+				},
+			},
+		},
+		{
+			Comment: "override table",
+			URLs: []string{
+				"s3://bqin.bucket.test/data/user/snapshot_at=20200211/part-0001.csv",
+				"s3://bqin.bucket.test/data/user/snapshot_at=20200211/part-0002.csv",
+			},
+			Override: &bqin.LoadOverride{
+				Table:            "fix.user_20200211",
+				WriteDisposition: bigquery.WriteTruncate,
+			},
+			Expected: map[string][]string{
+				"bqin-test-gcp.fix.user_20200211": []string{
+					"gs://bqin-import-tmp/data/user/snapshot_at=20200211/part-0001.csv",
+					"gs://bqin-import-tmp/data/user/snapshot_at=20200211/part-0002.csv",
+				},
+			},
+		},
+		{
+			Comment: "unmatched object does not stop others",
+			URLs: []string{
+				"s3://bqin.bucket.test/unknown/part-0001.csv",
+				"s3://bqin.bucket.test/data/user/snapshot_at=20200210/part-0001.csv",
+			},
+			IsErr: true,
+			Expected: map[string][]string{
+				"bqin-test-gcp.test.user": []string{
+					"gs://bqin-import-tmp/data/user/snapshot_at=20200210/part-0001.csv",
+				},
+			},
+		},
+		{
+			Comment:  "invalid override",
+			URLs:     []string{"s3://bqin.bucket.test/data/user/snapshot_at=20200210/part-0001.csv"},
+			Override: &bqin.LoadOverride{Table: "a.b.c.d"},
+			IsErr:    true,
+			Expected: map[string][]string{},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.Comment, func(t *testing.T) {
+			mgr := NewStubManager("testdata/s3/")
+			defer mgr.Close()
+			conf, err := bqin.LoadConfig("testdata/config/standard.yaml")
+			if err != nil {
+				t.Fatalf("Prepare failed, load configure  %s:", err)
+			}
+			mgr.OverwriteConfig(conf)
+			locs := make([]*url.URL, 0, len(c.URLs))
+			for _, u := range c.URLs {
+				locs = append(locs, MustParseURL(u))
+			}
+			err = bqin.NewApp(conf).LoadObjects(context.Background(), locs, c.Override)
+			if c.IsErr != (err != nil) {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if loaded := mgr.BigQuery.LoadedData(); !reflect.DeepEqual(loaded, c.Expected) {
+				t.Errorf("unexpected loaded data: %s", pretty.Compare(loaded, c.Expected))
+			}
+		})
+	}
+}
+
+func TestParseWriteDisposition(t *testing.T) {
+	cases := map[string]bigquery.TableWriteDisposition{
+		"append":         bigquery.WriteAppend,
+		"truncate":       bigquery.WriteTruncate,
+		"WRITE_EMPTY":    bigquery.WriteEmpty,
+		"write_truncate": bigquery.WriteTruncate,
+	}
+	for s, expected := range cases {
+		d, err := bqin.ParseWriteDisposition(s)
+		if err != nil || d != expected {
+			t.Errorf("%s: unexpected %s, %v", s, d, err)
+		}
+	}
+	if _, err := bqin.ParseWriteDisposition("overwrite"); err == nil {
+		t.Error("overwrite must be error")
+	}
+}
@@ -3,6 +3,8 @@ package bqin
 import (
 	"context"
 	"fmt"
+	"strings"
+	"text/template"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/kayac/bqin/internal/logger"
@@ -26,6 +28,13 @@ type LoadingJob struct {
 
 	CreateDisposition bigquery.TableCreateDisposition
 	WriteDisposition  bigquery.TableWriteDisposition
+
+	PostLoadQueries     []string
+	IgnorePostLoadError bool
+	// Captures are captured values of the key pattern, expanded in post load queries as {{ .Captures.name }}.
+	Captures map[string]string
+
+	Retry *RetryConfig
 }
 
 func NewLoadingJob(dest *LoadingDestination, objectURIs ...string) *LoadingJob {
@@ -41,24 +50,202 @@ func (job *LoadingJob) String() string {
 	return fmt.Sprintf("load to %s", job.LoadingDestination)
 }
 
+// LoadingResult is the statistics of the load job.
+type LoadingResult struct {
+	JobID       string
+	OutputRows  int64
+	OutputBytes int64
+}
+
+// Load runs the load job and post load queries, transient errors are retried with backoff.
+// returned error is classified as JobError.
 func (l *Loader) Load(ctx context.Context, job *LoadingJob) error {
-	bq, err := bigquery.NewClient(ctx, job.ProjectID, l.opts...)
+	_, err := l.LoadWithResult(ctx, job)
+	return err
+}
+
+// LoadWithResult is same as Load, and returns the result of the last load job even if failed.
+func (l *Loader) LoadWithResult(ctx context.Context, job *LoadingJob) (_ *LoadingResult, err error) {
+	ctx, span := startSpan(ctx, "bqin.load", attrTable.String(job.LoadingDestination.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
+	bq, err := newBigQueryClient(ctx, job.ProjectID, l.opts)
 	if err != nil {
-		return errors.Wrap(err, "can not get bigquery client")
+		return nil, newJobError("load", errors.Wrap(err, "can not get bigquery client"))
+	}
+	result := &LoadingResult{}
+	if err := l.load(ctx, bq, job, result); err != nil {
+		return result, err
 	}
+	return result, l.postLoad(ctx, bq, job)
+}
 
+// load creates the load job and waits it.
+// only creating the job is retried, the created job is never submitted again for avoiding duplicated rows,
+// because the job may be finished even if polling its status is failed.
+func (l *Loader) load(ctx context.Context, bq *bigquery.Client, job *LoadingJob, result *LoadingResult) (err error) {
+	ctx, span := startSpan(ctx, "bigquery.load", attrTable.String(job.LoadingDestination.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
 	loader := bq.Dataset(job.Dataset).Table(job.Table).LoaderFrom(job.GCSRef)
 	loader.CreateDisposition = job.CreateDisposition
 	loader.WriteDisposition = job.WriteDisposition
-	bqjob, err := loader.Run(ctx)
+	var bqjob *bigquery.Job
+	err = retryJob(ctx, job.Retry, RetryStageLoad, func() error {
+		var err error
+		bqjob, err = loader.Run(ctx)
+		err = newJobError(RetryStageLoad, errors.Wrap(err, "create job failed"))
+		countBigQueryJobFailure(err)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	span.SetAttributes(attrBigQueryJobID.String(bqjob.ID()))
+	ctx = logger.WithFields(ctx, logger.FieldBQJobID, bqjob.ID())
+	logger.FromContext(ctx).Debugf("create load job successed. jon_id=%s", bqjob.ID())
+	*result = LoadingResult{JobID: bqjob.ID()}
+	status, err := waitJob(ctx, job.Retry, RetryStageLoad, bqjob)
 	if err != nil {
-		return errors.Wrap(err, "create job failed")
+		countBigQueryJobFailure(err)
+		return err
+	}
+	if status.Statistics != nil {
+		if stats, ok := status.Statistics.Details.(*bigquery.LoadStatistics); ok {
+			result.OutputRows = stats.OutputRows
+			result.OutputBytes = stats.OutputBytes
+		}
+	}
+	if err := status.Err(); err != nil {
+		err = newJobError(RetryStageLoad, errors.Wrap(err, "load job failed"))
+		countBigQueryJobFailure(err)
+		return err
+	}
+	return nil
+}
+
+func (l *Loader) postLoad(ctx context.Context, bq *bigquery.Client, job *LoadingJob) error {
+	for i, q := range job.PostLoadQueries {
+		err := l.query(ctx, bq, job, q)
+		if err == nil {
+			continue
+		}
+		if !job.IgnorePostLoadError {
+			return errors.Wrapf(err, "post load query[%d] failed", i)
+		}
+		logger.FromContext(ctx).Warnf("post load query[%d] failed, but ignored. reason: %s", i, err)
 	}
+	return nil
+}
 
-	logger.Debugf("create load job successed. jon_id=%s", bqjob.ID())
-	status, err := bqjob.Wait(ctx)
+// query creates the query job and waits it.
+// post load queries such as DELETE may not be idempotent, so the job is never created again after polling its status is failed,
+// because the job may be finished. only creating the job, and the job finished with a retryable error are retried.
+func (l *Loader) query(ctx context.Context, bq *bigquery.Client, job *LoadingJob, q string) (err error) {
+	ctx, span := startSpan(ctx, "bigquery.query", attrTable.String(job.LoadingDestination.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
+	sql, err := expandQuery(q, job)
 	if err != nil {
-		return errors.Wrap(err, "can not wait job")
+		return newPermanentError(RetryStagePostLoad, "invalid query", err)
+	}
+	logger.FromContext(ctx).Debugf("run post load query: %s", sql)
+	var waitErr error
+	err = retryJob(ctx, job.Retry, RetryStagePostLoad, func() error {
+		bqjob, err := bq.Query(sql).Run(ctx)
+		if err != nil {
+			err = newJobError(RetryStagePostLoad, errors.Wrap(err, "create query job failed"))
+			countBigQueryJobFailure(err)
+			return err
+		}
+		span.SetAttributes(attrBigQueryJobID.String(bqjob.ID()))
+		jobCtx := logger.WithFields(ctx, logger.FieldBQJobID, bqjob.ID())
+		logger.FromContext(jobCtx).Debugf("create query job successed. jon_id=%s", bqjob.ID())
+		status, err := waitJob(jobCtx, job.Retry, RetryStagePostLoad, bqjob)
+		if err != nil {
+			waitErr = err
+			return nil
+		}
+		err = newJobError(RetryStagePostLoad, errors.Wrap(status.Err(), "query job failed"))
+		countBigQueryJobFailure(err)
+		return err
+	})
+	if waitErr != nil {
+		countBigQueryJobFailure(waitErr)
+		return waitErr
 	}
-	return errors.Wrap(status.Err(), "load job failed")
+	return err
+}
+
+// waitJob polls the job status. transient errors of polling are retried without creating the job again.
+func waitJob(ctx context.Context, c *RetryConfig, stage string, bqjob *bigquery.Job) (*bigquery.JobStatus, error) {
+	var status *bigquery.JobStatus
+	err := retryJob(ctx, c, stage, func() error {
+		var err error
+		status, err = bqjob.Wait(ctx)
+		return newJobError(stage, errors.Wrap(err, "can not wait job"))
+	})
+	return status, err
+}
+
+func parseQueryTemplate(q string) (*template.Template, error) {
+	return template.New("query").Option("missingkey=error").Parse(q)
+}
+
+// queryData is the data for expanding post load queries.
+type queryData struct {
+	*LoadingDestination
+	Captures map[string]string
+}
+
+// example: when destination table is `user`, DELETE FROM {{ .Dataset }}.{{ .Table }} => DELETE FROM test.user
+// captured values are escaped for string literals, such as WHERE dt = '{{ .Captures.date }}'.
+func expandQuery(q string, job *LoadingJob) (string, error) {
+	tmpl, err := parseQueryTemplate(q)
+	if err != nil {
+		return "", errors.Wrap(err, "parse query failed")
+	}
+	data := &queryData{
+		LoadingDestination: job.LoadingDestination,
+		Captures:           make(map[string]string, len(job.Captures)),
+	}
+	for k, v := range job.Captures {
+		data.Captures[k] = escapeQueryString(v)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", errors.Wrap(err, "expand query failed")
+	}
+	return b.String(), nil
+}
+
+// expandQueries returns post load queries of the job, a query failed to expand is returned as is.
+func (job *LoadingJob) expandQueries() []string {
+	ret := make([]string, 0, len(job.PostLoadQueries))
+	for _, q := range job.PostLoadQueries {
+		if sql, err := expandQuery(q, job); err == nil {
+			q = sql
+		}
+		ret = append(ret, q)
+	}
+	return ret
+}
+
+var queryStringEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`'`, `\'`,
+	`"`, `\"`,
+	"`", "\\`",
+	"\n", `\n`,
+	"\r", `\r`,
+)
+
+// escapeQueryString escapes s for string literals and quoted identifiers of BigQuery.
+// example: it's => it\'s
+func escapeQueryString(s string) string {
+	return queryStringEscaper.Replace(s)
 }
@@ -3,11 +3,14 @@ package bqin_test
 import (
 	"context"
 	"fmt"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/kayac/bqin"
 	"github.com/kayac/bqin/internal/logger"
 	"github.com/kayac/bqin/internal/stub"
+	"github.com/kylelemons/godebug/pretty"
 	"google.golang.org/api/option"
 )
 
@@ -22,9 +25,12 @@ func TestLoader(t *testing.T) {
 	)
 
 	cases := []struct {
-		Comment    string
-		ObjectURIs []string
-		IsErr      bool
+		Comment             string
+		ObjectURIs          []string
+		PostLoadQueries     []string
+		IgnorePostLoadError bool
+		Retry               *bqin.RetryConfig
+		IsErr               bool
 		*bqin.LoadingDestination
 	}{
 		{
@@ -47,11 +53,87 @@ func TestLoader(t *testing.T) {
 			},
 			IsErr: true,
 		},
+		{
+			Comment:         "success with post load queries",
+			ObjectURIs:      []string{"gs://my-bucket/my-object.csv"},
+			PostLoadQueries: []string{"DELETE FROM `{{ .Dataset }}.{{ .Table }}` WHERE 1=1"},
+			LoadingDestination: &bqin.LoadingDestination{
+				ProjectID: "my-project",
+				Dataset:   "my-dataset",
+				Table:     "my-table",
+			},
+			IsErr: false,
+		},
+		{
+			Comment:         "post load query failed",
+			ObjectURIs:      []string{"gs://my-bucket/my-object.csv"},
+			PostLoadQueries: []string{"FAIL"},
+			LoadingDestination: &bqin.LoadingDestination{
+				ProjectID: "my-project",
+				Dataset:   "my-dataset",
+				Table:     "my-table",
+			},
+			IsErr: true,
+		},
+		{
+			Comment:             "post load query failed, but ignored",
+			ObjectURIs:          []string{"gs://my-bucket/my-object.csv"},
+			PostLoadQueries:     []string{"FAIL", "SELECT 1"},
+			IgnorePostLoadError: true,
+			LoadingDestination: &bqin.LoadingDestination{
+				ProjectID: "my-project",
+				Dataset:   "my-dataset",
+				Table:     "my-table",
+			},
+			IsErr: false,
+		},
+		{
+			Comment:         "post load query has unknown placeholder",
+			ObjectURIs:      []string{"gs://my-bucket/my-object.csv"},
+			PostLoadQueries: []string{"SELECT * FROM {{ .Unknown }}"},
+			LoadingDestination: &bqin.LoadingDestination{
+				ProjectID: "my-project",
+				Dataset:   "my-dataset",
+				Table:     "my-table",
+			},
+			IsErr: true,
+		},
+		{
+			Comment:         "post load query is retried",
+			ObjectURIs:      []string{"gs://my-bucket/my-object.csv"},
+			PostLoadQueries: []string{"SELECT 'RETRY'"},
+			Retry: &bqin.RetryConfig{
+				RetryOption: bqin.RetryOption{MaxAttempts: 2, Interval: 10 * time.Millisecond},
+			},
+			LoadingDestination: &bqin.LoadingDestination{
+				ProjectID: "my-project",
+				Dataset:   "my-dataset",
+				Table:     "my-table",
+			},
+			IsErr: false,
+		},
+		{
+			Comment:         "post load query is not retried",
+			ObjectURIs:      []string{"gs://my-bucket/my-object.csv"},
+			PostLoadQueries: []string{"SELECT 'RETRY AGAIN'"},
+			Retry: &bqin.RetryConfig{
+				PostLoad: &bqin.RetryOption{MaxAttempts: 1},
+			},
+			LoadingDestination: &bqin.LoadingDestination{
+				ProjectID: "my-project",
+				Dataset:   "my-dataset",
+				Table:     "my-table",
+			},
+			IsErr: true,
+		},
 	}
 	for i, c := range cases {
 		t.Run(fmt.Sprintf("case-%02d", i), func(t *testing.T) {
 			t.Log(c.Comment)
 			job := bqin.NewLoadingJob(c.LoadingDestination, c.ObjectURIs...)
+			job.PostLoadQueries = c.PostLoadQueries
+			job.IgnorePostLoadError = c.IgnorePostLoadError
+			job.Retry = c.Retry
 			err := loader.Load(context.Background(), job)
 			t.Logf("err is %v", err)
 			if (err != nil) != c.IsErr {
@@ -60,3 +142,111 @@ func TestLoader(t *testing.T) {
 		})
 	}
 }
+
+func TestLoaderRetryPolling(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	s := stub.NewStubBigQuery()
+	defer s.Close()
+	s.FailGetJob = 2
+
+	loader := bqin.NewLoader(
+		option.WithoutAuthentication(),
+		option.WithEndpoint(s.Endpoint()),
+	)
+	dest := &bqin.LoadingDestination{
+		ProjectID: "my-project",
+		Dataset:   "my-dataset",
+		Table:     "my-table",
+	}
+	job := bqin.NewLoadingJob(dest, "gs://my-bucket/my-object.csv")
+	job.Retry = &bqin.RetryConfig{
+		RetryOption: bqin.RetryOption{MaxAttempts: 3, Interval: 10 * time.Millisecond},
+	}
+	if err := loader.Load(context.Background(), job); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := s.NumberOfLoadJobsCreated; n != 1 {
+		t.Errorf("load job must be created only once, but created %d times", n)
+	}
+	if loaded := s.LoadedData()["my-project.my-dataset.my-table"]; len(loaded) != 1 {
+		t.Errorf("unexpected loaded: %v", s.LoadedData())
+	}
+
+	t.Run("give_up_polling", func(t *testing.T) {
+		s.FailGetJob = 3
+		s.NumberOfLoadJobsCreated = 0
+		if err := loader.Load(context.Background(), job); err == nil {
+			t.Error("polling must give up after max_attempts")
+		}
+		if n := s.NumberOfLoadJobsCreated; n != 1 {
+			t.Errorf("load job must not be created again after polling failed, but created %d times", n)
+		}
+	})
+
+	t.Run("post_load", func(t *testing.T) {
+		postLoadJob := bqin.NewLoadingJob(dest, "gs://my-bucket/my-object.csv")
+		postLoadJob.PostLoadQueries = []string{"DELETE FROM {{ .Dataset }}.{{ .Table }} WHERE dt < CURRENT_DATE()"}
+		postLoadJob.Retry = job.Retry
+		s.FailGetQueryJob = 2
+		s.NumberOfQueryJobsCreated = 0
+		if err := loader.Load(context.Background(), postLoadJob); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if n := s.NumberOfQueryJobsCreated; n != 1 {
+			t.Errorf("query job must be created only once, but created %d times", n)
+		}
+	})
+
+	t.Run("post_load_give_up_polling", func(t *testing.T) {
+		postLoadJob := bqin.NewLoadingJob(dest, "gs://my-bucket/my-object.csv")
+		postLoadJob.PostLoadQueries = []string{"DELETE FROM {{ .Dataset }}.{{ .Table }} WHERE dt < CURRENT_DATE()"}
+		postLoadJob.Retry = job.Retry
+		s.FailGetQueryJob = 3
+		s.NumberOfQueryJobsCreated = 0
+		if err := loader.Load(context.Background(), postLoadJob); err == nil {
+			t.Error("polling must give up after max_attempts")
+		}
+		if n := s.NumberOfQueryJobsCreated; n != 1 {
+			t.Errorf("query job must not be created again after polling failed, but created %d times", n)
+		}
+	})
+}
+
+func TestLoaderPostLoadCaptures(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	s := stub.NewStubBigQuery()
+	defer s.Close()
+
+	conf, err := bqin.LoadConfig("testdata/config/post_load.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	resolver := (&bqin.Factory{Config: conf}).NewResolver()
+	loader := bqin.NewLoader(
+		option.WithoutAuthentication(),
+		option.WithEndpoint(s.Endpoint()),
+	)
+
+	// captured values are neither parsed as template nor able to break out of string literals.
+	jobs, err := resolver.Resolve(context.Background(), []*bqin.S3Record{
+		MustParseRecord("s3://bqin.bucket.test/data/{{.Table}}/snapshot_at=20200210/part-0001.csv"),
+		MustParseRecord("s3://bqin.bucket.test/data/it's/snapshot_at=20200210/part-0001.csv"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected resolve error: %s", err)
+	}
+	for _, job := range jobs {
+		if err := loader.Load(context.Background(), job.LoadingJob); err != nil {
+			t.Fatalf("unexpected load error: %s", err)
+		}
+	}
+	expected := []string{
+		"DELETE FROM `bqin-test-gcp.test.{{.Table}}_20200210` WHERE snapshot_at < '20200210'",
+		"CALL `bqin-test-gcp.test`.refresh_{{.Table}}_summary()",
+		"DELETE FROM `bqin-test-gcp.test.it's_20200210` WHERE snapshot_at < '20200210'",
+		"CALL `bqin-test-gcp.test`.refresh_it\\'s_summary()",
+	}
+	if queries := s.ExecutedQueries(); !reflect.DeepEqual(queries, expected) {
+		t.Errorf("unexpected queries: %s", pretty.Compare(queries, expected))
+	}
+}
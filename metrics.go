@@ -0,0 +1,106 @@
+package bqin
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// buckets of durations, loading jobs take from seconds to minutes.
+var durationBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+var registry = prometheus.NewRegistry()
+
+var (
+	metricMessagesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bqin_messages_received_total",
+		Help: "Number of SQS messages received.",
+	})
+	metricMessagesCompleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bqin_messages_completed_total",
+		Help: "Number of SQS messages deleted after processing.",
+	})
+	metricMessagesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bqin_messages_failed_total",
+		Help: "Number of SQS messages failed to process, by error class.",
+	}, []string{"class"})
+	metricReceiveEmpty = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bqin_receive_empty_total",
+		Help: "Number of receive calls which returned no messages.",
+	})
+	metricJobs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bqin_jobs_total",
+		Help: "Number of jobs processed, by rule.",
+	}, []string{"rule"})
+	metricJobsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bqin_jobs_in_flight",
+		Help: "Number of jobs in process.",
+	})
+	metricUnmatchedObjects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bqin_unmatched_objects_total",
+		Help: "Number of objects matched to no rules.",
+	})
+	metricTransportedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bqin_transported_bytes_total",
+		Help: "Bytes copied from S3 to Cloud Storage.",
+	})
+	metricTransportDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bqin_transport_duration_seconds",
+		Help:    "Duration of transport including retries.",
+		Buckets: durationBuckets,
+	})
+	metricLoadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bqin_load_duration_seconds",
+		Help:    "Duration of load including post load queries and retries, by rule.",
+		Buckets: durationBuckets,
+	}, []string{"rule"})
+	metricConfigReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bqin_config_reloads_total",
+		Help: "Number of config reloads, by result.",
+	}, []string{"result"})
+	metricBigQueryJobFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bqin_bigquery_job_failures_total",
+		Help: "Number of failed BigQuery jobs, by error reason.",
+	}, []string{"reason"})
+)
+
+func init() {
+	registry.MustRegister(
+		metricMessagesReceived,
+		metricMessagesCompleted,
+		metricMessagesFailed,
+		metricReceiveEmpty,
+		metricJobs,
+		metricJobsInFlight,
+		metricUnmatchedObjects,
+		metricTransportedBytes,
+		metricTransportDuration,
+		metricLoadDuration,
+		metricConfigReloads,
+		metricBigQueryJobFailures,
+	)
+	// export known labels as 0 before the first event.
+	for _, class := range []ErrorClass{ErrorRetryable, ErrorPermanent, ErrorUnknown} {
+		metricMessagesFailed.WithLabelValues(string(class))
+	}
+	for _, result := range []string{"success", "failure"} {
+		metricConfigReloads.WithLabelValues(result)
+	}
+}
+
+// MetricsHandler serves metrics of the worker in the Prometheus text format.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+func countBigQueryJobFailure(err error) {
+	if err == nil {
+		return
+	}
+	reason := "unknown"
+	if jobErr, ok := asJobError(err); ok && jobErr.Reason != "" {
+		reason = jobErr.Reason
+	}
+	metricBigQueryJobFailures.WithLabelValues(reason).Inc()
+}
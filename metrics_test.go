@@ -0,0 +1,69 @@
+package bqin_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kayac/bqin"
+	"github.com/kayac/bqin/internal/logger"
+)
+
+func scrapeMetrics(t *testing.T) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	bqin.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != 200 {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestMetricsHandler(t *testing.T) {
+	names := []string{
+		"bqin_messages_received_total",
+		"bqin_messages_completed_total",
+		"bqin_messages_failed_total",
+		"bqin_receive_empty_total",
+		"bqin_jobs_in_flight",
+		"bqin_unmatched_objects_total",
+		"bqin_transported_bytes_total",
+		"bqin_transport_duration_seconds",
+		"bqin_config_reloads_total",
+	}
+	body := scrapeMetrics(t)
+	for _, name := range names {
+		if !strings.Contains(body, "# TYPE "+name+" ") {
+			t.Errorf("%s is not exported", name)
+		}
+	}
+	if !strings.Contains(body, `bqin_messages_failed_total{class="permanent"} `) {
+		t.Error("known classes must be exported before failures")
+	}
+
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	mgr := NewStubManager("testdata/s3/")
+	defer mgr.Close()
+	if err := mgr.SQS.SendMessagesFromFile([]string{"testdata/sqs/user.json"}); err != nil {
+		t.Fatalf("Prepare failed, load message body %s:", err)
+	}
+	conf, err := bqin.LoadConfig("testdata/config/standard.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	mgr.OverwriteConfig(conf)
+	err = bqin.NewApp(conf).Run(context.Background(), bqin.WithExitNoMessage(true), bqin.WithExitError(true))
+	if err != nil {
+		t.Fatalf("unexpected run error: %s", err)
+	}
+	body = scrapeMetrics(t)
+	for _, series := range []string{
+		`bqin_jobs_total{rule=`,
+		`bqin_load_duration_seconds_bucket{rule=`,
+	} {
+		if !strings.Contains(body, series) {
+			t.Errorf("%s is not exported", series)
+		}
+	}
+}
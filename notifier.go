@@ -0,0 +1,330 @@
+package bqin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/kayac/bqin/internal/logger"
+	"github.com/pkg/errors"
+)
+
+const (
+	// NotifyJobFailure is the message processing failure, the message will be retried.
+	NotifyJobFailure = "job_failure"
+	// NotifyDeadLetter is the failure of the message which is moved to the dead letter queue or the failure queue.
+	NotifyDeadLetter = "dead_letter"
+	// NotifyMaxRetry is the message which can not be deleted after retries.
+	NotifyMaxRetry = "max_retry"
+)
+
+const (
+	NotifierWebhook = "webhook"
+	NotifierSlack   = "slack"
+	NotifierSNS     = "sns"
+)
+
+type NotificationConfig struct {
+	Sinks []*NotifierSinkConfig `yaml:"sinks"`
+	// at most rate_limit notifications are sent per rate_interval (default 1m), others are dropped.
+	RateLimit    int           `yaml:"rate_limit,omitempty"`
+	RateInterval time.Duration `yaml:"rate_interval,omitempty"`
+	// same errors are notified only once in dedup_window.
+	DedupWindow time.Duration `yaml:"dedup_window,omitempty"`
+}
+
+type NotifierSinkConfig struct {
+	Type string `yaml:"type"`
+	// for webhook and slack
+	URL string `yaml:"url,omitempty"`
+	// for webhook, the body is expanded by text/template with NotificationEvent. default is JSON of the event.
+	Headers  map[string]string `yaml:"headers,omitempty"`
+	Template string            `yaml:"template,omitempty"`
+	// for slack
+	Channel  string `yaml:"channel,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	// for sns
+	TopicARN string `yaml:"topic_arn,omitempty"`
+}
+
+func (c *NotificationConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.RateLimit < 0 {
+		return errors.New("rate_limit must be positive")
+	}
+	for i, sink := range c.Sinks {
+		if err := sink.Validate(); err != nil {
+			return errors.Wrapf(err, "sinks[%d]", i)
+		}
+	}
+	return nil
+}
+
+func (c *NotifierSinkConfig) Validate() error {
+	switch c.Type {
+	case NotifierWebhook, NotifierSlack:
+		if c.URL == "" {
+			return errors.New("url is not defined")
+		}
+		if _, err := parseNotificationTemplate(c.Template); err != nil {
+			return errors.Wrap(err, "template is invalid")
+		}
+	case NotifierSNS:
+		if c.TopicARN == "" {
+			return errors.New("topic_arn is not defined")
+		}
+	default:
+		return errors.Errorf("type `%s` is not supported", c.Type)
+	}
+	return nil
+}
+
+// NotificationEvent is the data for notification, and for the webhook template.
+type NotificationEvent struct {
+	Kind      string    `json:"kind"`
+	QueueName string    `json:"queue_name"`
+	MessageID string    `json:"message_id"`
+	Stage     string    `json:"stage,omitempty"`
+	Class     string    `json:"class,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Error     string    `json:"error"`
+	Time      time.Time `json:"time"`
+	// number of notifications dropped by rate limit, since the last notification.
+	Suppressed int `json:"suppressed,omitempty"`
+}
+
+func NewNotificationEvent(kind string, handle *ReceiptHandle, cause error) *NotificationEvent {
+	event := &NotificationEvent{
+		Kind:  kind,
+		Error: cause.Error(),
+		Time:  time.Now(),
+	}
+	if handle != nil {
+		event.MessageID = handle.MessageID()
+	}
+	if jobErr, ok := asJobError(cause); ok {
+		event.Stage = jobErr.Stage
+		event.Class = string(jobErr.Class)
+		event.Reason = jobErr.Reason
+	}
+	return event
+}
+
+func (e *NotificationEvent) String() string {
+	s := fmt.Sprintf("[bqin] %s: %s", e.Kind, e.Error)
+	if e.MessageID != "" {
+		s += fmt.Sprintf(" (queue=%s, message_id=%s)", e.QueueName, e.MessageID)
+	}
+	if e.Suppressed > 0 {
+		s += fmt.Sprintf(" and %d notifications are suppressed", e.Suppressed)
+	}
+	return s
+}
+
+func (e *NotificationEvent) dedupKey() string {
+	return e.Kind + "\x00" + e.Error
+}
+
+type notifierSink interface {
+	send(ctx context.Context, event *NotificationEvent) error
+}
+
+// Notifier sends notifications of failures to the sinks, with rate limiting and de-duplication.
+type Notifier struct {
+	sinks []notifierSink
+	conf  *NotificationConfig
+
+	mu          sync.Mutex
+	windowStart time.Time
+	sentCount   int
+	suppressed  int
+	lastSent    map[string]time.Time
+}
+
+var notifierHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+func NewNotifier(conf *NotificationConfig, sess *session.Session) *Notifier {
+	n := &Notifier{
+		conf:     conf,
+		lastSent: make(map[string]time.Time),
+	}
+	if conf == nil {
+		return n
+	}
+	for _, c := range conf.Sinks {
+		switch c.Type {
+		case NotifierWebhook:
+			tmpl, _ := parseNotificationTemplate(c.Template)
+			n.sinks = append(n.sinks, &webhookSink{url: c.URL, headers: c.Headers, tmpl: tmpl})
+		case NotifierSlack:
+			n.sinks = append(n.sinks, &slackSink{url: c.URL, channel: c.Channel, username: c.Username})
+		case NotifierSNS:
+			n.sinks = append(n.sinks, &snsSink{sess: sess, topicARN: c.TopicARN})
+		}
+	}
+	return n
+}
+
+// Notify sends the event to all sinks. errors of the sinks are only logged.
+func (n *Notifier) Notify(ctx context.Context, event *NotificationEvent) {
+	if n == nil || len(n.sinks) == 0 {
+		return
+	}
+	if !n.allow(ctx, event) {
+		return
+	}
+	for _, sink := range n.sinks {
+		if err := sink.send(ctx, event); err != nil {
+			logger.FromContext(ctx).Warnf("notification failed: %s", err)
+		}
+	}
+}
+
+func (n *Notifier) allow(ctx context.Context, event *NotificationEvent) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := event.Time
+	key := event.dedupKey()
+	if window := n.conf.DedupWindow; window > 0 {
+		if last, ok := n.lastSent[key]; ok && now.Sub(last) < window {
+			logger.FromContext(ctx).Debugf("notification is deduplicated: %s", event)
+			return false
+		}
+	}
+	if limit := n.conf.RateLimit; limit > 0 {
+		interval := n.conf.RateInterval
+		if interval == 0 {
+			interval = time.Minute
+		}
+		if now.Sub(n.windowStart) >= interval {
+			n.windowStart = now
+			n.sentCount = 0
+		}
+		if n.sentCount >= limit {
+			n.suppressed++
+			logger.FromContext(ctx).Infof("notification is suppressed by rate limit: %s", event)
+			return false
+		}
+		n.sentCount++
+	}
+	event.Suppressed = n.suppressed
+	n.suppressed = 0
+	n.lastSent[key] = now
+	for k, t := range n.lastSent {
+		if now.Sub(t) >= n.conf.DedupWindow {
+			delete(n.lastSent, k)
+		}
+	}
+	return true
+}
+
+var notificationFuncs = template.FuncMap{
+	// example: {"text": {{ .Error | json }}}
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func parseNotificationTemplate(s string) (*template.Template, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return template.New("notification").Funcs(notificationFuncs).Option("missingkey=error").Parse(s)
+}
+
+type webhookSink struct {
+	url     string
+	headers map[string]string
+	tmpl    *template.Template
+}
+
+func (s *webhookSink) send(ctx context.Context, event *NotificationEvent) error {
+	var body bytes.Buffer
+	if s.tmpl != nil {
+		if err := s.tmpl.Execute(&body, event); err != nil {
+			return errors.Wrap(err, "expand webhook template failed")
+		}
+	} else if err := json.NewEncoder(&body).Encode(event); err != nil {
+		return err
+	}
+	headers := map[string]string{"Content-Type": "application/json"}
+	for k, v := range s.headers {
+		headers[k] = v
+	}
+	return postNotification(ctx, s.url, headers, &body)
+}
+
+type slackSink struct {
+	url      string
+	channel  string
+	username string
+}
+
+// see https://api.slack.com/messaging/webhooks
+func (s *slackSink) send(ctx context.Context, event *NotificationEvent) error {
+	payload := map[string]string{"text": event.String()}
+	if s.channel != "" {
+		payload["channel"] = s.channel
+	}
+	if s.username != "" {
+		payload["username"] = s.username
+	}
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(payload); err != nil {
+		return err
+	}
+	return postNotification(ctx, s.url, map[string]string{"Content-Type": "application/json"}, &body)
+}
+
+func postNotification(ctx context.Context, url string, headers map[string]string, body *bytes.Buffer) error {
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := notifierHTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "post notification failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("post notification failed: %s", resp.Status)
+	}
+	return nil
+}
+
+type snsSink struct {
+	sess     *session.Session
+	topicARN string
+}
+
+func (s *snsSink) send(ctx context.Context, event *NotificationEvent) error {
+	msg, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("[bqin] %s", event.Kind)
+	if event.Stage != "" {
+		subject += " at " + strings.Replace(event.Stage, "_", " ", -1)
+	}
+	_, err = sns.New(s.sess).PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn: aws.String(s.topicARN),
+		Subject:  aws.String(subject),
+		Message:  aws.String(string(msg)),
+	})
+	return errors.Wrap(err, "publish notification to sns failed")
+}
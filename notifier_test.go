@@ -0,0 +1,156 @@
+package bqin_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/kayac/bqin"
+	"github.com/kayac/bqin/internal/logger"
+)
+
+type notificationRecorder struct {
+	mu     sync.Mutex
+	bodies []string
+	header http.Header
+}
+
+func (r *notificationRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if req.Header.Get("Content-Type") == "application/x-www-form-urlencoded; charset=utf-8" {
+		// sns publish
+		params, _ := url.ParseQuery(string(body))
+		r.bodies = append(r.bodies, params.Get("Message"))
+		w.Write([]byte(`<PublishResponse><PublishResult><MessageId>dummy</MessageId></PublishResult></PublishResponse>`))
+		return
+	}
+	r.bodies = append(r.bodies, string(body))
+	r.header = req.Header
+}
+
+func (r *notificationRecorder) Bodies() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.bodies...)
+}
+
+func TestNotifier(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	webhook := &notificationRecorder{}
+	webhookServer := httptest.NewServer(webhook)
+	defer webhookServer.Close()
+	slack := &notificationRecorder{}
+	slackServer := httptest.NewServer(slack)
+	defer slackServer.Close()
+
+	conf := &bqin.NotificationConfig{
+		RateLimit:   2,
+		DedupWindow: time.Minute,
+		Sinks: []*bqin.NotifierSinkConfig{
+			{
+				Type:     bqin.NotifierWebhook,
+				URL:      webhookServer.URL,
+				Headers:  map[string]string{"Authorization": "Bearer dummy"},
+				Template: `{"text": {{ .Error | json }}, "kind": "{{ .Kind }}", "queue": "{{ .QueueName }}"}`,
+			},
+			{
+				Type:    bqin.NotifierSlack,
+				URL:     slackServer.URL,
+				Channel: "#alert",
+			},
+		},
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("unexpected validate error: %s", err)
+	}
+	notifier := bqin.NewNotifier(conf, nil)
+	ctx := context.Background()
+
+	errs := []error{
+		errors.New("first error"),
+		errors.New("first error"), // deduplicated
+		errors.New("second error"),
+		errors.New("third error"), // rate limited
+	}
+	for _, err := range errs {
+		event := bqin.NewNotificationEvent(bqin.NotifyJobFailure, nil, err)
+		event.QueueName = "s3_to_bq"
+		notifier.Notify(ctx, event)
+	}
+
+	expected := []string{
+		`{"text": "first error", "kind": "job_failure", "queue": "s3_to_bq"}`,
+		`{"text": "second error", "kind": "job_failure", "queue": "s3_to_bq"}`,
+	}
+	bodies := webhook.Bodies()
+	if len(bodies) != len(expected) {
+		t.Fatalf("unexpected webhook notifications: %v", bodies)
+	}
+	for i, body := range bodies {
+		if body != expected[i] {
+			t.Errorf("webhook[%d] unexpected: %s", i, body)
+		}
+	}
+	if auth := webhook.header.Get("Authorization"); auth != "Bearer dummy" {
+		t.Errorf("unexpected webhook header: %s", auth)
+	}
+
+	bodies = slack.Bodies()
+	if len(bodies) != len(expected) {
+		t.Fatalf("unexpected slack notifications: %v", bodies)
+	}
+	var payload map[string]string
+	if err := json.Unmarshal([]byte(bodies[1]), &payload); err != nil {
+		t.Fatalf("slack payload is not json: %s", err)
+	}
+	if payload["channel"] != "#alert" || payload["text"] != "[bqin] job_failure: second error" {
+		t.Errorf("unexpected slack payload: %v", payload)
+	}
+}
+
+func TestNotifierSNS(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	sns := &notificationRecorder{}
+	server := httptest.NewServer(sns)
+	defer server.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("ap-northeast-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("dummy", "dummy", ""),
+	}))
+	notifier := bqin.NewNotifier(&bqin.NotificationConfig{
+		Sinks: []*bqin.NotifierSinkConfig{
+			{
+				Type:     bqin.NotifierSNS,
+				TopicARN: "arn:aws:sns:ap-northeast-1:123456789012:bqin-alert",
+			},
+		},
+	}, sess)
+	cause := errors.New("delete message failed")
+	notifier.Notify(context.Background(), bqin.NewNotificationEvent(bqin.NotifyMaxRetry, nil, cause))
+
+	bodies := sns.Bodies()
+	if len(bodies) != 1 {
+		t.Fatalf("unexpected sns notifications: %v", bodies)
+	}
+	var event bqin.NotificationEvent
+	if err := json.Unmarshal([]byte(bodies[0]), &event); err != nil {
+		t.Fatalf("sns message is not json: %s", err)
+	}
+	if event.Kind != bqin.NotifyMaxRetry || event.Error != cause.Error() {
+		t.Errorf("unexpected sns message: %s", bodies[0])
+	}
+}
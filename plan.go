@@ -0,0 +1,167 @@
+package bqin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/kayac/bqin/internal/logger"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+)
+
+// LoadingPlan is the result of validating the load job without loading.
+type LoadingPlan struct {
+	TableExists bool
+	NumRows     uint64
+	NumFields   int
+}
+
+func (p *LoadingPlan) String() string {
+	if !p.TableExists {
+		return "table will be created"
+	}
+	return fmt.Sprintf("table exists (rows=%d, fields=%d)", p.NumRows, p.NumFields)
+}
+
+// Plan validates the destination table and post load queries (by dry run) of the job, nothing is loaded.
+func (l *Loader) Plan(ctx context.Context, job *LoadingJob) (*LoadingPlan, error) {
+	bq, err := newBigQueryClient(ctx, job.ProjectID, l.opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "can not get bigquery client")
+	}
+	defer bq.Close()
+	plan := &LoadingPlan{}
+	md, err := bq.Dataset(job.Dataset).Table(job.Table).Metadata(ctx)
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		if job.CreateDisposition == bigquery.CreateNever {
+			return nil, errors.Errorf("table %s does not exist", job.LoadingDestination)
+		}
+		if !job.GCSRef.AutoDetect && len(job.GCSRef.Schema) == 0 &&
+			(job.GCSRef.SourceFormat == bigquery.CSV || job.GCSRef.SourceFormat == bigquery.JSON) {
+			return nil, errors.Errorf("table %s does not exist, and schema can not be created without auto_detect", job.LoadingDestination)
+		}
+		err = nil
+	} else if err == nil {
+		plan.TableExists = true
+		plan.NumRows = md.NumRows
+		plan.NumFields = len(md.Schema)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "get table %s failed", job.LoadingDestination)
+	}
+	if plan.TableExists && job.WriteDisposition == bigquery.WriteEmpty && plan.NumRows > 0 {
+		return nil, errors.Errorf("table %s is not empty", job.LoadingDestination)
+	}
+	for i, q := range job.PostLoadQueries {
+		if err := l.dryRunQuery(ctx, bq, job, q); err != nil {
+			return nil, errors.Wrapf(err, "post load query[%d] is invalid", i)
+		}
+	}
+	return plan, nil
+}
+
+func (l *Loader) dryRunQuery(ctx context.Context, bq *bigquery.Client, job *LoadingJob, q string) error {
+	sql, err := expandQuery(q, job)
+	if err != nil {
+		return err
+	}
+	query := bq.Query(sql)
+	query.DryRun = true
+	bqjob, err := query.Run(ctx)
+	if err != nil {
+		return errors.Wrap(err, "dry run query failed")
+	}
+	if status := bqjob.LastStatus(); status != nil {
+		return errors.Wrap(status.Err(), "dry run query failed")
+	}
+	return nil
+}
+
+// JobPlan is what the job will do.
+type JobPlan struct {
+	*Job
+	Object *S3ObjectInfo
+	// reason of skip by pre_load checks, the job is not validated more.
+	Skipped string
+	*LoadingPlan
+}
+
+func (p *JobPlan) String() string {
+	var b strings.Builder
+	b.WriteString(p.Job.String())
+	if p.Skipped != "" {
+		fmt.Fprintf(&b, ": skipped (%s)", p.Skipped)
+		return b.String()
+	}
+	if p.Object != nil {
+		fmt.Fprintf(&b, ": source %s", p.Object)
+	}
+	if p.LoadingPlan != nil {
+		fmt.Fprintf(&b, ", %s", p.LoadingPlan)
+	}
+	if n := len(p.PostLoadQueries); n > 0 {
+		fmt.Fprintf(&b, ", %d post load queries", n)
+	}
+	return b.String()
+}
+
+// Plan validates the job without transport and load, by HeadObject of the source and Loader.Plan.
+func (app *App) Plan(ctx context.Context, job *Job) (_ *JobPlan, err error) {
+	ctx, span := startSpan(ctx, "bqin.plan",
+		attrRule.String(job.Rule),
+		attrS3URI.String(job.Source.String()),
+		attrTable.String(job.LoadingDestination.String()),
+	)
+	defer func() {
+		endSpan(span, err)
+	}()
+	plan := &JobPlan{Job: job}
+	if err := app.Inspect(ctx, job); err != nil {
+		if errors.Cause(err) != ErrSkipObject {
+			return nil, err
+		}
+		plan.Skipped = err.Error()
+		return plan, nil
+	}
+	if plan.Object, err = app.Head(ctx, job.Source); err != nil {
+		return nil, err
+	}
+	if plan.LoadingPlan, err = app.Loader.Plan(ctx, job.LoadingJob); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// dryRun shows plans of the message, the message is not deleted and is released when Run returns.
+func (app *App) dryRun(ctx context.Context, receiptHandle *ReceiptHandle, records []*S3Record) error {
+	jobs, unmatched, err := app.ResolveWithUnmatched(ctx, records)
+	if err != nil {
+		return err
+	}
+	for _, r := range unmatched {
+		receiptHandle.Infof("[dry-run] %s is not matched to any rules, unmatched action is %s", r, app.unmatchedAction())
+	}
+	var failed int
+	for i, job := range jobs {
+		jobCtx := logger.WithFields(ctx,
+			logger.FieldRule, job.Rule,
+			logger.FieldS3URI, job.Source.String(),
+			logger.FieldTable, job.LoadingDestination.String(),
+		)
+		plan, err := app.Plan(jobCtx, job)
+		if err != nil {
+			logger.FromContext(jobCtx).Errorf("[dry-run][job %02d]%s: %s", i, job, err)
+			failed++
+			continue
+		}
+		logger.FromContext(jobCtx).Infof("[dry-run][job %02d]%s", i, plan)
+	}
+	receiptHandle.Infof("[dry-run] message is not deleted, and is released at the end")
+	if failed > 0 {
+		return errors.Errorf("%d of %d jobs are invalid", failed, len(jobs))
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package bqin_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/kayac/bqin"
+	"github.com/kayac/bqin/internal/logger"
+)
+
+var stubUserSchema = map[string]interface{}{
+	"fields": []map[string]string{
+		{"name": "id", "type": "INTEGER"},
+		{"name": "name", "type": "STRING"},
+		{"name": "password", "type": "STRING"},
+	},
+}
+
+func TestPlan(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	cases := []struct {
+		Comment   string
+		Configure string
+		Object    string
+		Tables    []string
+		IsErr     bool
+		Expected  string
+	}{
+		{
+			Comment:   "table exists",
+			Configure: "testdata/config/standard.yaml",
+			Object:    "s3://bqin.bucket.test/data/user/snapshot_at=20200210/part-0001.csv",
+			Tables:    []string{"bqin-test-gcp.test.user"},
+			Expected:  "source size=77, content_type=text/csv, table exists (rows=0, fields=3)",
+		},
+		{
+			Comment:   "table does not exist and no schema",
+			Configure: "testdata/config/standard.yaml",
+			Object:    "s3://bqin.bucket.test/data/user/snapshot_at=20200210/part-0001.csv",
+			IsErr:     true,
+		},
+		{
+			Comment:   "source does not exist",
+			Configure: "testdata/config/standard.yaml",
+			Object:    "s3://bqin.bucket.test/data/user/snapshot_at=20200210/part-9999.csv",
+			Tables:    []string{"bqin-test-gcp.test.user"},
+			IsErr:     true,
+		},
+		{
+			Comment:   "skipped by pre_load",
+			Configure: "testdata/config/pre_load.yaml",
+			Object:    "s3://bqin.bucket.test/data/user/snapshot_at=20200210/_SUCCESS",
+			Expected:  "skipped",
+		},
+		{
+			Comment:   "post load queries",
+			Configure: "testdata/config/post_load.yaml",
+			Object:    "s3://bqin.bucket.test/data/user/snapshot_at=20200210/part-0001.csv",
+			Tables:    []string{"bqin-test-gcp.test.user_20200210"},
+			Expected:  "2 post load queries",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.Comment, func(t *testing.T) {
+			mgr := NewStubManager("testdata/s3/")
+			defer mgr.Close()
+			for _, table := range c.Tables {
+				mgr.BigQuery.AddTable(table, stubUserSchema)
+			}
+			conf, err := bqin.LoadConfig(c.Configure)
+			if err != nil {
+				t.Fatalf("Prepare failed, load configure  %s:", err)
+			}
+			mgr.OverwriteConfig(conf)
+			app := bqin.NewApp(conf)
+			jobs, err := app.Resolve(context.Background(), []*bqin.S3Record{MustParseRecord(c.Object)})
+			if err != nil || len(jobs) != 1 {
+				t.Fatalf("Prepare failed, resolve: %v, %v", jobs, err)
+			}
+			plan, err := app.Plan(context.Background(), jobs[0])
+			if c.IsErr {
+				if err == nil {
+					t.Errorf("expected error, but got plan: %s", plan)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			t.Log(plan)
+			if !strings.Contains(plan.String(), c.Expected) {
+				t.Errorf("unexpected plan: %s", plan)
+			}
+			if len(mgr.BigQuery.ExecutedQueries()) != 0 {
+				t.Errorf("queries must not be executed: %v", mgr.BigQuery.ExecutedQueries())
+			}
+		})
+	}
+}
+
+func TestRunDryRun(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	mgr := NewStubManager("testdata/s3/")
+	defer mgr.Close()
+	mgr.BigQuery.AddTable("bqin-test-gcp.test.user", stubUserSchema)
+	if err := mgr.SQS.SendMessagesFromFile([]string{"testdata/sqs/user.json"}); err != nil {
+		t.Fatalf("Prepare failed, load message body %s:", err)
+	}
+	conf, err := bqin.LoadConfig("testdata/config/standard.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	mgr.OverwriteConfig(conf)
+
+	// stub sqs has no visibility timeout, so the message is received repeatedly until canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mgr.BigQuery.OnRequest = func(_ *http.Request) {
+		cancel()
+	}
+	app := bqin.NewApp(conf)
+	err = app.Run(ctx, bqin.WithDryRun(true), bqin.WithExitNoMessage(true), bqin.WithExitError(true))
+	if err != nil {
+		t.Fatalf("unexpected run error: %s", err)
+	}
+	if mgr.SQS.NumberOfMessagesReceived == 0 {
+		t.Error("message is not received")
+	}
+	if mgr.SQS.NumberOfMessagesDeleted != 0 {
+		t.Errorf("message must not be deleted: %d", mgr.SQS.NumberOfMessagesDeleted)
+	}
+	if loaded := mgr.BigQuery.LoadedData(); len(loaded) != 0 {
+		t.Errorf("dry run must not load: %v", loaded)
+	}
+	if len(mgr.SQS.VisibilityTimeouts) == 0 {
+		t.Error("message must be released at the end")
+	}
+	for id, timeout := range mgr.SQS.VisibilityTimeouts {
+		if timeout != 0 {
+			t.Errorf("message %s must be released, but visibility timeout is %d", id, timeout)
+		}
+	}
+
+	// a worker waiting for messages does not support dry run.
+	if err := app.Run(context.Background(), bqin.WithDryRun(true)); err == nil {
+		t.Error("dry run without exit on no message must be failed")
+	}
+}
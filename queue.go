@@ -0,0 +1,269 @@
+package bqin
+
+import (
+	"context"
+	"sync"
+
+	"github.com/kayac/bqin/internal/logger"
+	"github.com/pkg/errors"
+)
+
+// QueueConfig is a queue served with other queues in one process.
+// match_policy, failure_queue_name and unmatched are inherited from the top-level when not defined.
+type QueueConfig struct {
+	Name string `yaml:"name"`
+	// number of messages processed concurrently from this queue, default 1.
+	Concurrency      int              `yaml:"concurrency,omitempty"`
+	MatchPolicy      MatchPolicy      `yaml:"match_policy,omitempty"`
+	FailureQueueName string           `yaml:"failure_queue_name,omitempty"`
+	Unmatched        *UnmatchedOption `yaml:"unmatched,omitempty"`
+	// rules of this queue, merged with the top-level defaults.
+	Rules []*Rule `yaml:"rules,omitempty"`
+	// names of the top-level rules, evaluated after the rules of this queue.
+	// the top-level rules are used when neither rules nor rule_refs are defined.
+	RuleRefs []string `yaml:"rule_refs,omitempty"`
+
+	// resolved by Validate.
+	rules []*Rule
+}
+
+func (q *QueueConfig) getConcurrency() int {
+	if q.Concurrency <= 0 {
+		return 1
+	}
+	return q.Concurrency
+}
+
+func (c *Config) usesTopLevelRules() bool {
+	if len(c.Queues) == 0 {
+		return true
+	}
+	for _, q := range c.Queues {
+		if q != nil && len(q.Rules) == 0 && len(q.RuleRefs) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) validateQueues() ConfigErrors {
+	var errs ConfigErrors
+	rulesByName := make(map[string]*Rule, len(c.Rules))
+	for _, r := range c.Rules {
+		if r != nil && r.Name != "" {
+			rulesByName[r.Name] = r
+		}
+	}
+	names := make(map[string]bool, len(c.Queues))
+	for i, q := range c.Queues {
+		if q == nil {
+			errs = append(errs, errors.Errorf("queues[%d] is empty", i))
+			continue
+		}
+		if q.Name == "" {
+			errs = append(errs, errors.Errorf("queues[%d]: name is not defined", i))
+		} else if names[q.Name] {
+			errs = append(errs, errors.Errorf("queues[%d]: name `%s` is duplicated", i, q.Name))
+		}
+		names[q.Name] = true
+		if q.Concurrency < 0 {
+			errs = append(errs, errors.Errorf("queues[%d]: concurrency must be positive", i))
+		}
+		if !q.MatchPolicy.IsSupport() {
+			errs = append(errs, errors.Errorf("queues[%d]: match_policy `%s` is not supported", i, q.MatchPolicy))
+		}
+		if err := q.Unmatched.Validate(&c.Rule); err != nil {
+			errs = append(errs, errors.Wrapf(err, "queues[%d]: unmatched", i))
+		}
+		q.rules = nil
+		for j, dst := range q.Rules {
+			if dst == nil {
+				errs = append(errs, errors.Errorf("queues[%d]: rule[%d] is empty", i, j))
+				continue
+			}
+			dst.MergeIn(c.Rule.Clone())
+			if err := dst.Validate(); err != nil {
+				errs = append(errs, errors.Wrapf(err, "queues[%d]: rule[%d]", i, j))
+			}
+			q.rules = append(q.rules, dst)
+		}
+		for _, name := range q.RuleRefs {
+			r, ok := rulesByName[name]
+			if !ok {
+				errs = append(errs, errors.Errorf("queues[%d]: rule `%s` is not found in rules", i, name))
+				continue
+			}
+			q.rules = append(q.rules, r)
+		}
+		if len(q.Rules) == 0 && len(q.RuleRefs) == 0 {
+			q.rules = c.Rules
+		}
+	}
+	return errs
+}
+
+// QueueConfigs returns the config of each queue, as if the queue is configured by queue_name.
+// it returns only c itself when queues are not defined.
+func (c *Config) QueueConfigs() []*Config {
+	if len(c.Queues) == 0 {
+		return []*Config{c}
+	}
+	confs := make([]*Config, 0, len(c.Queues))
+	for _, q := range c.Queues {
+		confs = append(confs, c.queueConfig(q))
+	}
+	return confs
+}
+
+// ForQueue returns the config of the queue named name in queues.
+func (c *Config) ForQueue(name string) (*Config, error) {
+	for _, q := range c.Queues {
+		if q.Name == name {
+			return c.queueConfig(q), nil
+		}
+	}
+	return nil, errors.Errorf("queue `%s` is not defined in queues", name)
+}
+
+func (c *Config) queueConfig(q *QueueConfig) *Config {
+	conf := *c
+	conf.Queues = nil
+	conf.QueueName = q.Name
+	conf.Rules = q.rules
+	if q.MatchPolicy != "" {
+		conf.MatchPolicy = q.MatchPolicy
+	}
+	if q.FailureQueueName != "" {
+		conf.FailureQueueName = q.FailureQueueName
+	}
+	if q.Unmatched != nil {
+		conf.Unmatched = q.Unmatched
+	}
+	return &conf
+}
+
+// MultiApp serves queues in one process, each queue is processed by own App.
+type MultiApp struct {
+	Queues []*QueueApp
+
+	scheduler *fairScheduler
+	// serves queue_name without queues.
+	single bool
+}
+
+// QueueApp is the app of a queue, and the number of its workers.
+type QueueApp struct {
+	*App
+	Name        string
+	Concurrency int
+}
+
+func NewMultiApp(conf *Config) *MultiApp {
+	factory := &Factory{Config: conf}
+	return factory.NewMultiApp()
+}
+
+// Run runs workers of all queues, until ctx is done or a worker returns error.
+// with WithQueueName, only the queue of the name in queues is served.
+func (m *MultiApp) Run(ctx context.Context, opts ...RunOption) error {
+	settings := &RunSettings{}
+	for _, opt := range opts {
+		opt.Apply(settings)
+	}
+	queues := m.Queues
+	if settings.QueueName != "" && !m.single {
+		queues = nil
+		for _, q := range m.Queues {
+			if q.Name == settings.QueueName {
+				queues = append(queues, q)
+			}
+		}
+		if len(queues) == 0 {
+			return errors.Errorf("queue `%s` is not defined in queues", settings.QueueName)
+		}
+		settings.QueueName = ""
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for _, q := range queues {
+		queueCtx := ctx
+		if !m.single {
+			queueCtx = logger.WithFields(ctx, logger.FieldQueue, q.Name)
+		}
+		queueSettings := *settings
+		queueSettings.scheduler = m.scheduler
+		queueSettings.schedulerQueue = q.Name
+		for i := 0; i < q.Concurrency; i++ {
+			wg.Add(1)
+			go func(app *App, settings RunSettings) {
+				defer wg.Done()
+				err := app.Run(queueCtx, &settings, WithQueueName(settings.QueueName))
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}(q.App, queueSettings)
+		}
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// Reload swaps rules of all queues at once, or none of them when any queue fails.
+// added queues are applied after restart, and removing queues requires restart.
+func (m *MultiApp) Reload(conf *Config) (*RulesDiff, error) {
+	if m.single {
+		return m.Queues[0].Reload(conf)
+	}
+	confs := make([]*Config, 0, len(m.Queues))
+	diffs := make([]*RulesDiff, 0, len(m.Queues))
+	for _, q := range m.Queues {
+		queueConf, err := conf.ForQueue(q.Name)
+		if err != nil {
+			return nil, errors.Wrap(err, "removing queues requires restart")
+		}
+		d, err := diffRules(q.Rules(), queueConf.Rules)
+		if err != nil {
+			return nil, errors.Wrapf(err, "queue %s", q.Name)
+		}
+		confs = append(confs, queueConf)
+		diffs = append(diffs, d)
+	}
+
+	diff := &RulesDiff{}
+	for i, q := range m.Queues {
+		d := diffs[i]
+		q.swapRules(confs[i], d)
+		prefix := q.Name + ": "
+		for _, r := range d.Added {
+			diff.Added = append(diff.Added, prefix+r)
+		}
+		for _, r := range d.Removed {
+			diff.Removed = append(diff.Removed, prefix+r)
+		}
+		for _, r := range d.Changed {
+			diff.Changed = append(diff.Changed, prefix+r)
+		}
+		if d.MatchPolicy[0] != d.MatchPolicy[1] {
+			diff.Changed = append(diff.Changed, prefix+"match_policy "+string(d.MatchPolicy[0])+" -> "+string(d.MatchPolicy[1]))
+		}
+	}
+	return diff, nil
+}
+
+// Health returns the health checkers of all queues.
+func (m *MultiApp) Health() HealthCheckers {
+	checkers := make(HealthCheckers, 0, len(m.Queues))
+	for _, q := range m.Queues {
+		checkers = append(checkers, q.App.Health)
+	}
+	return checkers
+}
@@ -0,0 +1,257 @@
+package bqin_test
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/kayac/bqin"
+	"github.com/kayac/bqin/internal/logger"
+	"github.com/kayac/bqin/internal/stub"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestQueueConfigs(t *testing.T) {
+	conf, err := bqin.LoadConfig("testdata/config/queues.yaml")
+	if err != nil {
+		t.Fatalf("unexpected error :%s", err)
+	}
+	type expectedQueue struct {
+		QueueName        string
+		MatchPolicy      bqin.MatchPolicy
+		FailureQueueName string
+		Rules            []string
+	}
+	expected := []expectedQueue{
+		{
+			QueueName:   "team_a",
+			MatchPolicy: bqin.MatchFirst,
+			Rules: []string{
+				"s3://bqin.bucket.test/data/user => bqin-test-gcp.test.user",
+			},
+		},
+		{
+			QueueName:        "team_b",
+			MatchPolicy:      bqin.MatchAll,
+			FailureQueueName: "team_b_failure",
+			Rules: []string{
+				`s3://bqin.bucket.test/data/([a-z]+)/.+\.csv => bqin-test-gcp.test.team_b_$1`,
+				"s3://bqin.bucket.test/data/ => bqin-test-gcp.test.archive",
+			},
+		},
+		{
+			QueueName:   "team_c",
+			MatchPolicy: bqin.MatchFirst,
+			Rules: []string{
+				"s3://bqin.bucket.test/data/user => bqin-test-gcp.test.user",
+				"s3://bqin.bucket.test/data/ => bqin-test-gcp.test.archive",
+			},
+		},
+	}
+	var actual []expectedQueue
+	for _, c := range conf.QueueConfigs() {
+		q := expectedQueue{
+			QueueName:        c.QueueName,
+			MatchPolicy:      c.MatchPolicy,
+			FailureQueueName: c.FailureQueueName,
+		}
+		for _, r := range c.Rules {
+			q.Rules = append(q.Rules, r.String())
+		}
+		actual = append(actual, q)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected queue configs: %s", pretty.Compare(actual, expected))
+	}
+
+	if _, err := conf.ForQueue("team_d"); err == nil {
+		t.Error("undefined queue must be error")
+	}
+	app := bqin.NewMultiApp(conf)
+	var concurrencies []int
+	for _, q := range app.Queues {
+		concurrencies = append(concurrencies, q.Concurrency)
+	}
+	if !reflect.DeepEqual(concurrencies, []int{1, 1, 2}) {
+		t.Errorf("unexpected concurrencies: %v", concurrencies)
+	}
+}
+
+func TestQueueConfigsInvalid(t *testing.T) {
+	conf, err := bqin.ReadConfig("testdata/config/broken_invalid_queues.yaml")
+	if err != nil {
+		t.Fatalf("unexpected error :%s", err)
+	}
+	err = conf.ValidateAll()
+	errs, ok := err.(bqin.ConfigErrors)
+	if !ok {
+		t.Fatalf("unexpected error type: %T %s", err, err)
+	}
+	expected := []string{
+		"queue_name and queues can not be used together",
+		"rule[1]: name `user` is duplicated",
+		"queues[0]: rule `not_found` is not found in rules",
+		"queues[1]: name `team_a` is duplicated",
+		"queues[1]: concurrency must be positive",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("unexpected errors count: %d\n%s", len(errs), errs)
+	}
+	for i, e := range errs {
+		if !strings.HasPrefix(e.Error(), expected[i]) {
+			t.Errorf("errors[%d] unexpected: %s", i, e)
+		}
+	}
+}
+
+func TestMultiAppRun(t *testing.T) {
+	cases := []struct {
+		name     string
+		queue    string
+		expected map[string][]string
+	}{
+		{
+			name: "all_queues",
+			expected: map[string][]string{
+				"bqin-test-gcp.test.user": []string{
+					"gs://bqin-import-tmp/data/user/snapshot_at=20200210/part-0001.csv",
+				},
+				"bqin-test-gcp.test.team_b_user": []string{
+					"gs://bqin-import-tmp/data/user/snapshot_at=20200210/part-0001.csv",
+				},
+				"bqin-test-gcp.test.archive": []string{
+					"gs://bqin-import-tmp/data/user/snapshot_at=20200210/part-0001.csv",
+				},
+			},
+		},
+		{
+			name:  "selected_queue",
+			queue: "team_a",
+			expected: map[string][]string{
+				"bqin-test-gcp.test.user": []string{
+					"gs://bqin-import-tmp/data/user/snapshot_at=20200210/part-0001.csv",
+				},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+			mgr := NewStubManager("testdata/s3/")
+			defer mgr.Close()
+			for _, queue := range []string{"team_a", "team_b"} {
+				msg, err := stub.NewSQSMessageFromFile("testdata/sqs/user.json")
+				if err != nil {
+					t.Fatalf("Prepare failed, load message body %s:", err)
+				}
+				mgr.SQS.SetQueueMessages(queue, []*sqs.Message{msg})
+			}
+			conf, err := bqin.LoadConfig("testdata/config/queues.yaml")
+			if err != nil {
+				t.Fatalf("Prepare failed, load configure  %s:", err)
+			}
+			mgr.OverwriteConfig(conf)
+
+			err = bqin.NewMultiApp(conf).Run(
+				context.Background(),
+				bqin.WithQueueName(c.queue),
+				bqin.WithExitNoMessage(true),
+				bqin.WithExitError(true),
+			)
+			if err != nil {
+				t.Fatalf("unexpected run error: %s", err)
+			}
+			loaded := mgr.BigQuery.LoadedData()
+			if !reflect.DeepEqual(loaded, c.expected) {
+				t.Errorf("bigquery loaded data status unexpected: %s", pretty.Compare(loaded, c.expected))
+			}
+		})
+	}
+
+	t.Run("undefined_queue", func(t *testing.T) {
+		conf, err := bqin.LoadConfig("testdata/config/queues.yaml")
+		if err != nil {
+			t.Fatalf("Prepare failed, load configure  %s:", err)
+		}
+		if err := bqin.NewMultiApp(conf).Run(context.Background(), bqin.WithQueueName("team_d")); err == nil {
+			t.Error("undefined queue must be error")
+		}
+	})
+}
+
+func TestMultiAppSharesAuditor(t *testing.T) {
+	conf, err := bqin.LoadConfig("testdata/config/queues.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	conf.Audit = &bqin.AuditConfig{File: filepath.Join(t.TempDir(), "audit.ndjson")}
+	app := bqin.NewMultiApp(conf)
+	for _, q := range app.Queues[1:] {
+		if q.Auditor != app.Queues[0].Auditor {
+			t.Errorf("auditor of %s is not shared", q.Name)
+		}
+	}
+}
+
+func TestMultiAppReload(t *testing.T) {
+	conf, err := bqin.LoadConfig("testdata/config/queues.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	app := bqin.NewMultiApp(conf)
+
+	next, err := bqin.ReadConfig("testdata/config/queues.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	next.Queues[1].MatchPolicy = bqin.MatchFirst
+	next.Queues[1].RuleRefs = nil
+	if err := next.Validate(); err != nil {
+		t.Fatalf("unexpected error :%s", err)
+	}
+	diff, err := app.Reload(next)
+	if err != nil {
+		t.Fatalf("unexpected reload error: %s", err)
+	}
+	expected := []string{
+		"- team_b: s3://bqin.bucket.test/data/ => bqin-test-gcp.test.archive",
+		"~ team_b: match_policy all -> first",
+	}
+	if lines := diff.Lines(); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("unexpected diff: %s", pretty.Compare(lines, expected))
+	}
+	if rules := app.Queues[1].Rules(); len(rules) != 1 {
+		t.Errorf("rules of team_b are not reloaded: %v", rules)
+	}
+	if rules := app.Queues[2].Rules(); len(rules) != 2 {
+		t.Errorf("rules of team_c must be kept: %v", rules)
+	}
+}
+
+func TestMultiAppReloadAtomic(t *testing.T) {
+	conf, err := bqin.LoadConfig("testdata/config/queues.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	app := bqin.NewMultiApp(conf)
+
+	// team_b is changed, but team_c is removed.
+	next, err := bqin.ReadConfig("testdata/config/queues.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	next.Queues[1].RuleRefs = nil
+	next.Queues = next.Queues[:2]
+	if err := next.Validate(); err != nil {
+		t.Fatalf("unexpected error :%s", err)
+	}
+	if _, err := app.Reload(next); err == nil {
+		t.Fatal("removing queues must fail the reload")
+	}
+	if rules := app.Queues[1].Rules(); len(rules) != 2 {
+		t.Errorf("rules of team_b must be kept when the reload failed: %v", rules)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -13,7 +14,6 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/kayac/bqin/internal/logger"
-	"github.com/lestrrat-go/backoff"
 	"github.com/pkg/errors"
 )
 
@@ -24,12 +24,19 @@ type Receiver struct {
 	mu        sync.Mutex
 	queueName string
 	queueURL  string
+	// maxReceiveCount of the redrive policy, -1 means not fetched yet.
+	maxReceiveCount int
+	// fetching maxReceiveCount is retried after this time when failed.
+	maxReceiveCountRetryAt time.Time
+
+	retry *RetryConfig
 }
 
 func NewReceiver(queueName string, sess *session.Session) *Receiver {
 	return &Receiver{
-		sess:      sess,
-		queueName: queueName,
+		sess:            sess,
+		queueName:       queueName,
+		maxReceiveCount: -1,
 	}
 }
 
@@ -37,11 +44,42 @@ type ReceiptHandle struct {
 	sess             *session.Session
 	queueURL         string
 	isCompelete      bool
+	retry            *RetryOption
 	msgId            string
 	msgReceiptHandle string
+	body             string
+	receiveCount     int
+	maxReceiveCount  int
+	// sources of the jobs failed or not run yet, nil means all records of the message.
+	failedSources map[string]bool
+
+	log *logger.Logger
+}
+
+// S3Record is a S3 object notified by the message.
+type S3Record struct {
+	*url.URL
+	EventTime time.Time
+
+	// these are empty, when the record is not notified by message.
+	EventName   string
+	PrincipalID string
+	Size        int64
 }
 
-func (r *Receiver) Receive(ctx context.Context) ([]*url.URL, *ReceiptHandle, error) {
+// NewS3Record returns the record for the object that is not notified by message, such as check command.
+func NewS3Record(u *url.URL) *S3Record {
+	return &S3Record{
+		URL:       u,
+		EventTime: time.Now(),
+	}
+}
+
+func (r *Receiver) Receive(ctx context.Context) (_ []*S3Record, _ *ReceiptHandle, err error) {
+	ctx, span := startSpan(ctx, "bqin.receive")
+	defer func() {
+		endSpan(span, err)
+	}()
 	qurl, err := r.getQueueURL()
 	if err != nil {
 		return nil, nil, err
@@ -50,43 +88,60 @@ func (r *Receiver) Receive(ctx context.Context) ([]*url.URL, *ReceiptHandle, err
 	res, err := svc.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
 		MaxNumberOfMessages: aws.Int64(1),
 		QueueUrl:            aws.String(qurl),
+		AttributeNames:      []*string{aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount)},
 	})
 	if err != nil {
 		return nil, nil, err
 	}
 	if len(res.Messages) == 0 {
+		metricReceiveEmpty.Inc()
 		return nil, nil, ErrNoMessage
 	}
+	metricMessagesReceived.Inc()
 	msg := res.Messages[0]
-	handle := newReceiptHandle(r.sess, qurl, msg)
-	handle.Debugf("body: %s", *msg.Body)
+	handle := newReceiptHandle(ctx, r.sess, qurl, msg)
+	handle.retry = r.retry.Option(RetryStageDeleteMessage)
+	handle.maxReceiveCount = r.getMaxReceiveCount(ctx)
+	span.SetAttributes(attrMessageID.String(handle.MessageID()))
 
 	if msg.Body == nil {
-		return nil, handle, errors.New("body is nil")
+		return nil, handle, newPermanentError("receive", "invalid message", errors.New("body is nil"))
 	}
+	handle.Debugf("body: %s", *msg.Body)
 	dec := json.NewDecoder(strings.NewReader(*msg.Body))
 	var event events.S3Event
 	if err := dec.Decode(&event); err != nil {
-		return nil, handle, errors.Wrap(err, "body parse failed")
+		return nil, handle, newPermanentError("receive", "invalid message", errors.Wrap(err, "body parse failed"))
 	}
 
-	urls := make([]*url.URL, 0, len(event.Records))
+	records := make([]*S3Record, 0, len(event.Records))
 	for _, record := range event.Records {
-		record.S3.Object.URLDecodedKey = record.S3.Object.Key
-		if strings.Contains(record.S3.Object.Key, "%") {
-			if decordedKey, err := url.QueryUnescape(record.S3.Object.Key); err == nil {
-				record.S3.Object.URLDecodedKey = decordedKey
-			}
-		}
-		u := &url.URL{
-			Scheme: "s3",
-			Host:   record.S3.Bucket.Name,
-			Path:   record.S3.Object.URLDecodedKey,
-		}
+		u := recordURL(&record)
 		handle.Debugf("message include %s", u.String())
-		urls = append(urls, u)
+		records = append(records, &S3Record{
+			URL:         u,
+			EventTime:   record.EventTime,
+			EventName:   record.EventName,
+			PrincipalID: record.PrincipalID.PrincipalID,
+			Size:        record.S3.Object.Size,
+		})
+	}
+	return records, handle, nil
+}
+
+// recordURL returns the URL of the object notified by the record, the key is URL decoded.
+func recordURL(record *events.S3EventRecord) *url.URL {
+	record.S3.Object.URLDecodedKey = record.S3.Object.Key
+	if strings.Contains(record.S3.Object.Key, "%") {
+		if decordedKey, err := url.QueryUnescape(record.S3.Object.Key); err == nil {
+			record.S3.Object.URLDecodedKey = decordedKey
+		}
+	}
+	return &url.URL{
+		Scheme: "s3",
+		Host:   record.S3.Bucket.Name,
+		Path:   record.S3.Object.URLDecodedKey,
 	}
-	return urls, handle, nil
 }
 
 func (r *Receiver) getQueueURL() (string, error) {
@@ -109,6 +164,44 @@ func (r *Receiver) getQueueURL() (string, error) {
 	return r.queueURL, nil
 }
 
+// MaxReceiveCountRetryInterval is the interval of fetching maxReceiveCount again after failure.
+var MaxReceiveCountRetryInterval = time.Minute
+
+// getMaxReceiveCount returns maxReceiveCount of the redrive policy of the queue, 0 means no redrive policy.
+// when fetching failed, 0 is returned until MaxReceiveCountRetryInterval passes.
+func (r *Receiver) getMaxReceiveCount(ctx context.Context) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxReceiveCount >= 0 {
+		return r.maxReceiveCount
+	}
+	if time.Now().Before(r.maxReceiveCountRetryAt) {
+		return 0
+	}
+	res, err := sqs.New(r.sess).GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(r.queueURL),
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameRedrivePolicy)},
+	})
+	if err != nil {
+		r.maxReceiveCountRetryAt = time.Now().Add(MaxReceiveCountRetryInterval)
+		logger.FromContext(ctx).Warnf("cannot get sqs queue attributes, retry after %s: %s", MaxReceiveCountRetryInterval, err)
+		return 0
+	}
+	r.maxReceiveCount = 0
+	if policy, ok := res.Attributes[sqs.QueueAttributeNameRedrivePolicy]; ok {
+		var redrive struct {
+			MaxReceiveCount json.Number `json:"maxReceiveCount"`
+		}
+		if err := json.Unmarshal([]byte(aws.StringValue(policy)), &redrive); err != nil {
+			logger.FromContext(ctx).Warnf("cannot parse redrive policy: %s", err)
+		} else if n, err := redrive.MaxReceiveCount.Int64(); err == nil {
+			r.maxReceiveCount = int(n)
+		}
+	}
+	logger.FromContext(ctx).Debugf("maxReceiveCount is %d", r.maxReceiveCount)
+	return r.maxReceiveCount
+}
+
 func (r *Receiver) SetQueueName(queueName string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -117,45 +210,108 @@ func (r *Receiver) SetQueueName(queueName string) {
 	}
 	r.queueName = queueName
 	r.queueURL = ""
+	r.maxReceiveCount = -1
+	r.maxReceiveCountRetryAt = time.Time{}
+}
+
+// SetRetryConfig sets the retry options, delete_message is used for completing messages.
+func (r *Receiver) SetRetryConfig(c *RetryConfig) {
+	r.retry = c
 }
 
 func (r *Receiver) GetQueueName() string {
 	return r.queueName
 }
 
-func newReceiptHandle(sess *session.Session, queueURL string, msg *sqs.Message) *ReceiptHandle {
+func newReceiptHandle(ctx context.Context, sess *session.Session, queueURL string, msg *sqs.Message) *ReceiptHandle {
 	handle := &ReceiptHandle{
 		sess:             sess,
 		isCompelete:      false,
 		queueURL:         queueURL,
 		msgId:            *msg.MessageId,
 		msgReceiptHandle: *msg.ReceiptHandle,
+		body:             aws.StringValue(msg.Body),
+	}
+	handle.log = logger.FromContext(ctx).With(logger.FieldMessageID, handle.msgId)
+	if v, ok := msg.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]; ok {
+		handle.receiveCount, _ = strconv.Atoi(aws.StringValue(v))
 	}
 	handle.Infof("Recieved message.")
 	handle.Debugf("receipt handle: %s", handle.msgReceiptHandle)
 	return handle
 }
 
+func (h *ReceiptHandle) MessageID() string {
+	if h == nil {
+		return ""
+	}
+	return h.msgId
+}
+
+// IsLastReceive returns true when the message will be moved to the dead letter queue, if it is not completed.
+func (h *ReceiptHandle) IsLastReceive() bool {
+	if h == nil {
+		return false
+	}
+	return h.maxReceiveCount > 0 && h.receiveCount >= h.maxReceiveCount
+}
+
+// WithLogFields returns the context which carries the message id for logging.
+func (h *ReceiptHandle) WithLogFields(ctx context.Context) context.Context {
+	if h == nil {
+		return ctx
+	}
+	return logger.WithFields(ctx, logger.FieldMessageID, h.msgId)
+}
+
 func (h *ReceiptHandle) Infof(format string, args ...interface{}) {
-	args = append([]interface{}{h.msgId}, args...)
-	logger.Infof("[%s]"+format, args...)
+	h.log.Infof(format, args...)
 }
 
 func (h *ReceiptHandle) Debugf(format string, args ...interface{}) {
-	args = append([]interface{}{h.msgId}, args...)
-	logger.Debugf("[%s]"+format, args...)
+	h.log.Debugf(format, args...)
 }
 
 func (h *ReceiptHandle) Errorf(format string, args ...interface{}) {
-	args = append([]interface{}{h.msgId}, args...)
-	logger.Errorf("[%s]"+format, args...)
+	h.log.Errorf(format, args...)
 }
 
-var policy = backoff.NewExponential(
-	backoff.WithInterval(500*time.Millisecond), // base interval
-	backoff.WithJitterFactor(0.05),             // 5% jitter
-	backoff.WithMaxRetries(5),                  // If not specified, default number of retries is 10
-)
+// setFailedJobs records the sources of the jobs failed or not run yet.
+// the records of them are routed to the failure queue, and completed records are not loaded again by replay.
+func (h *ReceiptHandle) setFailedJobs(jobs []*Job) {
+	if h == nil {
+		return
+	}
+	h.failedSources = make(map[string]bool, len(jobs))
+	for _, job := range jobs {
+		h.failedSources[job.Source.String()] = true
+	}
+}
+
+// failedBody returns the body of the message, which includes only records of the failed jobs.
+func (h *ReceiptHandle) failedBody() (string, error) {
+	if h.failedSources == nil {
+		return h.body, nil
+	}
+	var event events.S3Event
+	if err := json.Unmarshal([]byte(h.body), &event); err != nil {
+		return "", errors.Wrap(err, "body parse failed")
+	}
+	records := make([]events.S3EventRecord, 0, len(h.failedSources))
+	for _, record := range event.Records {
+		// the decoded key is not written to the body.
+		decoded := record
+		if h.failedSources[recordURL(&decoded).String()] {
+			records = append(records, record)
+		}
+	}
+	event.Records = records
+	b, err := json.Marshal(event)
+	if err != nil {
+		return "", errors.Wrap(err, "marshal body failed")
+	}
+	return string(b), nil
+}
 
 func (h *ReceiptHandle) Complete() error {
 	if h == nil {
@@ -172,31 +328,48 @@ func (h *ReceiptHandle) Complete() error {
 	}
 	h.Debugf("input is %#v", input)
 	svc := sqs.New(h.sess)
-	_, err := svc.DeleteMessage(input)
+	retry := h.retry
+	if retry == nil {
+		retry = (*RetryConfig)(nil).Option(RetryStageDeleteMessage)
+	}
+	i := 0
+	err := retry.do(context.Background(), func() error {
+		_, err := svc.DeleteMessage(input)
+		if err != nil {
+			h.Infof("Can't delete message (retry count = %d): %s", i, err)
+		}
+		i++
+		return err
+	}, func(error) bool { return true })
 	if err == nil {
 		h.isCompelete = true
+		metricMessagesCompleted.Inc()
 		h.Infof("Completed message.")
 		return nil
 	}
-
-	h.Infof("Can't delete message (retry count = 0): %s", err)
-	b, cancel := policy.Start(context.Background())
-	defer cancel()
-
-	for i := 1; backoff.Continue(b); i++ {
-		_, err = svc.DeleteMessage(input)
-		if err == nil {
-			h.isCompelete = true
-			h.Infof("Retry completed message.")
-			return nil
-		}
-		h.Infof("Can't delete message (retry count = %d): %s", i, err)
-	}
 	h.Infof("Can't delete message. ReceiptHandle: %s", h.msgReceiptHandle)
 	h.Errorf("Max retry count reached. Giving up. last error: %s", err)
 	return ErrMaxRetry
 }
 
+// Release makes the message visible immediately by changing the visibility timeout to 0, for retrying by other workers.
+func (h *ReceiptHandle) Release() error {
+	if h == nil || h.isCompelete {
+		return nil
+	}
+	svc := sqs.New(h.sess)
+	_, err := svc.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(h.queueURL),
+		ReceiptHandle:     aws.String(h.msgReceiptHandle),
+		VisibilityTimeout: aws.Int64(0),
+	})
+	if err != nil {
+		return errors.Wrap(err, "change message visibility failed")
+	}
+	h.Infof("Released message.")
+	return nil
+}
+
 func (h *ReceiptHandle) Cleanup() {
 	if h != nil && !h.isCompelete {
 		h.Infof("This message not completed, ReceiptHandle: %s", h.msgReceiptHandle)
@@ -3,6 +3,7 @@ package bqin_test
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/kayac/bqin"
 	"github.com/kayac/bqin/internal/logger"
@@ -54,6 +55,12 @@ func TestReceiver(t *testing.T) {
 		if urls[0].String() != "s3://bqin.bucket.test/data/user/snapshot_at=20200210/part-0001.csv" {
 			t.Errorf("unexpected url: %s", urls[0])
 		}
+		if !urls[0].EventTime.Equal(time.Unix(0, 0)) {
+			t.Errorf("unexpected event time: %s", urls[0].EventTime)
+		}
+		if urls[0].EventName != "ObjectCreated:Put" || urls[0].PrincipalID != "AIDAJDPLRKLG7UEXAMPLE" || urls[0].Size != 1024 {
+			t.Errorf("unexpected event attributes: %#v", urls[0])
+		}
 		handle.Complete()
 		handle.Cleanup()
 		if stubSQS.NumberOfMessagesDeleted != stubSQS.NumberOfMessagesReceived {
@@ -78,4 +85,47 @@ func TestReceiver(t *testing.T) {
 			t.Errorf("unexpected metrix: Deleted=%d, Received=%d", stubSQS.NumberOfMessagesDeleted, stubSQS.NumberOfMessagesDeleted)
 		}
 	})
+	t.Run("last receive", func(t *testing.T) {
+		stubSQS.ClearMetrix()
+		stubSQS.MaxReceiveCount = 2
+		defer func() { stubSQS.MaxReceiveCount = 0 }()
+		stubSQS.SendMessagesFromFile([]string{"testdata/sqs/user_not_found.json"})
+		receiver := factory.NewReceiver()
+		for i, expected := range []bool{false, true} {
+			_, handle, err := receiver.Receive(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if handle.IsLastReceive() != expected {
+				t.Errorf("receive[%d] unexpected last receive: %v", i, handle.IsLastReceive())
+			}
+			handle.Cleanup()
+		}
+	})
+	t.Run("queue attributes failed", func(t *testing.T) {
+		stubSQS.ClearMetrix()
+		stubSQS.MaxReceiveCount = 2
+		stubSQS.FailGetQueueAttributes = true
+		stubSQS.NumberOfGetQueueAttributes = 0
+		defer func() {
+			stubSQS.MaxReceiveCount = 0
+			stubSQS.FailGetQueueAttributes = false
+		}()
+		receiver := factory.NewReceiver()
+		for i := 0; i < 2; i++ {
+			stubSQS.SendMessagesFromFile([]string{"testdata/sqs/user.json"})
+			_, handle, err := receiver.Receive(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if handle.IsLastReceive() {
+				t.Errorf("receive[%d] must not be last receive without maxReceiveCount", i)
+			}
+			handle.Complete()
+			handle.Cleanup()
+		}
+		if n := stubSQS.NumberOfGetQueueAttributes; n != 1 {
+			t.Errorf("failure must be cached, but GetQueueAttributes is called %d times", n)
+		}
+	})
 }
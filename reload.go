@@ -0,0 +1,295 @@
+package bqin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/kayac/bqin/internal/logger"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DefaultReloadDebounce is the delay of reload after the config file changed, for editors writing a file several times.
+const DefaultReloadDebounce = 500 * time.Millisecond
+
+// RulesDiff is the difference of rules by reload.
+type RulesDiff struct {
+	Added   []string
+	Removed []string
+	// rules of same source and destination, but other settings are changed.
+	Changed []string
+	// previous and current match_policy, empty when not changed.
+	MatchPolicy [2]MatchPolicy
+}
+
+func (d *RulesDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0 && d.MatchPolicy[0] == d.MatchPolicy[1]
+}
+
+func (d *RulesDiff) String() string {
+	if d.IsEmpty() {
+		return "no changes of rules"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "added=%d removed=%d changed=%d", len(d.Added), len(d.Removed), len(d.Changed))
+	if d.MatchPolicy[0] != d.MatchPolicy[1] {
+		fmt.Fprintf(&b, " match_policy=%s->%s", d.MatchPolicy[0], d.MatchPolicy[1])
+	}
+	return b.String()
+}
+
+// Lines returns the diff as `+ rule`, `- rule` and `~ rule`.
+func (d *RulesDiff) Lines() []string {
+	lines := make([]string, 0, len(d.Added)+len(d.Removed)+len(d.Changed))
+	for _, r := range d.Removed {
+		lines = append(lines, "- "+r)
+	}
+	for _, r := range d.Added {
+		lines = append(lines, "+ "+r)
+	}
+	for _, r := range d.Changed {
+		lines = append(lines, "~ "+r)
+	}
+	return lines
+}
+
+func diffRules(prev, next []*Rule) (*RulesDiff, error) {
+	prevKeys, err := ruleKeys(prev)
+	if err != nil {
+		return nil, err
+	}
+	nextKeys, err := ruleKeys(next)
+	if err != nil {
+		return nil, err
+	}
+	// rules are compared by all settings, as multiset.
+	removed := subtractRules(prev, prevKeys, nextKeys)
+	added := subtractRules(next, nextKeys, prevKeys)
+
+	diff := &RulesDiff{}
+	// a pair of removed and added rules of same String() is changed.
+	pairs := make(map[string]int, len(removed))
+	for _, r := range removed {
+		pairs[r.String()]++
+	}
+	for _, r := range added {
+		if pairs[r.String()] > 0 {
+			pairs[r.String()]--
+			diff.Changed = append(diff.Changed, r.String())
+			continue
+		}
+		diff.Added = append(diff.Added, r.String())
+	}
+	for _, r := range removed {
+		if pairs[r.String()] > 0 {
+			pairs[r.String()]--
+			diff.Removed = append(diff.Removed, r.String())
+		}
+	}
+	return diff, nil
+}
+
+// subtractRules returns rules whose keys are not in others.
+func subtractRules(rules []*Rule, keys, others []string) []*Rule {
+	counts := make(map[string]int, len(others))
+	for _, k := range others {
+		counts[k]++
+	}
+	ret := make([]*Rule, 0)
+	for i, k := range keys {
+		if counts[k] > 0 {
+			counts[k]--
+			continue
+		}
+		ret = append(ret, rules[i])
+	}
+	return ret
+}
+
+func ruleKeys(rules []*Rule) ([]string, error) {
+	keys := make([]string, 0, len(rules))
+	for _, r := range rules {
+		bs, err := yaml.Marshal(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "marshal rule failed")
+		}
+		keys = append(keys, string(bs))
+	}
+	return keys, nil
+}
+
+// Reload swaps rules, match_policy and the catch-all rule of unmatched by the validated config.
+// other settings are not reloaded, and they require restart.
+func (app *App) Reload(conf *Config) (*RulesDiff, error) {
+	diff, err := diffRules(app.Rules(), conf.Rules)
+	if err != nil {
+		return nil, err
+	}
+	app.swapRules(conf, diff)
+	return diff, nil
+}
+
+func (app *App) swapRules(conf *Config, diff *RulesDiff) {
+	prev := app.MatchPolicy()
+	app.SetRules(conf.Rules, conf.MatchPolicy, conf.Unmatched.getCatchAllRule())
+	diff.MatchPolicy = [2]MatchPolicy{prev, app.MatchPolicy()}
+}
+
+// Reloadable swaps the rules by the validated config, such as App and MultiApp.
+type Reloadable interface {
+	Reload(conf *Config) (*RulesDiff, error)
+}
+
+// ConfigReloader reloads the config file, and swaps the rules of the app.
+// when the new config is invalid, the current config is kept.
+type ConfigReloader struct {
+	path string
+	app  Reloadable
+	// running is the config at startup, settings other than rules are kept as it until restart.
+	running *Config
+	// loaded is the config of the last successful reload.
+	loaded *Config
+	mu     sync.Mutex
+}
+
+func NewConfigReloader(path string, running *Config, app Reloadable) *ConfigReloader {
+	return &ConfigReloader{
+		path:    path,
+		app:     app,
+		running: running,
+		loaded:  running,
+	}
+}
+
+// Reload loads and validates the config file, and swaps the rules.
+func (r *ConfigReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	logger.Infof("[reload] reloading %s", r.path)
+	conf, err := LoadConfig(r.path)
+	if err != nil {
+		metricConfigReloads.WithLabelValues("failure").Inc()
+		return errors.Wrap(err, "reload failed, keep the current config")
+	}
+	diff, err := r.app.Reload(conf)
+	if err != nil {
+		metricConfigReloads.WithLabelValues("failure").Inc()
+		return errors.Wrap(err, "reload failed, keep the current config")
+	}
+	metricConfigReloads.WithLabelValues("success").Inc()
+	logger.Infof("[reload] reloaded: %s", diff)
+	for _, line := range diff.Lines() {
+		logger.Infof("[reload] %s", line)
+	}
+	if changed, err := r.requiresRestart(conf); err != nil {
+		logger.Warnf("[reload] compare config failed: %s", err)
+	} else if changed {
+		logger.Warnf("[reload] settings other than rules, rule_refs, match_policy and unmatched.rule are changed, they are applied after restart")
+	}
+	r.loaded = conf
+	return nil
+}
+
+// requiresRestart reports whether the settings not reloaded are changed since the last reload,
+// and differ from the running settings. each change is reported once, restoring them is not.
+func (r *ConfigReloader) requiresRestart(next *Config) (bool, error) {
+	changed, err := requiresRestart(r.loaded, next)
+	if err != nil || !changed {
+		return false, err
+	}
+	return requiresRestart(r.running, next)
+}
+
+// requiresRestart reports whether the settings not reloaded are changed.
+func requiresRestart(running, next *Config) (bool, error) {
+	a, err := marshalWithoutRules(running)
+	if err != nil {
+		return false, err
+	}
+	b, err := marshalWithoutRules(next)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(a, b), nil
+}
+
+func marshalWithoutRules(c *Config) ([]byte, error) {
+	dump := *c
+	dump.Rules = nil
+	dump.Rule = Rule{}
+	dump.MatchPolicy = ""
+	if c.Unmatched != nil {
+		unmatched := *c.Unmatched
+		unmatched.Rule = nil
+		dump.Unmatched = &unmatched
+	}
+	dump.Queues = make([]*QueueConfig, 0, len(c.Queues))
+	for _, q := range c.Queues {
+		queue := *q
+		queue.Rules = nil
+		queue.RuleRefs = nil
+		queue.MatchPolicy = ""
+		if q.Unmatched != nil {
+			unmatched := *q.Unmatched
+			unmatched.Rule = nil
+			queue.Unmatched = &unmatched
+		}
+		dump.Queues = append(dump.Queues, &queue)
+	}
+	bs, err := yaml.Marshal(&dump)
+	return bs, errors.Wrap(err, "marshal config failed")
+}
+
+// Watch reloads the config when the config file is changed, until ctx is done.
+// the directory of the file is watched, for editors replacing the file by rename.
+func (r *ConfigReloader) Watch(ctx context.Context, debounce time.Duration) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "create watcher failed")
+	}
+	defer watcher.Close()
+	target, err := filepath.Abs(r.path)
+	if err != nil {
+		return errors.Wrap(err, "watch config failed")
+	}
+	if err := watcher.Add(filepath.Dir(target)); err != nil {
+		return errors.Wrap(err, "watch config failed")
+	}
+	logger.Infof("[reload] watching %s", r.path)
+
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if name, err := filepath.Abs(event.Name); err != nil || name != target {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			logger.Debugf("[reload] %s", event)
+			timer = time.After(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			logger.Warnf("[reload] watch error: %s", err)
+		case <-timer:
+			timer = nil
+			if err := r.Reload(); err != nil {
+				logger.Errorf("[reload] %s", err)
+			}
+		}
+	}
+}
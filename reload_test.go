@@ -0,0 +1,250 @@
+package bqin_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kayac/bqin"
+	"github.com/kayac/bqin/internal/logger"
+)
+
+const reloadBaseConfig = `queue_name: s3_to_bq
+s3:
+  bucket: bqin.bucket.test
+  region: ap-northeast-1
+big_query:
+  project_id: bqin-test-gcp
+  dataset: test
+option:
+  temporary_bucket: bqin-import-tmp
+  source_format: csv
+`
+
+func writeReloadConfig(t *testing.T, path, rules string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(reloadBaseConfig+rules), 0644); err != nil {
+		t.Fatalf("write config failed: %s", err)
+	}
+}
+
+func resolveTables(t *testing.T, app *bqin.App, raw string) []string {
+	t.Helper()
+	jobs, err := app.Resolve(context.Background(), []*bqin.S3Record{MustParseRecord(raw)})
+	if err != nil {
+		t.Fatalf("unexpected resolve error: %s", err)
+	}
+	tables := make([]string, 0, len(jobs))
+	for _, job := range jobs {
+		tables = append(tables, job.LoadingDestination.String())
+	}
+	return tables
+}
+
+func TestConfigReload(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	os.Setenv("AWS_REGION", "ap-northeast-1")
+
+	dir, err := ioutil.TempDir("", "bqin-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	writeReloadConfig(t, path, `rules:
+  - big_query:
+      table: user
+    s3:
+      key_prefix: data/user
+  - big_query:
+      table: item
+    s3:
+      key_prefix: data/item
+`)
+	conf, err := bqin.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error :%s", err)
+	}
+	app := bqin.NewApp(conf)
+	reloader := bqin.NewConfigReloader(path, conf, app)
+
+	writeReloadConfig(t, path, `match_policy: first
+rules:
+  - big_query:
+      table: user
+    s3:
+      key_prefix: data/user
+  - big_query:
+      table: item
+    s3:
+      key_prefix: data/item
+    option:
+      gzip: true
+  - big_query:
+      table: log
+    s3:
+      key_prefix: logs/
+`)
+	next, err := bqin.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error :%s", err)
+	}
+	diff, err := app.Reload(next)
+	if err != nil {
+		t.Fatalf("unexpected reload error :%s", err)
+	}
+	t.Log(diff)
+	expected := []string{
+		"+ s3://bqin.bucket.test/logs/ => bqin-test-gcp.test.log",
+		"~ s3://bqin.bucket.test/data/item => bqin-test-gcp.test.item",
+	}
+	if !reflect.DeepEqual(diff.Lines(), expected) {
+		t.Errorf("unexpected diff: %#v", diff.Lines())
+	}
+	if diff.MatchPolicy != [2]bqin.MatchPolicy{bqin.MatchAll, bqin.MatchFirst} {
+		t.Errorf("unexpected match_policy diff: %v", diff.MatchPolicy)
+	}
+	if tables := resolveTables(t, app, "s3://bqin.bucket.test/logs/access.log"); !reflect.DeepEqual(tables, []string{"bqin-test-gcp.test.log"}) {
+		t.Errorf("unexpected tables after reload: %v", tables)
+	}
+
+	// invalid config is not applied
+	writeReloadConfig(t, path, `rules:
+  - big_query:
+      table: user
+    s3:
+      key_regexp: data/(user
+`)
+	if err := reloader.Reload(); err == nil {
+		t.Error("reload of invalid config must be failed")
+	}
+	if n := len(app.Rules()); n != 3 {
+		t.Errorf("rules must be kept, but %d rules", n)
+	}
+
+	writeReloadConfig(t, path, `rules:
+  - big_query:
+      table: item
+    s3:
+      key_prefix: data/item
+`)
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("unexpected reload error :%s", err)
+	}
+	if tables := resolveTables(t, app, "s3://bqin.bucket.test/data/user/part-0001.csv"); len(tables) != 0 {
+		t.Errorf("removed rule must not be matched: %v", tables)
+	}
+}
+
+func TestConfigReloaderRestartWarning(t *testing.T) {
+	var buf bytes.Buffer
+	logger.Setup(&buf, logger.InfoLevel)
+	defer logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	os.Setenv("AWS_REGION", "ap-northeast-1")
+
+	dir, err := ioutil.TempDir("", "bqin-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	rules := `rules:
+  - big_query:
+      table: user
+    s3:
+      key_prefix: data/user
+`
+	writeReloadConfig(t, path, rules)
+	conf, err := bqin.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error :%s", err)
+	}
+	reloader := bqin.NewConfigReloader(path, conf, bqin.NewApp(conf))
+
+	cases := []struct {
+		Comment  string
+		Settings string
+		Warnings int
+	}{
+		{Comment: "changed", Settings: "failure_queue_name: failure\n", Warnings: 1},
+		{Comment: "not changed since the last reload", Settings: "failure_queue_name: failure\n", Warnings: 1},
+		{Comment: "restored", Settings: "", Warnings: 1},
+		{Comment: "changed again", Settings: "failure_queue_name: failure\n", Warnings: 2},
+	}
+	for _, c := range cases {
+		writeReloadConfig(t, path, c.Settings+rules)
+		if err := reloader.Reload(); err != nil {
+			t.Fatalf("unexpected reload error :%s", err)
+		}
+		if n := strings.Count(buf.String(), "applied after restart"); n != c.Warnings {
+			t.Errorf("%s: unexpected warnings: %d", c.Comment, n)
+		}
+	}
+}
+
+func TestConfigReloaderWatch(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	os.Setenv("AWS_REGION", "ap-northeast-1")
+
+	dir, err := ioutil.TempDir("", "bqin-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	writeReloadConfig(t, path, `rules:
+  - big_query:
+      table: user
+    s3:
+      key_prefix: data/user
+`)
+	conf, err := bqin.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error :%s", err)
+	}
+	app := bqin.NewApp(conf)
+	reloader := bqin.NewConfigReloader(path, conf, app)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- reloader.Watch(ctx, 10*time.Millisecond)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("unexpected watch error: %s", err)
+		}
+	}()
+	// wait for the watcher to start
+	time.Sleep(100 * time.Millisecond)
+
+	// replace the file by rename, as editors do
+	tmp := filepath.Join(dir, "config.yaml.tmp")
+	writeReloadConfig(t, tmp, `rules:
+  - big_query:
+      table: user
+    s3:
+      key_prefix: data/user
+  - big_query:
+      table: item
+    s3:
+      key_prefix: data/item
+`)
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for len(app.Rules()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("rules are not reloaded: %d rules", len(app.Rules()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
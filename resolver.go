@@ -1,78 +1,473 @@
 package bqin
 
 import (
+	"context"
 	"fmt"
 	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
 
 	"github.com/kayac/bqin/internal/logger"
+	"github.com/pkg/errors"
 )
 
+type MatchPolicy string
+
+const (
+	// MatchAll creates jobs for all matched rules.
+	MatchAll MatchPolicy = "all"
+	// MatchFirst creates a job only for the first matched rule, unless the rule has `continue: true`.
+	MatchFirst MatchPolicy = "first"
+)
+
+func (p MatchPolicy) IsSupport() bool {
+	return p == "" || p == MatchAll || p == MatchFirst
+}
+
 type Resolver struct {
-	rules []*Rule
+	// *ruleSet, swapped atomically by SetRules.
+	ruleSet atomic.Value
+
+	unmatched *unmatchedCounter
+
+	//for fetching object attributes, when rules require them.
+	inspector *Inspector
+}
+
+// ruleSet is the rules resolving a message, the message is resolved by a ruleSet even if the rules are swapped.
+type ruleSet struct {
+	// rules are sorted by priority.
+	rules  []*Rule
+	policy MatchPolicy
+	// rules in config order, and index of them.
+	config []*Rule
+	index  map[*Rule]int
+
+	// catchAll is evaluated only when no rules matched, for unmatched.action catch_all.
+	catchAll *Rule
+}
+
+func newRuleSet(rules []*Rule, policy MatchPolicy, catchAll *Rule) *ruleSet {
+	sorted := make([]*Rule, len(rules))
+	copy(sorted, rules)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority > sorted[j].Priority
+	})
+	if policy == "" {
+		policy = MatchAll
+	}
+	config := make([]*Rule, len(rules))
+	copy(config, rules)
+	index := make(map[*Rule]int, len(rules))
+	for i, rule := range rules {
+		index[rule] = i
+	}
+	return &ruleSet{
+		rules:    sorted,
+		policy:   policy,
+		config:   config,
+		index:    index,
+		catchAll: catchAll,
+	}
 }
 
-func NewResolver(rules []*Rule) *Resolver {
-	return &Resolver{
-		rules: rules,
+func NewResolver(rules []*Rule, policy MatchPolicy, inspector *Inspector) *Resolver {
+	r := &Resolver{
+		inspector: inspector,
+		unmatched: newUnmatchedCounter(),
 	}
+	r.ruleSet.Store(newRuleSet(rules, policy, nil))
+	return r
 }
 
-func (r *Resolver) Resolve(urls []*url.URL) []*Job {
-	ret := make([]*Job, 0, len(urls))
-	for _, u := range urls {
-		logger.Debugf("check url :%s", u.String())
-		for _, rule := range r.rules {
-			ok, capture := rule.Match(u)
-			if !ok {
-				continue
+func (r *Resolver) current() *ruleSet {
+	return r.ruleSet.Load().(*ruleSet)
+}
+
+func (r *Resolver) SetCatchAllRule(rule *Rule) {
+	rs := *r.current()
+	rs.catchAll = rule
+	r.ruleSet.Store(&rs)
+}
+
+// SetRules swaps the rules, match_policy and the catch-all rule atomically.
+// messages in process are resolved by the previous rules.
+func (r *Resolver) SetRules(rules []*Rule, policy MatchPolicy, catchAll *Rule) {
+	r.ruleSet.Store(newRuleSet(rules, policy, catchAll))
+}
+
+// Rules returns the current rules in config order.
+func (r *Resolver) Rules() []*Rule {
+	return r.current().config
+}
+
+// MatchPolicy returns the current match_policy.
+func (r *Resolver) MatchPolicy() MatchPolicy {
+	return r.current().policy
+}
+
+// Resolve returns jobs of records.
+func (r *Resolver) Resolve(ctx context.Context, records []*S3Record) ([]*Job, error) {
+	jobs, _, err := r.ResolveWithUnmatched(ctx, records)
+	return jobs, err
+}
+
+// ResolveWithUnmatched returns jobs, and records which are matched to neither rules nor catch-all rule.
+// unmatched objects are not counted, they are counted by CountUnmatched only when the message is processed.
+func (r *Resolver) ResolveWithUnmatched(ctx context.Context, records []*S3Record) ([]*Job, []*S3Record, error) {
+	rs := r.current()
+	ret := make([]*Job, 0, len(records))
+	unmatched := make([]*S3Record, 0)
+	for _, u := range records {
+		matches, err := r.match(ctx, rs, u)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(matches) == 0 {
+			unmatched = append(unmatched, u)
+			continue
+		}
+		for _, m := range matches {
+			job, err := newJob(m.rule, u, m.capture, m.obj)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "resolve %s failed", u)
 			}
-			logger.Debugf("match rule: %s", rule.String())
-			ret = append(ret, newJob(rule, u, capture))
+			job.catchAll = m.rule == rs.catchAll
+			ret = append(ret, job)
+			if rs.policy == MatchFirst && !m.rule.Continue {
+				break
+			}
+		}
+	}
+	return ret, unmatched, nil
+}
+
+// CountUnmatched counts objects matched to no rules by the key prefix,
+// unmatched records and records routed to the catch-all rule.
+func (r *Resolver) CountUnmatched(ctx context.Context, unmatched []*S3Record, jobs []*Job) {
+	for _, u := range unmatched {
+		r.unmatched.add(ctx, u)
+	}
+	for _, job := range jobs {
+		if job.catchAll {
+			r.unmatched.add(ctx, NewS3Record(job.Source))
 		}
 	}
-	return ret
+}
+
+// MatchedRules returns all rules matched to the record in evaluation order, regardless of match_policy.
+func (r *Resolver) MatchedRules(ctx context.Context, record *S3Record) ([]*Rule, error) {
+	matches, err := r.match(ctx, r.current(), record)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*Rule, 0, len(matches))
+	for _, m := range matches {
+		ret = append(ret, m.rule)
+	}
+	return ret, nil
+}
+
+// RuleMatch is the rule matched to the object, and the job by the rule.
+type RuleMatch struct {
+	// Index is the index of the rule in config, -1 for the catch-all rule.
+	Index int    `json:"index"`
+	Rule  string `json:"rule"`
+	// Captures are captures of the key pattern by index and name, such as {"0": ..., "1": "user", "table": "user"}.
+	Captures     map[string]string   `json:"captures"`
+	Destination  *LoadingDestination `json:"destination"`
+	TemporaryURI string              `json:"temporary_uri"`
+	Option       *JobOption          `json:"option"`
+	// Resolved is false when the job is not created by match_policy first.
+	Resolved bool `json:"resolved"`
+}
+
+// Explain returns all rules matched to the record in evaluation order with the jobs, regardless of match_policy.
+func (r *Resolver) Explain(ctx context.Context, record *S3Record) ([]*RuleMatch, error) {
+	rs := r.current()
+	matches, err := r.match(ctx, rs, record)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*RuleMatch, 0, len(matches))
+	resolved := true
+	for _, m := range matches {
+		job, err := newJob(m.rule, record, m.capture, m.obj)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolve %s failed", record)
+		}
+		index, ok := rs.index[m.rule]
+		if !ok {
+			index = -1
+		}
+		ret = append(ret, &RuleMatch{
+			Index:        index,
+			Rule:         m.rule.String(),
+			Captures:     m.rule.namedCaptures(m.capture),
+			Destination:  job.LoadingDestination,
+			TemporaryURI: job.TransportJob.Destination.String(),
+			Option:       m.rule.Option,
+			Resolved:     resolved,
+		})
+		if rs.policy == MatchFirst && !m.rule.Continue {
+			resolved = false
+		}
+	}
+	return ret, nil
+}
+
+type ruleMatch struct {
+	rule    *Rule
+	capture []string
+	obj     *objectRef
+}
+
+// match returns matched rules, or the catch-all rule when no rules matched.
+func (r *Resolver) match(ctx context.Context, rs *ruleSet, u *S3Record) ([]*ruleMatch, error) {
+	logger.FromContext(ctx).Debugf("check url :%s", u.String())
+	obj := &objectRef{ctx: ctx, inspector: r.inspector, loc: u.URL}
+	ret, err := r.matchRules(ctx, u, obj, rs.rules)
+	if err != nil || len(ret) != 0 {
+		return ret, err
+	}
+	if rs.catchAll == nil {
+		return ret, nil
+	}
+	logger.FromContext(ctx).Debugf("no rules matched, try catch-all rule")
+	return r.matchRules(ctx, u, obj, []*Rule{rs.catchAll})
+}
+
+func (r *Resolver) matchRules(ctx context.Context, u *S3Record, obj *objectRef, rules []*Rule) ([]*ruleMatch, error) {
+	ret := make([]*ruleMatch, 0, 1)
+	for _, rule := range rules {
+		ok, capture := rule.matchURL(ctx, u.URL)
+		if !ok {
+			continue
+		}
+		ok, err := rule.matchObject(ctx, obj)
+		if err != nil {
+			return nil, errors.Wrapf(err, "match object %s failed", u)
+		}
+		if !ok {
+			continue
+		}
+		ok, err = rule.matchCondition(ctx, &placeHolder{
+			record:   u,
+			capture:  capture,
+			captures: rule.namedCaptures(capture),
+			obj:      obj,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "evaluate condition for %s failed", u)
+		}
+		if !ok {
+			continue
+		}
+		logger.FromContext(ctx).Debugf("match rule: %s", rule.String())
+		ret = append(ret, &ruleMatch{rule: rule, capture: capture, obj: obj})
+	}
+	return ret, nil
 }
 
 type Job struct {
+	// Rule is the source pattern of the matched rule.
+	Rule string
+
 	*TransportJob
 	*LoadingJob
+
+	PreLoad *PreLoadOption
+
+	// catchAll is true when the job is routed to the catch-all rule.
+	catchAll bool
 }
 
-func newJob(r *Rule, u *url.URL, capture []string) *Job {
+func newJob(r *Rule, u *S3Record, capture []string, obj *objectRef) (*Job, error) {
+	ph := &placeHolder{
+		record:   u,
+		capture:  capture,
+		captures: r.namedCaptures(capture),
+		obj:      obj,
+	}
+	bucket, err := ph.expand(r.Option.TemporaryBucket)
+	if err != nil {
+		return nil, errors.Wrap(err, "expand temporary_bucket failed")
+	}
 	temp := &url.URL{
 		Scheme: "gs",
-		Host:   expandPlaceHolder(r.Option.TemporaryBucket, capture),
+		Host:   bucket,
 		Path:   u.Path,
 	}
-	dest := &LoadingDestination{
-		ProjectID: expandPlaceHolder(r.BigQuery.ProjectID, capture),
-		Dataset:   expandPlaceHolder(r.BigQuery.Dataset, capture),
-		Table:     expandPlaceHolder(r.BigQuery.Table, capture),
+	dest := &LoadingDestination{}
+	if dest.ProjectID, err = ph.expand(r.BigQuery.ProjectID); err != nil {
+		return nil, errors.Wrap(err, "expand project_id failed")
+	}
+	if dest.Dataset, err = ph.expand(r.BigQuery.Dataset); err != nil {
+		return nil, errors.Wrap(err, "expand dataset failed")
+	}
+	if dest.Table, err = ph.expand(r.BigQuery.Table); err != nil {
+		return nil, errors.Wrap(err, "expand table failed")
 	}
 	loadingJob := NewLoadingJob(dest, temp.String())
 	loadingJob.GCSRef.Compression = r.Option.getCompression()
 	loadingJob.GCSRef.AutoDetect = r.Option.getAutoDetect()
 	loadingJob.GCSRef.SourceFormat = r.Option.getSourceFormat()
+	// captured values are not parsed as template, they are expanded when the query runs.
+	for _, q := range r.PostLoad.getQueries() {
+		loadingJob.PostLoadQueries = append(loadingJob.PostLoadQueries, captureActions(q, capture))
+	}
+	loadingJob.Captures = ph.captures
+	loadingJob.IgnorePostLoadError = r.PostLoad.getIgnoreError()
+	loadingJob.Retry = r.Retry
 
 	return &Job{
+		Rule: r.S3.String(),
 		TransportJob: &TransportJob{
-			Source:      u,
+			Source:      u.URL,
 			Destination: temp,
+			Retry:       r.Retry,
 		},
 		LoadingJob: loadingJob,
-	}
+		PreLoad:    r.PreLoad,
+	}, nil
 }
 
 func (job *Job) String() string {
 	return fmt.Sprintf(`%s, and %s`, job.TransportJob, job.LoadingJob)
 }
 
-// example: when capture []string{"hoge"},  table_$1 => table_hoge
-func expandPlaceHolder(s string, capture []string) string {
-	for i, v := range capture {
-		s = strings.Replace(s, "$"+strconv.Itoa(i), v, -1)
+// placeHolder is the data for expanding bigquery destination and temporary bucket.
+// example: {{ .Captures.date }}, {{ .EventTime | date "20060102" }}, {{ .Metadata.dataset }}, {{ .Tags.dataset }}
+type placeHolder struct {
+	record   *S3Record
+	capture  []string
+	captures map[string]string
+	obj      *objectRef
+}
+
+func (p *placeHolder) Bucket() string {
+	return p.record.Host
+}
+
+func (p *placeHolder) Key() string {
+	return strings.TrimPrefix(p.record.Path, "/")
+}
+
+func (p *placeHolder) Captures() map[string]string {
+	return p.captures
+}
+
+func (p *placeHolder) EventTime() time.Time {
+	return p.record.EventTime
+}
+
+func (p *placeHolder) Metadata() (map[string]string, error) {
+	info, err := p.obj.Info()
+	if err != nil {
+		return nil, err
+	}
+	return info.Metadata, nil
+}
+
+func (p *placeHolder) Tags() (map[string]string, error) {
+	return p.obj.Tags()
+}
+
+func (p *placeHolder) ContentType() (string, error) {
+	info, err := p.obj.Info()
+	if err != nil {
+		return "", err
+	}
+	return info.ContentType, nil
+}
+
+func (p *placeHolder) Size() (int64, error) {
+	if p.record.Size > 0 {
+		return p.record.Size, nil
+	}
+	info, err := p.obj.Info()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (p *placeHolder) expand(s string) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return expandPlaceHolder(s, p.capture), nil
+	}
+	s = captureActions(s, p.capture)
+	tmpl, err := parsePlaceHolderTemplate(s)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, p); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+var placeHolderFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+	// example: {{ .Key | replace "/" "_" }}
+	"replace": func(old, new, s string) string {
+		return strings.Replace(s, old, new, -1)
+	},
+	// example: {{ .Captures.date | parseDate "2006-01-02" | date "20060102" }}
+	"parseDate": func(layout, s string) (time.Time, error) {
+		return time.Parse(layout, s)
+	},
+	"date": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+	// example: {{ .Captures.name | sanitize }}, `user-log.2020` => `user_log_2020`
+	"sanitize": sanitizeBigQueryIdentifier,
+}
+
+func parsePlaceHolderTemplate(s string) (*template.Template, error) {
+	return template.New("placeholder").Funcs(placeHolderFuncs).Option("missingkey=error").Parse(s)
+}
+
+var invalidIdentifierRegexp = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+const maxBigQueryIdentifierLength = 1024
+
+func sanitizeBigQueryIdentifier(s string) string {
+	s = invalidIdentifierRegexp.ReplaceAllString(s, "_")
+	if len(s) > maxBigQueryIdentifierLength {
+		s = s[:maxBigQueryIdentifierLength]
 	}
 	return s
 }
+
+var placeHolderRegexp = regexp.MustCompile(`\$[0-9]+`)
+
+// captureActions rewrites `$N` as template action, for capture values are not parsed as template.
+// example: table_$1 => table_{{ index .Captures "1" }}
+func captureActions(s string, capture []string) string {
+	return placeHolderRegexp.ReplaceAllStringFunc(s, func(v string) string {
+		if i, _ := strconv.Atoi(v[1:]); i < len(capture) {
+			return `{{ index .Captures "` + v[1:] + `" }}`
+		}
+		return v
+	})
+}
+
+// example: when capture []string{"hoge"},  table_$1 => table_hoge
+// `$10` is not expanded as `$1` and `0`.
+func expandPlaceHolder(s string, capture []string) string {
+	return placeHolderRegexp.ReplaceAllStringFunc(s, func(v string) string {
+		if i, _ := strconv.Atoi(v[1:]); i < len(capture) {
+			return capture[i]
+		}
+		return v
+	})
+}
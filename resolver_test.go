@@ -1,13 +1,16 @@
 package bqin_test
 
 import (
+	"context"
 	"reflect"
 	"sort"
 	"testing"
-	"net/url"
+	"time"
 
 	"github.com/kayac/bqin"
 	"github.com/kayac/bqin/internal/logger"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/kayac/bqin/internal/stub"
 )
 
 func TestResolver(t *testing.T) {
@@ -20,19 +23,22 @@ func TestResolver(t *testing.T) {
 	factory := &bqin.Factory{Config: conf}
 	resolver := factory.NewResolver()
 
-	jobs := resolver.Resolve([]*url.URL{
-		MustParseURL("s3://dummy/dummy.txt"),
-		MustParseURL("s3://bqin.bucket.test/dummy.txt"),
-		MustParseURL("s3://bqin.bucket.test/data/user.txt"),
-		MustParseURL("s3://bqin.bucket.test/data/hoge/part-0001.csv"),
-		MustParseURL("s3://bqin.bucket.test/data/hoge/xxxx.txt"),
+	jobs, err := resolver.Resolve(context.Background(), []*bqin.S3Record{
+		MustParseRecord("s3://dummy/dummy.txt"),
+		MustParseRecord("s3://bqin.bucket.test/dummy.txt"),
+		MustParseRecord("s3://bqin.bucket.test/data/user.txt"),
+		MustParseRecord("s3://bqin.bucket.test/data/hoge/part-0001.csv"),
+		MustParseRecord("s3://bqin.bucket.test/data/hoge/xxxx.txt"),
 	})
+	if err != nil {
+		t.Fatalf("unexpected resolve error: %s", err)
+	}
 	actual := make([]string, 0, len(jobs))
 	for _, j := range jobs {
 		actual = append(actual, j.String())
 	}
-	sort.Slice(actual, func(i,j int) bool { return actual[i] < actual[j]})
-	expected := []string {
+	sort.Slice(actual, func(i, j int) bool { return actual[i] < actual[j] })
+	expected := []string{
 		"transport from s3://bqin.bucket.test/data/hoge/part-0001.csv to gs://bqin-import-tmp/data/hoge/part-0001.csv, and load to bqin-test-gcp.test.hoge_0001",
 		"transport from s3://bqin.bucket.test/data/user.txt to gs://bqin-import-tmp/data/user.txt, and load to bqin-test-gcp.test.user",
 	}
@@ -43,3 +49,362 @@ func TestResolver(t *testing.T) {
 	}
 }
 
+func TestResolverWithObjectAttributes(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	stubS3 := stub.NewStubS3("testdata/s3/")
+	defer stubS3.Close()
+
+	conf, err := bqin.LoadConfig("testdata/config/object_attributes.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	conf.Cloud.AWS = &bqin.AWS{
+		Region:           "local",
+		DisableSSL:       true,
+		S3ForcePathStyle: true,
+		S3Endpoint:       stubS3.Endpoint(),
+		AccessKeyID:      "AWS_ACCESS_KEY_ID",
+		SecretAccessKey:  "AWS_SECRET_ACCESS_KEY",
+	}
+	factory := &bqin.Factory{Config: conf}
+	resolver := factory.NewResolver()
+
+	jobs, err := resolver.Resolve(context.Background(), []*bqin.S3Record{
+		MustParseRecord("s3://bqin.bucket.test/data/user/snapshot_at=20200210/part-0001.csv"),
+		MustParseRecord("s3://bqin.bucket.test/data/user/snapshot_at=20200210/_SUCCESS"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected resolve error: %s", err)
+	}
+	actual := make([]string, 0, len(jobs))
+	for _, j := range jobs {
+		actual = append(actual, j.String())
+	}
+	expected := []string{
+		"transport from s3://bqin.bucket.test/data/user/snapshot_at=20200210/part-0001.csv to gs://bqin-import-tmp/data/user/snapshot_at=20200210/part-0001.csv, and load to bqin-test-gcp.member.user_v2",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Logf("actual:   %v", actual)
+		t.Logf("expected: %v", expected)
+		t.Error("unexpected job strings")
+	}
+
+	_, err = resolver.Resolve(context.Background(), []*bqin.S3Record{
+		MustParseRecord("s3://bqin.bucket.test/data/user/not_found.csv"),
+	})
+	if err == nil {
+		t.Error("resolve not found object must be failed")
+	}
+}
+
+func TestResolverWithCondition(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	stubS3 := stub.NewStubS3("testdata/s3/")
+	defer stubS3.Close()
+
+	conf, err := bqin.LoadConfig("testdata/config/when.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	conf.Cloud.AWS = &bqin.AWS{
+		Region:           "local",
+		DisableSSL:       true,
+		S3ForcePathStyle: true,
+		S3Endpoint:       stubS3.Endpoint(),
+		AccessKeyID:      "AWS_ACCESS_KEY_ID",
+		SecretAccessKey:  "AWS_SECRET_ACCESS_KEY",
+	}
+	factory := &bqin.Factory{Config: conf}
+	resolver := factory.NewResolver()
+
+	cases := []struct {
+		url         string
+		size        int64
+		principalID string
+		eventTime   time.Time
+		expected    []string
+	}{
+		{
+			url:         "s3://bqin.bucket.test/data/user/snapshot_at=20200210/part-0001.csv",
+			size:        1024,
+			principalID: "AIDAJDPLRKLG7UEXAMPLE",
+			eventTime:   time.Date(2020, 2, 10, 12, 0, 0, 0, time.UTC),
+			expected:    []string{"bqin-test-gcp.test.user_large", "bqin-test-gcp.test.user_v2"},
+		},
+		{
+			url:         "s3://bqin.bucket.test/data/user/snapshot_at=20200210/part-0001.csv",
+			size:        10,
+			principalID: "AIDAJDPLRKLG7UEXAMPLE",
+			eventTime:   time.Date(2020, 2, 8, 3, 0, 0, 0, time.UTC),
+			expected:    []string{"bqin-test-gcp.test.user_v2", "bqin-test-gcp.test.user_weekend"},
+		},
+		{
+			url:         "s3://bqin.bucket.test/data/user/snapshot_at=20200210/_SUCCESS",
+			size:        2048,
+			principalID: "AROAEXAMPLE:other",
+			eventTime:   time.Date(2020, 2, 10, 12, 0, 0, 0, time.UTC),
+			expected:    []string{},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.url, func(t *testing.T) {
+			record := MustParseRecord(c.url)
+			record.Size = c.size
+			record.PrincipalID = c.principalID
+			record.EventTime = c.eventTime
+			jobs, err := resolver.Resolve(context.Background(), []*bqin.S3Record{record})
+			if err != nil {
+				t.Fatalf("unexpected resolve error: %s", err)
+			}
+			actual := make([]string, 0, len(jobs))
+			for _, j := range jobs {
+				actual = append(actual, j.LoadingDestination.String())
+			}
+			if !reflect.DeepEqual(actual, c.expected) {
+				t.Logf("actual:   %v", actual)
+				t.Logf("expected: %v", c.expected)
+				t.Error("unexpected destinations")
+			}
+		})
+	}
+}
+
+func TestResolverWithTemplate(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+
+	conf, err := bqin.LoadConfig("testdata/config/template.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	factory := &bqin.Factory{Config: conf}
+	resolver := factory.NewResolver()
+
+	eventTime := time.Date(2020, 2, 10, 12, 0, 0, 0, time.UTC)
+	records := []*bqin.S3Record{
+		MustParseRecord("s3://bqin.bucket.test/data/user/snapshot_at=20200210/part-0001.csv"),
+		MustParseRecord("s3://bqin.bucket.test/char/abcdefghij.csv"),
+		MustParseRecord("s3://bqin.bucket.test/logs/access-log.2020.csv"),
+	}
+	for _, r := range records {
+		r.EventTime = eventTime
+	}
+	jobs, err := resolver.Resolve(context.Background(), records)
+	if err != nil {
+		t.Fatalf("unexpected resolve error: %s", err)
+	}
+	actual := make([]string, 0, len(jobs))
+	for _, j := range jobs {
+		actual = append(actual, j.LoadingJob.String())
+	}
+	expected := []string{
+		"load to bqin-test-gcp.test.USER_2020",
+		"load to bqin-test-gcp.test.t_j_a",
+		"load to bqin-test-gcp.bqin_bucket_test.access_log_2020_csv_20200210",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Logf("actual:   %v", actual)
+		t.Logf("expected: %v", expected)
+		t.Error("unexpected job strings")
+	}
+}
+
+func TestResolverWithMatchPolicy(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+
+	conf, err := bqin.LoadConfig("testdata/config/match_policy_first.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	factory := &bqin.Factory{Config: conf}
+	resolver := factory.NewResolver()
+
+	cases := []struct {
+		URL          string
+		Expected     []string
+		MatchedRules int
+	}{
+		{
+			URL:          "s3://bqin.bucket.test/data/user/part-0001.csv",
+			Expected:     []string{"load to bqin-test-gcp.test.archive", "load to bqin-test-gcp.test.user_0001"},
+			MatchedRules: 3,
+		},
+		{
+			URL:          "s3://bqin.bucket.test/data/item/part-0001.csv",
+			Expected:     []string{"load to bqin-test-gcp.test.item_0001"},
+			MatchedRules: 2,
+		},
+		{
+			URL:          "s3://bqin.bucket.test/data/item/part-0001.json",
+			Expected:     []string{"load to bqin-test-gcp.test.all"},
+			MatchedRules: 1,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.URL, func(t *testing.T) {
+			record := MustParseRecord(c.URL)
+			jobs, err := resolver.Resolve(context.Background(), []*bqin.S3Record{record})
+			if err != nil {
+				t.Fatalf("unexpected resolve error: %s", err)
+			}
+			actual := make([]string, 0, len(jobs))
+			for _, j := range jobs {
+				actual = append(actual, j.LoadingJob.String())
+			}
+			if !reflect.DeepEqual(actual, c.Expected) {
+				t.Logf("actual:   %v", actual)
+				t.Logf("expected: %v", c.Expected)
+				t.Error("unexpected job strings")
+			}
+			rules, err := resolver.MatchedRules(context.Background(), record)
+			if err != nil {
+				t.Fatalf("unexpected match error: %s", err)
+			}
+			if len(rules) != c.MatchedRules {
+				t.Errorf("unexpected matched rules count: %d", len(rules))
+			}
+		})
+	}
+}
+
+func TestResolverExplain(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+
+	conf, err := bqin.LoadConfig("testdata/config/match_policy_first.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	factory := &bqin.Factory{Config: conf}
+	resolver := factory.NewResolver()
+
+	matches, err := resolver.Explain(context.Background(), MustParseRecord("s3://bqin.bucket.test/data/user/part-0001.csv"))
+	if err != nil {
+		t.Fatalf("unexpected explain error: %s", err)
+	}
+	type explained struct {
+		Index       int
+		Destination string
+		Resolved    bool
+	}
+	actual := make([]explained, 0, len(matches))
+	for _, m := range matches {
+		actual = append(actual, explained{m.Index, m.Destination.String(), m.Resolved})
+	}
+	expected := []explained{
+		{2, "bqin-test-gcp.test.archive", true},
+		{1, "bqin-test-gcp.test.user_0001", true},
+		{0, "bqin-test-gcp.test.all", false},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected matches: %s", pretty.Compare(actual, expected))
+	}
+	m := matches[1]
+	if m.Captures["1"] != "user" || m.Captures["2"] != "0001" {
+		t.Errorf("unexpected captures: %v", m.Captures)
+	}
+	if m.TemporaryURI != "gs://bqin-import-tmp/data/user/part-0001.csv" {
+		t.Errorf("unexpected temporary uri: %s", m.TemporaryURI)
+	}
+	if m.Option == nil || m.Option.TemporaryBucket != "bqin-import-tmp" {
+		t.Errorf("unexpected option: %#v", m.Option)
+	}
+
+	matches, err = resolver.Explain(context.Background(), MustParseRecord("s3://bqin.bucket.test/logs/part-0001.csv"))
+	if err != nil || len(matches) != 0 {
+		t.Errorf("unexpected explain result: %v, %v", matches, err)
+	}
+}
+
+func TestResolverUnmatched(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+
+	conf, err := bqin.LoadConfig("testdata/config/unmatched_catch_all.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	factory := &bqin.Factory{Config: conf}
+	resolver := factory.NewResolver()
+
+	jobs, unmatched, err := resolver.ResolveWithUnmatched(context.Background(), []*bqin.S3Record{
+		MustParseRecord("s3://bqin.bucket.test/data/item/part-0001.csv"),
+		MustParseRecord("s3://bqin.bucket.test/data/user/part-0001.csv"),
+		MustParseRecord("s3://bqin.bucket.test/data/user/part-0002.csv"),
+		MustParseRecord("s3://other.bucket.test/data/user/part-0001.csv"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected resolve error: %s", err)
+	}
+	actual := make([]string, 0, len(jobs))
+	for _, j := range jobs {
+		actual = append(actual, j.LoadingDestination.String())
+	}
+	expected := []string{
+		"bqin-test-gcp.test.item",
+		"bqin-test-gcp.test.unmatched",
+		"bqin-test-gcp.test.unmatched",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Logf("actual:   %v", actual)
+		t.Logf("expected: %v", expected)
+		t.Error("unexpected destinations")
+	}
+	if len(unmatched) != 1 || unmatched[0].String() != "s3://other.bucket.test/data/user/part-0001.csv" {
+		t.Errorf("unexpected unmatched records: %v", unmatched)
+	}
+	// resolving does not count.
+	if counts := resolver.UnmatchedCounts(); len(counts) != 0 {
+		t.Errorf("unexpected unmatched counts before process: %v", counts)
+	}
+	resolver.CountUnmatched(context.Background(), unmatched, jobs)
+	expectedCounts := map[string]int64{
+		"s3://bqin.bucket.test/data/user/":  2,
+		"s3://other.bucket.test/data/user/": 1,
+	}
+	if counts := resolver.UnmatchedCounts(); !reflect.DeepEqual(counts, expectedCounts) {
+		t.Errorf("unexpected unmatched counts: %v", counts)
+	}
+
+	// checking rules does not count.
+	record := MustParseRecord("s3://other.bucket.test/data/user/part-0002.csv")
+	if _, err := resolver.Resolve(context.Background(), []*bqin.S3Record{record}); err != nil {
+		t.Fatalf("unexpected resolve error: %s", err)
+	}
+	if _, _, err := resolver.ResolveWithUnmatched(context.Background(), []*bqin.S3Record{record}); err != nil {
+		t.Fatalf("unexpected resolve error: %s", err)
+	}
+	if _, err := resolver.Explain(context.Background(), record); err != nil {
+		t.Fatalf("unexpected explain error: %s", err)
+	}
+	if counts := resolver.UnmatchedCounts(); !reflect.DeepEqual(counts, expectedCounts) {
+		t.Errorf("unexpected unmatched counts after check: %v", counts)
+	}
+}
+
+func TestResolverUnmatchedBounded(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	defer func(size int) {
+		bqin.UnmatchedCounterSize = size
+	}(bqin.UnmatchedCounterSize)
+	bqin.UnmatchedCounterSize = 2
+
+	resolver := bqin.NewResolver(nil, bqin.MatchAll, nil)
+	_, unmatched, err := resolver.ResolveWithUnmatched(context.Background(), []*bqin.S3Record{
+		MustParseRecord("s3://bqin.bucket.test/a/part-0001.csv"),
+		MustParseRecord("s3://bqin.bucket.test/b/part-0001.csv"),
+		MustParseRecord("s3://bqin.bucket.test/a/part-0002.csv"),
+		MustParseRecord("s3://bqin.bucket.test/c/part-0001.csv"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected resolve error: %s", err)
+	}
+	if len(unmatched) != 4 {
+		t.Errorf("unexpected unmatched records: %v", unmatched)
+	}
+	resolver.CountUnmatched(context.Background(), unmatched, nil)
+	expectedCounts := map[string]int64{
+		"s3://bqin.bucket.test/a/": 2,
+		"s3://bqin.bucket.test/c/": 1,
+	}
+	if counts := resolver.UnmatchedCounts(); !reflect.DeepEqual(counts, expectedCounts) {
+		t.Errorf("unexpected unmatched counts: %v", counts)
+	}
+}
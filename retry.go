@@ -0,0 +1,216 @@
+package bqin
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/kayac/bqin/internal/logger"
+	"github.com/lestrrat-go/backoff"
+	"github.com/pkg/errors"
+)
+
+const (
+	RetryStageDeleteMessage = "delete_message"
+	RetryStageTransport     = "transport"
+	RetryStageLoad          = "load"
+	RetryStagePostLoad      = "post_load"
+)
+
+// RetryOption is the exponential backoff policy.
+type RetryOption struct {
+	// number of attempts including the first call. 1 means no retry.
+	MaxAttempts int           `yaml:"max_attempts,omitempty"`
+	Interval    time.Duration `yaml:"interval,omitempty"`
+	Jitter      *float64      `yaml:"jitter,omitempty"`
+	// give up retrying after this duration from the first call, 0 means no limit.
+	MaxElapsed time.Duration `yaml:"max_elapsed,omitempty"`
+}
+
+// defaultRetryOptions are used when the stage is not configured.
+var defaultRetryOptions = map[string]*RetryOption{
+	RetryStageDeleteMessage: {MaxAttempts: 6, Interval: 500 * time.Millisecond, Jitter: float64Ptr(0.05)},
+	RetryStageTransport:     {MaxAttempts: 4, Interval: 1 * time.Second, Jitter: float64Ptr(0.05)},
+	RetryStageLoad:          {MaxAttempts: 4, Interval: 1 * time.Second, Jitter: float64Ptr(0.05)},
+	RetryStagePostLoad:      {MaxAttempts: 4, Interval: 1 * time.Second, Jitter: float64Ptr(0.05)},
+}
+
+func float64Ptr(v float64) *float64 {
+	return &v
+}
+
+func (o *RetryOption) String() string {
+	jitter := "default"
+	if o.Jitter != nil {
+		jitter = strconv.FormatFloat(*o.Jitter, 'f', -1, 64)
+	}
+	return fmt.Sprintf("max_attempts=%d interval=%s jitter=%s max_elapsed=%s", o.MaxAttempts, o.Interval, jitter, o.MaxElapsed)
+}
+
+func (o *RetryOption) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.MaxAttempts < 0 {
+		return errors.New("max_attempts must be positive")
+	}
+	if o.Interval < 0 {
+		return errors.New("interval must be positive")
+	}
+	if o.Jitter != nil && (*o.Jitter < 0 || *o.Jitter > 1) {
+		return errors.New("jitter must be between 0 and 1")
+	}
+	if o.MaxElapsed < 0 {
+		return errors.New("max_elapsed must be positive")
+	}
+	return nil
+}
+
+func (o *RetryOption) Clone() *RetryOption {
+	if o == nil {
+		return nil
+	}
+	ret := &RetryOption{}
+	ret.MergeIn(o)
+	return ret
+}
+
+func (o *RetryOption) MergeIn(other *RetryOption) {
+	if other == nil {
+		return
+	}
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = other.MaxAttempts
+	}
+	if o.Interval == 0 {
+		o.Interval = other.Interval
+	}
+	if o.Jitter == nil && other.Jitter != nil {
+		jitter := *other.Jitter
+		o.Jitter = &jitter
+	}
+	if o.MaxElapsed == 0 {
+		o.MaxElapsed = other.MaxElapsed
+	}
+}
+
+func (o *RetryOption) newPolicy() backoff.Policy {
+	opts := []backoff.Option{
+		backoff.WithInterval(o.Interval),
+		// first call is counted as retry by lestrrat-go/backoff
+		backoff.WithMaxRetries(o.MaxAttempts - 1),
+	}
+	if o.Jitter != nil {
+		opts = append(opts, backoff.WithJitterFactor(*o.Jitter))
+	}
+	if o.MaxElapsed > 0 {
+		opts = append(opts, backoff.WithMaxElapsedTime(o.MaxElapsed))
+	}
+	return backoff.NewExponential(opts...)
+}
+
+// do calls fn, and retries with backoff while the error is retryable.
+func (o *RetryOption) do(ctx context.Context, fn func() error, isRetryable func(error) bool) error {
+	if o.MaxAttempts <= 1 {
+		return fn()
+	}
+	b, cancel := o.newPolicy().Start(ctx)
+	defer cancel()
+	var err error
+	for i := 0; backoff.Continue(b); i++ {
+		if i > 0 {
+			logger.FromContext(ctx).Warnf("retry (retry count = %d), reason: %s", i, err)
+		}
+		err = fn()
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	logger.FromContext(ctx).Errorf("max retry count reached. giving up. last error: %s", err)
+	return err
+}
+
+// RetryConfig is the retry options for each stage, the top level options are the default for all stages.
+type RetryConfig struct {
+	RetryOption `yaml:",inline"`
+
+	DeleteMessage *RetryOption `yaml:"delete_message,omitempty"`
+	Transport     *RetryOption `yaml:"transport,omitempty"`
+	Load          *RetryOption `yaml:"load,omitempty"`
+	PostLoad      *RetryOption `yaml:"post_load,omitempty"`
+}
+
+func (c *RetryConfig) stages() map[string]**RetryOption {
+	return map[string]**RetryOption{
+		RetryStageDeleteMessage: &c.DeleteMessage,
+		RetryStageTransport:     &c.Transport,
+		RetryStageLoad:          &c.Load,
+		RetryStagePostLoad:      &c.PostLoad,
+	}
+}
+
+func (c *RetryConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if err := c.RetryOption.Validate(); err != nil {
+		return err
+	}
+	for stage, opt := range c.stages() {
+		if err := (*opt).Validate(); err != nil {
+			return errors.Wrap(err, stage)
+		}
+	}
+	return nil
+}
+
+func (c *RetryConfig) Clone() *RetryConfig {
+	if c == nil {
+		return nil
+	}
+	ret := &RetryConfig{}
+	ret.MergeIn(c)
+	return ret
+}
+
+// MergeIn merges other as the default.
+// stage options of the receiver are resolved before merging,
+// for the receiver's options take precedence over other's stage options.
+func (c *RetryConfig) MergeIn(other *RetryConfig) {
+	if other == nil {
+		return
+	}
+	otherStages := other.stages()
+	for stage, opt := range c.stages() {
+		if *opt == nil {
+			*opt = &RetryOption{}
+		}
+		(*opt).MergeIn(&c.RetryOption)
+		(*opt).MergeIn(*otherStages[stage])
+		(*opt).MergeIn(&other.RetryOption)
+	}
+	c.RetryOption.MergeIn(&other.RetryOption)
+}
+
+// Option returns the resolved option of the stage.
+func (c *RetryConfig) Option(stage string) *RetryOption {
+	ret := &RetryOption{}
+	if c != nil {
+		if opt, ok := c.stages()[stage]; ok {
+			ret.MergeIn(*opt)
+		}
+		ret.MergeIn(&c.RetryOption)
+	}
+	ret.MergeIn(defaultRetryOptions[stage])
+	return ret
+}
+
+// retryJob calls fn with the option of the stage, and retries while the error is retryable.
+// fn must return error classified by newJobError.
+func retryJob(ctx context.Context, c *RetryConfig, stage string, fn func() error) error {
+	return c.Option(stage).do(ctx, fn, IsRetryable)
+}
@@ -1,9 +1,12 @@
 package bqin
 
 import (
+	"context"
 	"fmt"
+	"mime"
 	"net/url"
-	"regexp"
+	"path"
+	"strconv"
 	"strings"
 
 	"cloud.google.com/go/bigquery"
@@ -17,11 +20,25 @@ const (
 )
 
 type Rule struct {
+	// referred by rule_refs of queues.
+	Name     string              `yaml:"name,omitempty"`
 	S3       *S3Soruce           `yaml:"s3"`
 	BigQuery *LoadingDestination `yaml:"big_query"`
 	Option   *JobOption          `yaml:"option"`
-
-	keyMatcher func(string) (bool, []string)
+	PreLoad  *PreLoadOption      `yaml:"pre_load,omitempty"`
+	PostLoad *PostLoadOption     `yaml:"post_load,omitempty"`
+	Retry    *RetryConfig        `yaml:"retry,omitempty"`
+
+	// rules are evaluated in descending order of priority, and in definition order for same priority.
+	Priority int `yaml:"priority,omitempty"`
+	// when match_policy is first, continue evaluating following rules after this rule matched.
+	Continue bool `yaml:"continue,omitempty"`
+	// the rule is matched only when the expression is true, evaluated after the s3 conditions.
+	When string `yaml:"when,omitempty"`
+
+	keyMatcher   keyMatcher
+	captureNames []string
+	condition    *ruleCondition
 }
 
 type LoadingDestination struct {
@@ -35,6 +52,18 @@ type S3Soruce struct {
 	Bucket    string `yaml:"bucket"`
 	KeyPrefix string `yaml:"key_prefix"`
 	KeyRegexp string `yaml:"key_regexp"`
+	KeyGlob   string `yaml:"key_glob,omitempty"`
+	KeySuffix string `yaml:"key_suffix,omitempty"`
+
+	// objects matching any of exclude patterns are not matched to the rule.
+	Exclude []*S3KeyPattern `yaml:"exclude,omitempty"`
+
+	// conditions for the object attributes, checked by HeadObject and GetObjectTagging.
+	Metadata    map[string]string `yaml:"metadata,omitempty"`
+	Tags        map[string]string `yaml:"tags,omitempty"`
+	ContentType string            `yaml:"content_type,omitempty"`
+	MinSize     int64             `yaml:"min_size,omitempty"`
+	MaxSize     int64             `yaml:"max_size,omitempty"`
 }
 
 type S3Object struct {
@@ -47,6 +76,12 @@ func (s S3Object) String() string {
 }
 
 func (r *Rule) Validate() error {
+	if r.S3 == nil {
+		return errors.New("rule.s3 is not defined")
+	}
+	if r.BigQuery == nil {
+		return errors.New("rule.bigquery is not defined")
+	}
 	if r.BigQuery.ProjectID == "" {
 		return errors.New("rule.bigquery.project_id is not defined")
 	}
@@ -56,56 +91,127 @@ func (r *Rule) Validate() error {
 	if r.BigQuery.Table == "" {
 		return errors.New("rule.bigquery.table is not defined")
 	}
+	for _, field := range [][2]string{
+		{"rule.bigquery.project_id", r.BigQuery.ProjectID},
+		{"rule.bigquery.dataset", r.BigQuery.Dataset},
+		{"rule.bigquery.table", r.BigQuery.Table},
+		{"rule.option.temporary_bucket", r.Option.getTemporaryBucket()},
+	} {
+		if _, err := parsePlaceHolderTemplate(field[1]); err != nil {
+			return errors.Wrapf(err, "%s is invalid", field[0])
+		}
+	}
 	if err := r.Option.Validate(); err != nil {
 		return errors.Wrap(err, "rule.option")
 	}
+	if r.S3.MaxSize != 0 && r.S3.MinSize > r.S3.MaxSize {
+		return errors.New("rule.s3.min_size is larger than max_size")
+	}
+	if err := r.PreLoad.Validate(); err != nil {
+		return errors.Wrap(err, "rule.pre_load")
+	}
+	if err := r.PostLoad.Validate(); err != nil {
+		return errors.Wrap(err, "rule.post_load")
+	}
+	if err := r.Retry.Validate(); err != nil {
+		return errors.Wrap(err, "rule.retry")
+	}
+	if r.When != "" {
+		condition, err := compileCondition(r.When)
+		if err != nil {
+			return errors.Wrap(err, "rule.when is invalid")
+		}
+		r.condition = condition
+	}
 	return r.buildKeyMacher()
 }
 
 func (r *Rule) buildKeyMacher() error {
-	switch {
-	case r.S3.KeyPrefix != "":
-		r.keyMatcher = func(key string) (bool, []string) {
-			if strings.HasPrefix(strings.Trim(key, "/"), r.S3.KeyPrefix) {
-				return true, []string{key}
-			}
-			logger.Debugf("object key start %s.key is %s`", r.S3.KeyPrefix, key)
-			return false, nil
+	matcher, captureNames, err := r.S3.keyPattern().buildKeyMatcher()
+	if err != nil {
+		return errors.Wrap(err, "rule.s3")
+	}
+	excludes := make([]keyMatcher, 0, len(r.S3.Exclude))
+	for i, p := range r.S3.Exclude {
+		if p == nil {
+			return errors.Errorf("rule.s3.exclude[%d] is empty", i)
 		}
-	case r.S3.KeyRegexp != "":
-		reg, err := regexp.Compile(r.S3.KeyRegexp)
+		m, _, err := p.buildKeyMatcher()
 		if err != nil {
-			return errors.Wrap(err, "rule.s3.key_regexp is invalid")
+			return errors.Wrapf(err, "rule.s3.exclude[%d]", i)
 		}
-		r.keyMatcher = func(key string) (bool, []string) {
-			capture := reg.FindStringSubmatch(key)
-			if len(capture) == 0 {
-				logger.Debugf("object key not match regexp(%s). key is %s`", r.S3.KeyRegexp, key)
+		excludes = append(excludes, m)
+	}
+	r.captureNames = captureNames
+	r.keyMatcher = func(ctx context.Context, key string) (bool, []string) {
+		ok, capture := matcher(ctx, key)
+		if !ok {
+			return false, nil
+		}
+		for i, exclude := range excludes {
+			if ok, _ := exclude(ctx, key); ok {
+				logger.FromContext(ctx).Debugf("object key is excluded by %s. key is %s`", r.S3.Exclude[i], key)
 				return false, nil
 			}
-			return true, capture
 		}
-	default:
-		return errors.New("rule.s3.key_prefix or key_regexp is not defined")
+		return true, capture
 	}
 	return nil
 }
 
 //Match must after Valicate
-func (r *Rule) match(bucket, key string) (bool, []string) {
-	logger.Debugf("try match `s3://%s/%s` to `%s`", bucket, key, r.String())
+func (r *Rule) match(ctx context.Context, bucket, key string) (bool, []string) {
+	log := logger.FromContext(ctx)
+	log.Debugf("try match `s3://%s/%s` to `%s`", bucket, key, r.String())
 	if bucket != r.S3.Bucket {
-		logger.Debugf("bucket name is missmatch: %s is not %s`", bucket, r.S3.Bucket)
+		log.Debugf("bucket name is missmatch: %s is not %s`", bucket, r.S3.Bucket)
 		return false, nil
 	}
-	return r.keyMatcher(key)
+	return r.keyMatcher(ctx, key)
 }
 
 func (r *Rule) Match(u *url.URL) (bool, []string) {
+	return r.matchURL(context.Background(), u)
+}
+
+func (r *Rule) matchURL(ctx context.Context, u *url.URL) (bool, []string) {
 	if u.Scheme != "s3" {
 		return false, nil
 	}
-	return r.match(u.Host, strings.TrimPrefix(u.Path, "/"))
+	return r.match(ctx, u.Host, strings.TrimPrefix(u.Path, "/"))
+}
+
+// namedCaptures returns captures by index and name of the key_regexp.
+// example: data/(?P<table>.+)/part-([0-9]+).csv => {"0": ..., "1": "user", "table": "user", "2": "0001"}
+func (r *Rule) namedCaptures(capture []string) map[string]string {
+	ret := make(map[string]string, len(capture)+len(r.captureNames))
+	for i, v := range capture {
+		ret[strconv.Itoa(i)] = v
+		if i < len(r.captureNames) && r.captureNames[i] != "" {
+			ret[r.captureNames[i]] = v
+		}
+	}
+	return ret
+}
+
+// matchObject checks the object attributes, after Match.
+func (r *Rule) matchObject(ctx context.Context, obj *objectRef) (bool, error) {
+	return r.S3.matchObject(ctx, obj)
+}
+
+// matchCondition evaluates the `when` expression, after matchObject.
+func (r *Rule) matchCondition(ctx context.Context, p *placeHolder) (bool, error) {
+	if r.condition == nil {
+		return true, nil
+	}
+	ok, err := r.condition.eval(p)
+	if err != nil {
+		return false, errors.Wrapf(err, "rule.when `%s`", r.When)
+	}
+	if !ok {
+		logger.FromContext(ctx).Debugf("condition `%s` is not satisfied. key is %s", r.When, p.Key())
+	}
+	return ok, nil
 }
 
 func (r *Rule) String() string {
@@ -140,13 +246,36 @@ func (r *Rule) MergeIn(other *Rule) {
 	} else {
 		r.Option.MergeIn(other.Option)
 	}
+
+	if r.PreLoad == nil {
+		r.PreLoad = other.PreLoad.Clone()
+	} else {
+		r.PreLoad.MergeIn(other.PreLoad)
+	}
+
+	if r.PostLoad == nil {
+		r.PostLoad = other.PostLoad.Clone()
+	} else {
+		r.PostLoad.MergeIn(other.PostLoad)
+	}
+
+	if r.Retry == nil {
+		r.Retry = other.Retry.Clone()
+	} else {
+		r.Retry.MergeIn(other.Retry)
+	}
 }
 
 func (s3 S3Soruce) String() string {
-	if s3.KeyPrefix != "" {
-		return fmt.Sprintf(S3URITemplate, s3.Bucket, s3.KeyPrefix)
-	} else {
-		return fmt.Sprintf(S3URITemplate, s3.Bucket, s3.KeyRegexp)
+	return fmt.Sprintf(S3URITemplate, s3.Bucket, s3.keyPattern())
+}
+
+func (s3 *S3Soruce) keyPattern() *S3KeyPattern {
+	return &S3KeyPattern{
+		KeyPrefix: s3.KeyPrefix,
+		KeySuffix: s3.KeySuffix,
+		KeyGlob:   s3.KeyGlob,
+		KeyRegexp: s3.KeyRegexp,
 	}
 }
 
@@ -172,6 +301,79 @@ func (s3 *S3Soruce) MergeIn(other *S3Soruce) {
 	if s3.KeyRegexp == "" {
 		s3.KeyRegexp = other.KeyRegexp
 	}
+	if s3.KeyGlob == "" {
+		s3.KeyGlob = other.KeyGlob
+	}
+	if s3.KeySuffix == "" {
+		s3.KeySuffix = other.KeySuffix
+	}
+	if len(s3.Exclude) == 0 {
+		s3.Exclude = append([]*S3KeyPattern{}, other.Exclude...)
+	}
+	if len(s3.Metadata) == 0 && len(other.Metadata) != 0 {
+		s3.Metadata = make(map[string]string, len(other.Metadata))
+		for k, v := range other.Metadata {
+			s3.Metadata[k] = v
+		}
+	}
+	if len(s3.Tags) == 0 && len(other.Tags) != 0 {
+		s3.Tags = make(map[string]string, len(other.Tags))
+		for k, v := range other.Tags {
+			s3.Tags[k] = v
+		}
+	}
+	if s3.ContentType == "" {
+		s3.ContentType = other.ContentType
+	}
+	if s3.MinSize == 0 {
+		s3.MinSize = other.MinSize
+	}
+	if s3.MaxSize == 0 {
+		s3.MaxSize = other.MaxSize
+	}
+}
+
+func (s3 *S3Soruce) needsHead() bool {
+	return len(s3.Metadata) != 0 || s3.ContentType != "" || s3.MinSize != 0 || s3.MaxSize != 0
+}
+
+func (s3 *S3Soruce) matchObject(ctx context.Context, obj *objectRef) (bool, error) {
+	log := logger.FromContext(ctx)
+	if s3.needsHead() {
+		info, err := obj.Info()
+		if err != nil {
+			return false, err
+		}
+		for k, v := range s3.Metadata {
+			if actual, ok := info.Metadata[strings.ToLower(k)]; !ok || actual != v {
+				log.Debugf("object metadata %s is missmatch: `%s` is not `%s`", k, actual, v)
+				return false, nil
+			}
+		}
+		if s3.ContentType != "" {
+			if mediaType, _, _ := mime.ParseMediaType(info.ContentType); mediaType != s3.ContentType {
+				log.Debugf("object content type is missmatch: `%s` is not `%s`", info.ContentType, s3.ContentType)
+				return false, nil
+			}
+		}
+		if info.Size < s3.MinSize || (s3.MaxSize != 0 && info.Size > s3.MaxSize) {
+			log.Debugf("object size %d is out of range", info.Size)
+			return false, nil
+		}
+	}
+	if len(s3.Tags) != 0 {
+		tags, err := obj.Tags()
+		if err != nil {
+			return false, err
+		}
+		for k, v := range s3.Tags {
+			if actual, ok := tags[k]; !ok || actual != v {
+				log.Debugf("object tag %s is missmatch: `%s` is not `%s`", k, actual, v)
+				return false, nil
+			}
+		}
+	}
+	return true, nil
 }
 
 func (bq LoadingDestination) String() string {
@@ -217,7 +419,7 @@ func (o *JobOption) Validate() error {
 		return errors.New("source_format is not supported")
 	}
 	if o.getAutoDetect() && !o.SourceFormat.Is(CSV, JSON) {
-		logger.Infof("auto_detect works only when source_format is csv or json")
+		logger.Warnf("auto_detect works only when source_format is csv or json")
 	}
 	return nil
 }
@@ -247,6 +449,24 @@ func (o *JobOption) MergeIn(other *JobOption) {
 
 }
 
+// effective returns the option with omitted flags filled by the default.
+func (o *JobOption) effective() *JobOption {
+	if o == nil {
+		return nil
+	}
+	ret := o.Clone()
+	gzip, autoDetect := o.getCompression() == bigquery.Gzip, o.getAutoDetect()
+	ret.GZip, ret.AutoDetect = &gzip, &autoDetect
+	return ret
+}
+
+func (o *JobOption) getTemporaryBucket() string {
+	if o == nil {
+		return ""
+	}
+	return o.TemporaryBucket
+}
+
 func (o *JobOption) getCompression() bigquery.Compression {
 	if o.GZip == nil {
 		return bigquery.None
@@ -267,3 +487,160 @@ func (o *JobOption) getAutoDetect() bool {
 func (o *JobOption) getSourceFormat() bigquery.DataFormat {
 	return o.SourceFormat.toBigQuery()
 }
+
+// PreLoadOption is checks for the source object before transport.
+// the object that does not pass the checks is skipped, and it is not treated as failure.
+type PreLoadOption struct {
+	MinSize      int64    `yaml:"min_size,omitempty" json:"min_size,omitempty"`
+	MaxSize      int64    `yaml:"max_size,omitempty" json:"max_size,omitempty"`
+	ContentTypes []string `yaml:"content_types,omitempty" json:"content_types,omitempty"`
+	SkipPatterns []string `yaml:"skip_patterns,omitempty" json:"skip_patterns,omitempty"`
+}
+
+func (o *PreLoadOption) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.MinSize < 0 || o.MaxSize < 0 {
+		return errors.New("min_size and max_size must be positive")
+	}
+	if o.MaxSize != 0 && o.MinSize > o.MaxSize {
+		return errors.New("min_size is larger than max_size")
+	}
+	for i, ct := range o.ContentTypes {
+		if _, _, err := mime.ParseMediaType(ct); err != nil {
+			return errors.Wrapf(err, "content_types[%d] is invalid", i)
+		}
+	}
+	for i, pattern := range o.SkipPatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "skip_patterns[%d] is invalid", i)
+		}
+	}
+	return nil
+}
+
+func (o *PreLoadOption) Clone() *PreLoadOption {
+	if o == nil {
+		return nil
+	}
+	ret := &PreLoadOption{}
+	ret.MergeIn(o)
+	return ret
+}
+
+func (o *PreLoadOption) MergeIn(other *PreLoadOption) {
+	if other == nil {
+		return
+	}
+	if o.MinSize == 0 {
+		o.MinSize = other.MinSize
+	}
+	if o.MaxSize == 0 {
+		o.MaxSize = other.MaxSize
+	}
+	if len(o.ContentTypes) == 0 {
+		o.ContentTypes = append([]string{}, other.ContentTypes...)
+	}
+	if len(o.SkipPatterns) == 0 {
+		o.SkipPatterns = append([]string{}, other.SkipPatterns...)
+	}
+}
+
+// example: skip_patterns `_SUCCESS` matches s3://bucket/data/_SUCCESS
+func (o *PreLoadOption) matchSkipPattern(u *url.URL) (string, bool) {
+	key := strings.TrimPrefix(u.Path, "/")
+	for _, pattern := range o.SkipPatterns {
+		if ok, _ := path.Match(pattern, key); ok {
+			return pattern, true
+		}
+		if ok, _ := path.Match(pattern, path.Base(key)); ok {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+func (o *PreLoadOption) needsHead() bool {
+	return o.MinSize != 0 || o.MaxSize != 0 || len(o.ContentTypes) != 0
+}
+
+// Check returns error caused by ErrSkipObject, when the object does not pass the checks.
+func (o *PreLoadOption) Check(info *S3ObjectInfo) error {
+	if info.Size < o.MinSize {
+		return errors.Wrapf(ErrSkipObject, "object size %d is smaller than min_size %d", info.Size, o.MinSize)
+	}
+	if o.MaxSize != 0 && info.Size > o.MaxSize {
+		return errors.Wrapf(ErrSkipObject, "object size %d is larger than max_size %d", info.Size, o.MaxSize)
+	}
+	if len(o.ContentTypes) == 0 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(info.ContentType)
+	for _, ct := range o.ContentTypes {
+		if ct == mediaType {
+			return nil
+		}
+		if strings.HasSuffix(ct, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(ct, "*")) {
+			return nil
+		}
+	}
+	return errors.Wrapf(ErrSkipObject, "content type `%s` is not allowed", info.ContentType)
+}
+
+// PostLoadOption is queries executed after the load job successed.
+// each query can use placeholders, `$N` is expanded by key captures and `{{ .Table }}` is expanded by loading destination.
+type PostLoadOption struct {
+	Queries     []string `yaml:"queries" json:"queries"`
+	IgnoreError *bool    `yaml:"ignore_error,omitempty" json:"ignore_error,omitempty"`
+}
+
+func (o *PostLoadOption) Validate() error {
+	if o == nil {
+		return nil
+	}
+	for i, q := range o.Queries {
+		if strings.TrimSpace(q) == "" {
+			return errors.Errorf("queries[%d] is empty", i)
+		}
+		if _, err := parseQueryTemplate(q); err != nil {
+			return errors.Wrapf(err, "queries[%d] is invalid", i)
+		}
+	}
+	return nil
+}
+
+func (o *PostLoadOption) Clone() *PostLoadOption {
+	if o == nil {
+		return nil
+	}
+	ret := &PostLoadOption{}
+	ret.MergeIn(o)
+	return ret
+}
+
+func (o *PostLoadOption) MergeIn(other *PostLoadOption) {
+	if other == nil {
+		return
+	}
+	if len(o.Queries) == 0 {
+		o.Queries = append([]string{}, other.Queries...)
+	}
+	if o.IgnoreError == nil {
+		o.IgnoreError = other.IgnoreError
+	}
+}
+
+func (o *PostLoadOption) getQueries() []string {
+	if o == nil {
+		return nil
+	}
+	return o.Queries
+}
+
+func (o *PostLoadOption) getIgnoreError() bool {
+	if o == nil || o.IgnoreError == nil {
+		return false
+	}
+	return *o.IgnoreError
+}
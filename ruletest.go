@@ -0,0 +1,108 @@
+package bqin
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+
+	goconfig "github.com/kayac/go-config"
+	"github.com/pkg/errors"
+)
+
+// RuleTestCase is the expected resolution of the object.
+type RuleTestCase struct {
+	URI string `yaml:"uri"`
+	// destination tables as `project.dataset.table` in resolved order. empty means no rules matched.
+	Tables []string `yaml:"tables"`
+}
+
+// RuleTestSuite is the rule test fixture file.
+type RuleTestSuite struct {
+	Tests []*RuleTestCase `yaml:"tests"`
+}
+
+func LoadRuleTestSuite(path string) (*RuleTestSuite, error) {
+	suite := &RuleTestSuite{}
+	if err := goconfig.LoadWithEnv(suite, path); err != nil {
+		return nil, errors.Wrapf(err, "%s load failed", path)
+	}
+	for i, c := range suite.Tests {
+		if c.URI == "" {
+			return nil, errors.Errorf("%s: tests[%d] uri is not defined", path, i)
+		}
+	}
+	return suite, nil
+}
+
+// RuleTestResult is the actual resolution of the test case.
+type RuleTestResult struct {
+	*RuleTestCase
+	Actual []string
+	Err    error
+}
+
+func (r *RuleTestResult) OK() bool {
+	if r.Err != nil || len(r.Actual) != len(r.Tables) {
+		return false
+	}
+	return len(r.Actual) == 0 || reflect.DeepEqual(r.Actual, r.Tables)
+}
+
+// Diff returns expected tables with `-` and actual tables with `+`.
+func (r *RuleTestResult) Diff() string {
+	if r.Err != nil {
+		return fmt.Sprintf("  error: %s\n", r.Err)
+	}
+	var b strings.Builder
+	for _, t := range formatRuleTestTables(r.Tables) {
+		fmt.Fprintf(&b, "  - %s\n", t)
+	}
+	for _, t := range formatRuleTestTables(r.Actual) {
+		fmt.Fprintf(&b, "  + %s\n", t)
+	}
+	return b.String()
+}
+
+func (r *RuleTestResult) String() string {
+	status := "ok"
+	if !r.OK() {
+		status = "FAIL"
+	}
+	return fmt.Sprintf("%s\t%s => %s", status, r.URI, strings.Join(formatRuleTestTables(r.Actual), ", "))
+}
+
+func formatRuleTestTables(tables []string) []string {
+	if len(tables) == 0 {
+		return []string{"(no match)"}
+	}
+	return tables
+}
+
+// RunRuleTests resolves the objects of the test cases, no objects are transported or loaded.
+func (r *Resolver) RunRuleTests(ctx context.Context, suite *RuleTestSuite) []*RuleTestResult {
+	results := make([]*RuleTestResult, 0, len(suite.Tests))
+	for _, c := range suite.Tests {
+		result := &RuleTestResult{RuleTestCase: c, Actual: []string{}}
+		results = append(results, result)
+		loc, err := url.Parse(c.URI)
+		if err != nil {
+			result.Err = err
+			continue
+		}
+		if loc.Scheme != "s3" {
+			result.Err = errors.New("uri is not s3 uri")
+			continue
+		}
+		jobs, err := r.Resolve(ctx, []*S3Record{NewS3Record(loc)})
+		if err != nil {
+			result.Err = err
+			continue
+		}
+		for _, job := range jobs {
+			result.Actual = append(result.Actual, job.LoadingDestination.String())
+		}
+	}
+	return results
+}
@@ -0,0 +1,62 @@
+package bqin_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kayac/bqin"
+	"github.com/kayac/bqin/internal/logger"
+)
+
+func TestRunRuleTests(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+
+	conf, err := bqin.LoadConfig("testdata/config/match_policy_first.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	factory := &bqin.Factory{Config: conf}
+	resolver := factory.NewResolver()
+
+	cases := []struct {
+		Path     string
+		Expected []bool
+	}{
+		{
+			Path:     "testdata/ruletest/match_policy_first.yaml",
+			Expected: []bool{true, true, true},
+		},
+		{
+			Path:     "testdata/ruletest/broken.yaml",
+			Expected: []bool{false, false, false},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.Path, func(t *testing.T) {
+			suite, err := bqin.LoadRuleTestSuite(c.Path)
+			if err != nil {
+				t.Fatalf("unexpected load error: %s", err)
+			}
+			results := resolver.RunRuleTests(context.Background(), suite)
+			if len(results) != len(c.Expected) {
+				t.Fatalf("unexpected results count: %d", len(results))
+			}
+			for i, result := range results {
+				t.Logf("%s\n%s", result, result.Diff())
+				if result.OK() != c.Expected[i] {
+					t.Errorf("tests[%d] unexpected result: %s", i, result)
+				}
+			}
+		})
+	}
+
+	results := resolver.RunRuleTests(context.Background(), &bqin.RuleTestSuite{
+		Tests: []*bqin.RuleTestCase{
+			{URI: "s3://bqin.bucket.test/data/item/part-0001.csv", Tables: []string{"bqin-test-gcp.test.item"}},
+		},
+	})
+	expected := "  - bqin-test-gcp.test.item\n  + bqin-test-gcp.test.item_0001\n"
+	if diff := results[0].Diff(); diff != expected {
+		t.Errorf("unexpected diff:\n%s", diff)
+	}
+}
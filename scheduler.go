@@ -0,0 +1,103 @@
+package bqin
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// SchedulerBeatInterval is the interval of beats of the health check, while waiting for a slot.
+var SchedulerBeatInterval = 10 * time.Second
+
+// fairScheduler limits the number of messages processed at once over queues.
+// when slots are exhausted, released slots are granted to the waiting queues in round robin,
+// so a busy queue does not starve other queues.
+type fairScheduler struct {
+	mu      sync.Mutex
+	free    int
+	queues  []string
+	waiters map[string][]chan struct{}
+	next    int
+}
+
+func newFairScheduler(max int, queues []string) *fairScheduler {
+	if max <= 0 {
+		return nil
+	}
+	return &fairScheduler{
+		free:    max,
+		queues:  queues,
+		waiters: make(map[string][]chan struct{}, len(queues)),
+	}
+}
+
+// acquire waits for a slot for the queue until ctx is done.
+// beat is called every SchedulerBeatInterval while waiting, for the worker not to be reported as stuck.
+func (s *fairScheduler) acquire(ctx context.Context, queue string, beat func()) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	if s.free > 0 {
+		s.free--
+		s.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	s.waiters[queue] = append(s.waiters[queue], ch)
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(SchedulerBeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ch:
+			return nil
+		case <-ticker.C:
+			if beat != nil {
+				beat()
+			}
+			continue
+		case <-ctx.Done():
+		}
+		break
+	}
+	s.mu.Lock()
+	select {
+	case <-ch:
+		// granted while canceling, pass the slot to others.
+		s.mu.Unlock()
+		s.release()
+		return ctx.Err()
+	default:
+	}
+	waiters := s.waiters[queue]
+	for i, w := range waiters {
+		if w == ch {
+			s.waiters[queue] = append(waiters[:i:i], waiters[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+	return ctx.Err()
+}
+
+// release returns the slot, it is granted to the next queue which has waiters.
+func (s *fairScheduler) release() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < len(s.queues); i++ {
+		idx := (s.next + i) % len(s.queues)
+		queue := s.queues[idx]
+		if waiters := s.waiters[queue]; len(waiters) > 0 {
+			s.waiters[queue] = waiters[1:]
+			s.next = idx + 1
+			close(waiters[0])
+			return
+		}
+	}
+	s.free++
+}
@@ -0,0 +1,136 @@
+package bqin_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kayac/bqin"
+)
+
+func waitWaiting(t *testing.T, waiting func() int, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for waiting() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("waiters are not %d: %d", n, waiting())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFairSchedulerMaxConcurrency(t *testing.T) {
+	s := bqin.NewFairScheduler(2, []string{"a", "b"})
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := s.Acquire(ctx, "a"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := s.Acquire(timeoutCtx, "b"); err != context.DeadlineExceeded {
+		t.Fatalf("acquire over max_concurrency must wait, but returned %v", err)
+	}
+	s.Release()
+	if err := s.Acquire(ctx, "b"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if s := bqin.NewFairScheduler(0, []string{"a"}); s != nil {
+		t.Error("scheduler without limit must be nil")
+	}
+}
+
+func TestFairSchedulerFairness(t *testing.T) {
+	s := bqin.NewFairScheduler(1, []string{"a", "b"})
+	ctx := context.Background()
+	if err := s.Acquire(ctx, "a"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	granted := make(chan string)
+	acquire := func(queue string, n int) {
+		go func() {
+			if err := s.Acquire(ctx, queue); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			granted <- queue
+		}()
+		waitWaiting(t, func() int { return s.Waiting(queue) }, n)
+	}
+	// waiters of b come after all waiters of a.
+	acquire("a", 1)
+	acquire("a", 2)
+	acquire("a", 3)
+	acquire("b", 1)
+
+	var order []string
+	for i := 0; i < 4; i++ {
+		s.Release()
+		order = append(order, <-granted)
+	}
+	expected := []string{"a", "b", "a", "a"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("slots must be granted in turn of queues: %v", order)
+	}
+}
+
+func TestFairSchedulerCancel(t *testing.T) {
+	s := bqin.NewFairScheduler(1, []string{"a", "b"})
+	if err := s.Acquire(context.Background(), "a"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Acquire(ctx, "b")
+	}()
+	waitWaiting(t, func() int { return s.Waiting("b") }, 1)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("canceled acquire must return context.Canceled: %v", err)
+	}
+	if n := s.Waiting("b"); n != 0 {
+		t.Errorf("canceled waiter must be removed: %d", n)
+	}
+
+	// the released slot is not granted to the canceled waiter.
+	s.Release()
+	timeoutCtx, cancelTimeout := context.WithTimeout(context.Background(), time.Second)
+	defer cancelTimeout()
+	if err := s.Acquire(timeoutCtx, "a"); err != nil {
+		t.Fatalf("released slot must be free: %s", err)
+	}
+}
+
+func TestFairSchedulerBeat(t *testing.T) {
+	defer func(d time.Duration) {
+		bqin.SchedulerBeatInterval = d
+	}(bqin.SchedulerBeatInterval)
+	bqin.SchedulerBeatInterval = 10 * time.Millisecond
+
+	s := bqin.NewFairScheduler(1, []string{"a", "b"})
+	if err := s.Acquire(context.Background(), "a"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	beats := make(chan struct{}, 100)
+	done := make(chan error)
+	go func() {
+		done <- s.AcquireWithBeat(context.Background(), "b", func() {
+			beats <- struct{}{}
+		})
+	}()
+	// the waiting worker beats the health check.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-beats:
+		case <-time.After(5 * time.Second):
+			t.Fatal("waiting worker does not beat")
+		}
+	}
+	s.Release()
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
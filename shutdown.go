@@ -0,0 +1,56 @@
+package bqin
+
+import (
+	"context"
+	"time"
+
+	"github.com/kayac/bqin/internal/logger"
+)
+
+const (
+	// DefaultDrainTimeout is shorter than the default grace period of ECS and Kubernetes (30s).
+	DefaultDrainTimeout = 25 * time.Second
+	// DefaultCleanupTimeout is the timeout for deleting temporary objects after the job is finished or canceled.
+	DefaultCleanupTimeout = 10 * time.Second
+)
+
+// detachedContext has values of the parent, but it is not canceled by the parent.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// drainContext returns the context for processing the received message.
+// it is not canceled when ctx is done, but drainTimeout after that. zero drainTimeout waits for the message without limit.
+func drainContext(ctx context.Context, drainTimeout time.Duration) (context.Context, context.CancelFunc) {
+	drainCtx, cancel := context.WithCancel(detachedContext{ctx})
+	go func() {
+		select {
+		case <-drainCtx.Done():
+			return
+		case <-ctx.Done():
+		}
+		if drainTimeout <= 0 {
+			logger.FromContext(drainCtx).Infof("shutting down, wait for the message in process")
+			return
+		}
+		logger.FromContext(drainCtx).Infof("shutting down, wait for the message in process up to %s", drainTimeout)
+		timer := time.NewTimer(drainTimeout)
+		defer timer.Stop()
+		select {
+		case <-drainCtx.Done():
+		case <-timer.C:
+			logger.FromContext(drainCtx).Warnf("drain timeout exceeded, cancel the message in process")
+			cancel()
+		}
+	}()
+	return drainCtx, cancel
+}
+
+// cleanupContext returns the context for deleting temporary objects, even if ctx is canceled by shutdown.
+func cleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(detachedContext{ctx}, DefaultCleanupTimeout)
+}
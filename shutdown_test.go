@@ -0,0 +1,89 @@
+package bqin_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kayac/bqin"
+	"github.com/kayac/bqin/internal/logger"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	cases := []struct {
+		name          string
+		delay         time.Duration
+		drainTimeout  time.Duration
+		expectDeleted int
+		expectLoaded  bool
+	}{
+		{
+			name:          "drained",
+			delay:         300 * time.Millisecond,
+			drainTimeout:  5 * time.Second,
+			expectDeleted: 1,
+			expectLoaded:  true,
+		},
+		{
+			name:          "drain_timeout",
+			delay:         time.Minute,
+			drainTimeout:  100 * time.Millisecond,
+			expectDeleted: 0,
+			expectLoaded:  false,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+			mgr := NewStubManager("testdata/s3/")
+			defer mgr.Close()
+			mgr.BigQuery.Delay = c.delay
+			if err := mgr.SQS.SendMessagesFromFile([]string{"testdata/sqs/user.json"}); err != nil {
+				t.Fatalf("Prepare failed, load message body %s:", err)
+			}
+			conf, err := bqin.LoadConfig("testdata/config/standard.yaml")
+			if err != nil {
+				t.Fatalf("Prepare failed, load configure  %s:", err)
+			}
+			mgr.OverwriteConfig(conf)
+
+			// shutdown while processing the first message, after it is received
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mgr.BigQuery.OnRequest = func(_ *http.Request) {
+				cancel()
+			}
+			start := time.Now()
+			if err := bqin.NewApp(conf).Run(ctx, bqin.WithDrainTimeout(c.drainTimeout)); err != nil {
+				t.Fatalf("unexpected run error: %s", err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("shutdown takes too long: %s", elapsed)
+			}
+			if n := mgr.SQS.NumberOfMessagesReceived; n != 1 {
+				t.Errorf("receiving must stop at shutdown, but received %d times", n)
+			}
+			if n := mgr.SQS.NumberOfMessagesDeleted; n != c.expectDeleted {
+				t.Errorf("unexpected deleted messages: %d", n)
+			}
+			if loaded := len(mgr.BigQuery.LoadedData()) > 0; loaded != c.expectLoaded {
+				t.Errorf("unexpected loaded: %v", mgr.BigQuery.LoadedData())
+			}
+			if objects := mgr.CloudStorage.Objects(); len(objects) != 0 {
+				t.Errorf("temporary objects are not cleaned up: %v", objects)
+			}
+			if c.expectDeleted > 0 {
+				return
+			}
+			if len(mgr.SQS.VisibilityTimeouts) != 1 {
+				t.Fatalf("message is not released: %v", mgr.SQS.VisibilityTimeouts)
+			}
+			for id, timeout := range mgr.SQS.VisibilityTimeouts {
+				if timeout != 0 {
+					t.Errorf("visibility timeout of %s is not 0: %d", id, timeout)
+				}
+			}
+		})
+	}
+}
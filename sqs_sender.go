@@ -0,0 +1,68 @@
+package bqin
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+)
+
+// sqsSender sends messages to the queue, such as unmatched and failure queue.
+type sqsSender struct {
+	//for sqs client session
+	sess *session.Session
+
+	mu        sync.Mutex
+	queueName string
+	queueURL  string
+}
+
+func newSQSSender(queueName string, sess *session.Session) *sqsSender {
+	return &sqsSender{
+		sess:      sess,
+		queueName: queueName,
+	}
+}
+
+func (s *sqsSender) send(ctx context.Context, body string, attributes map[string]string) error {
+	qurl, err := s.getQueueURL(ctx)
+	if err != nil {
+		return err
+	}
+	input := &sqs.SendMessageInput{
+		QueueUrl:    aws.String(qurl),
+		MessageBody: aws.String(body),
+	}
+	if len(attributes) > 0 {
+		input.MessageAttributes = make(map[string]*sqs.MessageAttributeValue, len(attributes))
+		for name, value := range attributes {
+			input.MessageAttributes[name] = &sqs.MessageAttributeValue{
+				DataType:    aws.String("String"),
+				StringValue: aws.String(value),
+			}
+		}
+	}
+	if _, err := sqs.New(s.sess).SendMessageWithContext(ctx, input); err != nil {
+		return errors.Wrapf(err, "send message to %s failed", s.queueName)
+	}
+	return nil
+}
+
+func (s *sqsSender) getQueueURL(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queueURL != "" {
+		return s.queueURL, nil
+	}
+	res, err := sqs.New(s.sess).GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{
+		QueueName: aws.String(s.queueName),
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot get sqs queue url")
+	}
+	s.queueURL = *res.QueueUrl
+	return s.queueURL, nil
+}
@@ -0,0 +1,177 @@
+package bqin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/kayac/bqin/internal/otlp"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// TracingConfig is the OpenTelemetry tracing options. tracing is disabled when endpoint is empty.
+type TracingConfig struct {
+	// OTLP/HTTP endpoint, spans are posted to `<endpoint>/v1/traces` in JSON encoding.
+	Endpoint string            `yaml:"endpoint,omitempty"`
+	Headers  map[string]string `yaml:"headers,omitempty"`
+	// ratio of sampled traces (0 - 1), default is 1. sampling decision of the parent is respected.
+	SamplingRatio *float64 `yaml:"sampling_ratio,omitempty"`
+	ServiceName   string   `yaml:"service_name,omitempty"`
+}
+
+func (c *TracingConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.SamplingRatio != nil && (*c.SamplingRatio < 0 || *c.SamplingRatio > 1) {
+		return errors.New("sampling_ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+func (c *TracingConfig) IsEnabled() bool {
+	return c != nil && c.Endpoint != ""
+}
+
+// SetupTracing sets the global tracer provider. returned func flushes and shutdowns the provider.
+// when tracing is disabled, the no-op provider is kept.
+func SetupTracing(c *TracingConfig) func(context.Context) error {
+	if !c.IsEnabled() {
+		return func(context.Context) error { return nil }
+	}
+	ratio := 1.0
+	if c.SamplingRatio != nil {
+		ratio = *c.SamplingRatio
+	}
+	serviceName := c.ServiceName
+	if serviceName == "" {
+		serviceName = "bqin"
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(otlp.NewExporter(c.Endpoint, c.Headers)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName(serviceName),
+			semconv.ServiceVersion(Version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown
+}
+
+const (
+	attrMessageID     = attribute.Key("messaging.message.id")
+	attrS3URI         = attribute.Key("bqin.s3_uri")
+	attrRule          = attribute.Key("bqin.rule")
+	attrTable         = attribute.Key("bqin.table")
+	attrBigQueryJobID = attribute.Key("bqin.bigquery.job_id")
+)
+
+var tracer = otel.Tracer("github.com/kayac/bqin")
+
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends the span, and records the error if not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil && err != ErrNoMessage {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// addTracingHandlers creates a client span for each AWS API call.
+func addTracingHandlers(sess *session.Session) {
+	sess.Handlers.Validate.PushFront(func(r *request.Request) {
+		ctx, _ := tracer.Start(r.Context(), fmt.Sprintf("%s.%s", r.ClientInfo.ServiceID, r.Operation.Name),
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.RPCSystemKey.String("aws-api"),
+				semconv.RPCService(r.ClientInfo.ServiceID),
+				semconv.RPCMethod(r.Operation.Name),
+			),
+		)
+		r.SetContext(ctx)
+	})
+	sess.Handlers.Complete.PushBack(func(r *request.Request) {
+		span := trace.SpanFromContext(r.Context())
+		if r.RequestID != "" {
+			span.SetAttributes(attribute.String("aws.request_id", r.RequestID))
+		}
+		endSpan(span, r.Error)
+	})
+}
+
+// newCloudStorageClient returns the Cloud Storage client which creates a client span for each request.
+func newCloudStorageClient(ctx context.Context, opts []option.ClientOption) (*storage.Client, error) {
+	opts, err := withTracingHTTPClient(ctx, "CloudStorage", opts, storage.ScopeFullControl)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewClient(ctx, opts...)
+}
+
+// newBigQueryClient returns the BigQuery client which creates a client span for each request.
+func newBigQueryClient(ctx context.Context, projectID string, opts []option.ClientOption) (*bigquery.Client, error) {
+	opts, err := withTracingHTTPClient(ctx, "BigQuery", opts, bigquery.Scope)
+	if err != nil {
+		return nil, err
+	}
+	return bigquery.NewClient(ctx, projectID, opts...)
+}
+
+// withTracingHTTPClient appends the authenticated HTTP client of opts wrapped by tracingTransport.
+// the client libraries ignore credentials with option.WithHTTPClient, so the client is built with them here.
+func withTracingHTTPClient(ctx context.Context, service string, opts []option.ClientOption, scope string) ([]option.ClientOption, error) {
+	base := append([]option.ClientOption{option.WithScopes(scope)}, opts...)
+	client, _, err := htransport.NewClient(ctx, base...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can not get %s http client", service)
+	}
+	client.Transport = &tracingTransport{service: service, base: client.Transport}
+	return append(opts[:len(opts):len(opts)], option.WithHTTPClient(client)), nil
+}
+
+type tracingTransport struct {
+	service string
+	base    http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(req.Context(), fmt.Sprintf("%s.%s", t.service, req.Method),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethod(req.Method),
+			semconv.HTTPURL(req.URL.Redacted()),
+		),
+	)
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPStatusCode(resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	span.End()
+	return resp, nil
+}
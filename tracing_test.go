@@ -0,0 +1,130 @@
+package bqin_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/kayac/bqin"
+	"github.com/kayac/bqin/internal/logger"
+)
+
+type otlpCollector struct {
+	mu    sync.Mutex
+	spans map[string][]map[string]string
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var data struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					Name       string `json:"name"`
+					Attributes []struct {
+						Key   string `json:"key"`
+						Value struct {
+							StringValue string `json:"stringValue"`
+						} `json:"value"`
+					} `json:"attributes"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range data.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, span := range ss.Spans {
+				attrs := make(map[string]string)
+				for _, attr := range span.Attributes {
+					attrs[attr.Key] = attr.Value.StringValue
+				}
+				c.spans[span.Name] = append(c.spans[span.Name], attrs)
+			}
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	logger.Setup(logger.NewTestingLogWriter(t), GetLogLevel())
+	collector := &otlpCollector{spans: make(map[string][]map[string]string)}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	mgr := NewStubManager("testdata/s3/")
+	defer mgr.Close()
+	if err := mgr.SQS.SendMessagesFromFile([]string{"testdata/sqs/user.json"}); err != nil {
+		t.Fatalf("Prepare failed, load message body %s:", err)
+	}
+	conf, err := bqin.LoadConfig("testdata/config/standard.yaml")
+	if err != nil {
+		t.Fatalf("Prepare failed, load configure  %s:", err)
+	}
+	mgr.OverwriteConfig(conf)
+	conf.Tracing = &bqin.TracingConfig{Endpoint: server.URL}
+
+	shutdown := bqin.SetupTracing(conf.Tracing)
+	err = bqin.NewApp(conf).Run(context.Background(), bqin.WithExitNoMessage(true), bqin.WithExitError(true))
+	if err != nil {
+		t.Fatalf("unexpected run error: %s", err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown tracing failed: %s", err)
+	}
+
+	expected := map[string]map[string]string{
+		"bqin.message":       {"messaging.message.id": "*"},
+		"bqin.receive":       {},
+		"SQS.ReceiveMessage": {"rpc.method": "ReceiveMessage"},
+		"SQS.DeleteMessage":  {"rpc.method": "DeleteMessage"},
+		"bqin.job":           {"bqin.table": "bqin-test-gcp.test.user"},
+		"bqin.transport":     {"bqin.s3_uri": "s3://bqin.bucket.test/data/user/snapshot_at=20200210/part-0001.csv"},
+		"S3.GetObject":       {"rpc.service": "S3"},
+		"gcs.write":          {},
+		"bqin.load":          {"bqin.table": "bqin-test-gcp.test.user"},
+		"bigquery.load":      {"bqin.bigquery.job_id": "*"},
+		"bqin.cleanup":       {},
+		"CloudStorage.POST":  {"http.method": "POST"},
+		"BigQuery.POST":      {"http.method": "POST"},
+		"BigQuery.GET":       {"http.method": "GET"},
+	}
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	for name, attrs := range expected {
+		spans, ok := collector.spans[name]
+		if !ok {
+			t.Errorf("span %s is not exported", name)
+			continue
+		}
+		if !containsSpanAttributes(spans, attrs) {
+			t.Errorf("span %s with attributes %v is not exported: %v", name, attrs, spans)
+		}
+	}
+}
+
+// containsSpanAttributes reports whether any span has the attributes, "*" matches any non empty value.
+func containsSpanAttributes(spans []map[string]string, attrs map[string]string) bool {
+	for _, span := range spans {
+		matched := true
+		for key, value := range attrs {
+			if span[key] == "" || (value != "*" && span[key] != value) {
+				matched = false
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"net/url"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/aws/aws-sdk-go/aws"
@@ -12,6 +14,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/kayac/bqin/internal/logger"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/api/option"
 )
 
@@ -34,6 +37,8 @@ func NewTransporter(sess *session.Session, opts ...option.ClientOption) *Transpo
 type TransportJob struct {
 	Source      *url.URL
 	Destination *url.URL
+
+	Retry *RetryConfig
 }
 
 func (job *TransportJob) String() string {
@@ -43,11 +48,43 @@ func (job *TransportJob) String() string {
 type TransportJobHandle struct {
 	locator *url.URL
 	obj     *storage.ObjectHandle
+	source  *S3ObjectInfo
+}
+
+// SourceInfo returns the attributes of the source object which is transported.
+func (h *TransportJobHandle) SourceInfo() *S3ObjectInfo {
+	if h == nil {
+		return nil
+	}
+	return h.source
 }
 
-func (t *Transporter) Transport(ctx context.Context, job *TransportJob) (*TransportJobHandle, error) {
-	logger.Debugf("try %s", job)
-	reader, err := t.newReader(ctx, job.Source)
+// Transport copies the object, transient errors are retried with backoff.
+// returned error is classified as JobError.
+func (t *Transporter) Transport(ctx context.Context, job *TransportJob) (_ *TransportJobHandle, err error) {
+	ctx, span := startSpan(ctx, "bqin.transport",
+		attrS3URI.String(job.Source.String()),
+		attribute.String("bqin.gcs_uri", job.Destination.String()),
+	)
+	defer func() {
+		endSpan(span, err)
+	}()
+	start := time.Now()
+	defer func() {
+		metricTransportDuration.Observe(time.Since(start).Seconds())
+	}()
+	var handle *TransportJobHandle
+	err = retryJob(ctx, job.Retry, RetryStageTransport, func() error {
+		var err error
+		handle, err = t.transport(ctx, job)
+		return newJobError(RetryStageTransport, err)
+	})
+	return handle, err
+}
+
+func (t *Transporter) transport(ctx context.Context, job *TransportJob) (*TransportJobHandle, error) {
+	logger.FromContext(ctx).Debugf("try %s", job)
+	reader, info, err := t.newReader(ctx, job.Source)
 	if err != nil {
 		return nil, err
 	}
@@ -57,23 +94,39 @@ func (t *Transporter) Transport(ctx context.Context, job *TransportJob) (*Transp
 	if err != nil {
 		return nil, err
 	}
-	defer writer.Close()
-
-	_, err = io.Copy(writer, reader)
-	if err != nil {
-		return nil, errors.Wrap(err, "copy object failed")
+	if err := t.copy(ctx, writer, reader); err != nil {
+		return nil, err
 	}
-	logger.Debugf("toransport job successed")
+	logger.FromContext(ctx).Debugf("toransport job successed")
 	handle := &TransportJobHandle{
 		locator: job.Destination,
 		obj:     obj,
+		source:  info,
 	}
 	return handle, nil
 }
 
-func (t *Transporter) newReader(ctx context.Context, loc *url.URL) (io.ReadCloser, error) {
+func (t *Transporter) copy(ctx context.Context, writer io.WriteCloser, reader io.Reader) (err error) {
+	_, span := startSpan(ctx, "gcs.write")
+	defer func() {
+		endSpan(span, err)
+	}()
+	n, err := io.Copy(writer, reader)
+	metricTransportedBytes.Add(float64(n))
+	span.SetAttributes(attribute.Int64("bqin.bytes", n))
+	if err != nil {
+		writer.Close()
+		return errors.Wrap(err, "copy object failed")
+	}
+	if err := writer.Close(); err != nil {
+		return errors.Wrap(err, "write object to cloud storage failed")
+	}
+	return nil
+}
+
+func (t *Transporter) newReader(ctx context.Context, loc *url.URL) (io.ReadCloser, *S3ObjectInfo, error) {
 	if loc.Scheme != "s3" {
-		return nil, errors.New("source is not s3 object")
+		return nil, nil, newPermanentError("transport", "invalid source", errors.New("source is not s3 object"))
 	}
 
 	resp, err := s3.New(t.sess).GetObjectWithContext(ctx, &s3.GetObjectInput{
@@ -81,17 +134,23 @@ func (t *Transporter) newReader(ctx context.Context, loc *url.URL) (io.ReadClose
 		Key:    aws.String(loc.Path),
 	})
 	if err != nil {
-		return nil, errors.Wrap(err, "get object from s3 failed")
+		return nil, nil, errors.Wrap(err, "get object from s3 failed")
+	}
+	logger.FromContext(ctx).Debugf("get object from %s successed.", loc)
+	info := &S3ObjectInfo{
+		Size:         aws.Int64Value(resp.ContentLength),
+		ContentType:  aws.StringValue(resp.ContentType),
+		ETag:         strings.Trim(aws.StringValue(resp.ETag), `"`),
+		LastModified: aws.TimeValue(resp.LastModified),
 	}
-	logger.Debugf("get object from %s successed.", loc)
-	return resp.Body, nil
+	return resp.Body, info, nil
 }
 
 func (t *Transporter) newWriter(ctx context.Context, loc *url.URL) (io.WriteCloser, *storage.ObjectHandle, error) {
 	if loc.Scheme != "gs" {
-		return nil, nil, errors.New("destination is not google cloud storage object")
+		return nil, nil, newPermanentError("transport", "invalid destination", errors.New("destination is not google cloud storage object"))
 	}
-	gcs, err := storage.NewClient(ctx, t.opts...)
+	gcs, err := newCloudStorageClient(ctx, t.opts)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "can not get cloud storage client")
 	}
@@ -101,22 +160,27 @@ func (t *Transporter) newWriter(ctx context.Context, loc *url.URL) (io.WriteClos
 
 var ErrInvalidHandle = errors.New("invalid handle")
 
-func (h *TransportJobHandle) Cleanup(ctx context.Context) error {
+func (h *TransportJobHandle) Cleanup(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "bqin.cleanup")
+	defer func() {
+		endSpan(span, err)
+	}()
 	if h == nil {
-		logger.Errorf("try cleanup but job handle is nil")
+		logger.FromContext(ctx).Errorf("try cleanup but job handle is nil")
 		return ErrInvalidHandle
 	}
 	if h.obj == nil {
-		logger.Errorf("try cleanup but object handle is nil")
+		logger.FromContext(ctx).Errorf("try cleanup but object handle is nil")
 		return ErrInvalidHandle
 	}
-	logger.Debugf("cleanup %s", h.locator)
+	span.SetAttributes(attribute.String("bqin.gcs_uri", h.locator.String()))
+	logger.FromContext(ctx).Debugf("cleanup %s", h.locator)
 	if err := h.obj.Delete(ctx); err != nil {
 		if err != storage.ErrObjectNotExist {
-			logger.Errorf("can not delete temporary object reason: %s", err)
+			logger.FromContext(ctx).Errorf("can not delete temporary object reason: %s", err)
 			return err
 		}
-		logger.Debugf("aleady cleanuped %s", h.locator)
+		logger.FromContext(ctx).Debugf("aleady cleanuped %s", h.locator)
 	}
 	return nil
 }
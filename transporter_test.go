@@ -37,6 +37,7 @@ func TestTransporter(t *testing.T) {
 		Comment string
 		Job     *bqin.TransportJob
 		IsErr   bool
+		Class   bqin.ErrorClass
 	}{
 		{
 			Comment: "success",
@@ -53,6 +54,7 @@ func TestTransporter(t *testing.T) {
 				Destination: MustParseURL("gs://temp-bucket/my-object.csv"),
 			},
 			IsErr: true,
+			Class: bqin.ErrorPermanent,
 		},
 		{
 			Comment: "source scheme invalid",
@@ -61,6 +63,7 @@ func TestTransporter(t *testing.T) {
 				Destination: MustParseURL("gs://temp-bucket/my-object.csv"),
 			},
 			IsErr: true,
+			Class: bqin.ErrorPermanent,
 		},
 		{
 			Comment: "destination scheme invalid",
@@ -69,6 +72,7 @@ func TestTransporter(t *testing.T) {
 				Destination: MustParseURL("s3://temp-bucket/my-object.csv"),
 			},
 			IsErr: true,
+			Class: bqin.ErrorPermanent,
 		},
 	}
 
@@ -84,6 +88,9 @@ func TestTransporter(t *testing.T) {
 			if (err != nil) != c.IsErr {
 				t.Error("unexpected error state")
 			}
+			if err != nil && bqin.ErrorClassOf(err) != c.Class {
+				t.Errorf("unexpected error class: %s", bqin.ErrorClassOf(err))
+			}
 		})
 	}
 }
@@ -0,0 +1,200 @@
+package bqin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws/session"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/kayac/bqin/internal/logger"
+	"github.com/pkg/errors"
+)
+
+type UnmatchedAction string
+
+const (
+	// UnmatchedError fails the message when no jobs, and the message is retried. (default)
+	UnmatchedError UnmatchedAction = "error"
+	// UnmatchedAck logs unmatched objects, and deletes the message.
+	UnmatchedAck UnmatchedAction = "ack"
+	// UnmatchedForward sends unmatched objects to the other queue as S3 event notification.
+	UnmatchedForward UnmatchedAction = "forward"
+	// UnmatchedCatchAll routes unmatched objects to unmatched.rule.
+	UnmatchedCatchAll UnmatchedAction = "catch_all"
+)
+
+func (a UnmatchedAction) IsSupport() bool {
+	switch a {
+	case "", UnmatchedError, UnmatchedAck, UnmatchedForward, UnmatchedCatchAll:
+		return true
+	}
+	return false
+}
+
+type UnmatchedOption struct {
+	Action UnmatchedAction `yaml:"action,omitempty"`
+	// for forward
+	QueueName string `yaml:"queue_name,omitempty"`
+	// for catch_all, merged with the default rule. when no key conditions, matches all keys.
+	Rule *Rule `yaml:"rule,omitempty"`
+}
+
+func (o *UnmatchedOption) Validate(defaultRule *Rule) error {
+	if o == nil {
+		return nil
+	}
+	if !o.Action.IsSupport() {
+		return errors.Errorf("action `%s` is not supported", o.Action)
+	}
+	switch o.Action {
+	case UnmatchedForward:
+		if o.QueueName == "" {
+			return errors.New("queue_name is required for forward")
+		}
+	case UnmatchedCatchAll:
+		if o.Rule == nil {
+			return errors.New("rule is required for catch_all")
+		}
+		o.Rule.MergeIn(defaultRule.Clone())
+		if o.Rule.S3 != nil && o.Rule.S3.keyPattern().isEmpty() {
+			o.Rule.S3.KeyRegexp = ".*"
+		}
+		if err := o.Rule.Validate(); err != nil {
+			return errors.Wrap(err, "rule")
+		}
+	}
+	return nil
+}
+
+func (o *UnmatchedOption) getAction() UnmatchedAction {
+	if o == nil || o.Action == "" {
+		return UnmatchedError
+	}
+	return o.Action
+}
+
+func (o *UnmatchedOption) getCatchAllRule() *Rule {
+	if o.getAction() != UnmatchedCatchAll {
+		return nil
+	}
+	return o.Rule
+}
+
+// UnmatchedCounterSize is the max number of key prefixes counted by the unmatched counter.
+// the least recently unmatched prefix is evicted, and it is logged as new again.
+var UnmatchedCounterSize = 1000
+
+// unmatchedCounter counts unmatched objects by the key prefix (directory) of the object,
+// for noticing a new producer path without rules.
+type unmatchedCounter struct {
+	mu     sync.Mutex
+	counts *lru.Cache
+}
+
+func newUnmatchedCounter() *unmatchedCounter {
+	counts, err := lru.New(UnmatchedCounterSize)
+	if err != nil {
+		panic(err)
+	}
+	return &unmatchedCounter{
+		counts: counts,
+	}
+}
+
+func (c *unmatchedCounter) add(ctx context.Context, u *S3Record) int64 {
+	prefix := fmt.Sprintf(S3URITemplate, u.Host, path.Dir(strings.TrimPrefix(u.Path, "/"))+"/")
+	metricUnmatchedObjects.Inc()
+	c.mu.Lock()
+	var n int64 = 1
+	if v, ok := c.counts.Get(prefix); ok {
+		n = v.(int64) + 1
+	}
+	c.counts.Add(prefix, n)
+	c.mu.Unlock()
+	if n == 1 {
+		logger.FromContext(ctx).Infof("[unmatched] new path without rules: %s", prefix)
+	}
+	logger.FromContext(ctx).Debugf("[unmatched] %s is not matched to any rules (count of %s = %d)", u, prefix, n)
+	return n
+}
+
+func (c *unmatchedCounter) snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := make(map[string]int64, c.counts.Len())
+	for _, k := range c.counts.Keys() {
+		if v, ok := c.counts.Peek(k); ok {
+			ret[k.(string)] = v.(int64)
+		}
+	}
+	return ret
+}
+
+type UnmatchedHandler struct {
+	option *UnmatchedOption
+	sender *sqsSender
+}
+
+func NewUnmatchedHandler(option *UnmatchedOption, sess *session.Session) *UnmatchedHandler {
+	h := &UnmatchedHandler{
+		option: option,
+	}
+	if option.getAction() == UnmatchedForward {
+		h.sender = newSQSSender(option.QueueName, sess)
+	}
+	return h
+}
+
+func (h *UnmatchedHandler) unmatchedAction() UnmatchedAction {
+	return h.option.getAction()
+}
+
+// HandleUnmatched processes records which are matched to no rules by unmatched.action.
+// returns ErrNothingToDo when the action is error.
+func (h *UnmatchedHandler) HandleUnmatched(ctx context.Context, records []*S3Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	switch h.option.getAction() {
+	case UnmatchedAck:
+		for _, r := range records {
+			logger.FromContext(ctx).Infof("[unmatched] ack %s", r)
+		}
+		return nil
+	case UnmatchedForward:
+		return h.forward(ctx, records)
+	}
+	return ErrNothingToDo
+}
+
+func (h *UnmatchedHandler) forward(ctx context.Context, records []*S3Record) error {
+	event := events.S3Event{
+		Records: make([]events.S3EventRecord, 0, len(records)),
+	}
+	for _, r := range records {
+		record := events.S3EventRecord{
+			EventSource: "aws:s3",
+			EventTime:   r.EventTime,
+			EventName:   r.EventName,
+		}
+		record.PrincipalID.PrincipalID = r.PrincipalID
+		record.S3.Bucket.Name = r.Host
+		record.S3.Object.Key = strings.TrimPrefix(r.Path, "/")
+		record.S3.Object.Size = r.Size
+		event.Records = append(event.Records, record)
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "marshal unmatched records failed")
+	}
+	if err := h.sender.send(ctx, string(body), nil); err != nil {
+		return errors.Wrap(err, "forward unmatched records failed")
+	}
+	logger.FromContext(ctx).Infof("[unmatched] forwarded %d records to %s", len(records), h.option.QueueName)
+	return nil
+}